@@ -2,27 +2,41 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"plugin"
 	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,7 +49,9 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
 
+	"github.com/rwynn/monstache/v6/pkg/lru"
 	"github.com/rwynn/monstache/v6/pkg/oplog"
+	"github.com/rwynn/monstache/v6/pkg/query"
 
 	"github.com/BurntSushi/toml"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -51,6 +67,7 @@ import (
 	"github.com/rwynn/gtm/v2/consistent"
 	"github.com/rwynn/monstache/v6/monstachemap"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
 	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -70,12 +87,26 @@ var errorLog = log.New(os.Stderr, "ERROR ", log.Flags())
 
 var mapperPlugin func(*monstachemap.MapperPluginInput) (*monstachemap.MapperPluginOutput, error)
 var filterPlugin func(*monstachemap.MapperPluginInput) (bool, error)
+var deletePlugin func(*monstachemap.MapperPluginInput) (*monstachemap.DeletePluginOutput, error)
 var processPlugin func(*monstachemap.ProcessPluginInput) error
+var processBatchPlugin func([]*monstachemap.ProcessPluginInput) error
 var pipePlugin func(string, bool) ([]interface{}, error)
+var initPlugin func(map[string]interface{}) error
+var closePlugin func() error
+var stdioPluginProcess *stdioPlugin
+var pluginCtx, cancelPluginCtx = context.WithCancel(context.Background())
+var pluginLog monstachemap.Logger = pluginLogger{}
 var mapEnvs = make(map[string]*executionEnv)
 var filterEnvs = make(map[string]*executionEnv)
+var deleteEnvs = make(map[string]*executionEnv)
+var ddlEnvs = make(map[string]*executionEnv)
+var createIndexes = make(map[string]*createIndex)
 var pipeEnvs = make(map[string]*executionEnv)
+var queryFilters = make(map[string]*queryFilter)
 var mapIndexTypes = make(map[string]*indexMapping)
+var aggregations = make(map[string]*aggregation)
+var operationPolicies = make(map[string]*operationPolicy)
+var softDeletes = make(map[string]*softDelete)
 var relates = make(map[string][]*relation)
 var fileNamespaces = make(map[string]bool)
 var patchNamespaces = make(map[string]bool)
@@ -83,6 +114,7 @@ var tmNamespaces = make(map[string]bool)
 var routingNamespaces = make(map[string]bool)
 var mux sync.Mutex
 
+var errScriptTimeout = errors.New("Script execution timed out")
 var chunksRegex = regexp.MustCompile("\\.chunks$")
 var systemsRegex = regexp.MustCompile("system\\..+$")
 var exitStatus = 0
@@ -99,6 +131,19 @@ const fileDownloadersDefault = 10
 const relateThreadsDefault = 10
 const relateBufferDefault = 1000
 const postProcessorsDefault = 10
+const processBatchSizeDefault = 100
+const processBatchSecondsDefault = 1
+const deleteBatchSizeDefault = 500
+const deleteBatchMillisDefault = 500
+const deleteBatchSizeMax = 5000
+const tombstoneRetryOnConflict = 3
+const deleteMetaStoreMongo = "mongodb"
+const deleteMetaStoreElastic = "elasticsearch"
+const dropArchiveClose = "close"
+const dropArchiveClone = "clone"
+const lookupCacheSizeDefault = 1000
+const derivedCacheSize = 10000
+const preImageField = "fullDocumentBeforeChange"
 const redact = "REDACTED"
 const configDatabaseNameDefault = "monstache"
 const relateQueueOverloadMsg = "Relate queue is full. Skipping relate for %v.(%v) to keep pipeline healthy."
@@ -120,6 +165,17 @@ const (
 	statelessDeleteStrategy deleteStrategy = iota
 	statefulDeleteStrategy
 	ignoreDeleteStrategy
+	tombstoneDeleteStrategy
+)
+
+type scriptErrorPolicy string
+
+const (
+	defaultScriptErrorPolicy    scriptErrorPolicy = ""
+	skipScriptErrorPolicy       scriptErrorPolicy = "skip"
+	indexScriptErrorPolicy      scriptErrorPolicy = "index"
+	deadLetterScriptErrorPolicy scriptErrorPolicy = "dead-letter"
+	failScriptErrorPolicy       scriptErrorPolicy = "fail"
 )
 
 type resumeStrategy int
@@ -129,6 +185,14 @@ const (
 	tokenResumeStrategy
 )
 
+type renameStrategy int
+
+const (
+	ignoreRenameStrategy renameStrategy = iota
+	reindexRenameStrategy
+	aliasRenameStrategy
+)
+
 type buildInfo struct {
 	Version      string
 	VersionArray []int `bson:"versionArray"`
@@ -156,8 +220,24 @@ type indexClient struct {
 	lastTs             primitive.Timestamp
 	lastTsSaved        primitive.Timestamp
 	tokens             bson.M
+	ddlTokens          bson.M
 	indexC             chan *gtm.Op
 	processC           chan *gtm.Op
+	deleteC            chan *pendingDelete
+	deleteMutex        sync.Mutex
+	deletesPending     map[string]int
+	metaMutex          sync.Mutex
+	renameWg           sync.WaitGroup
+	metaPending        map[string]*pendingMeta
+	scriptUpdateMutex  sync.Mutex
+	scriptUpdateFlush  sync.Mutex
+	scriptUpdateDocs   map[string]bson.M
+	scriptUpdateWg     sync.WaitGroup
+	stopScriptUpdates  context.CancelFunc
+	ddlC               chan *gtm.Op
+	stopDDL            context.CancelFunc
+	stopArchives       context.CancelFunc
+	deleteWg           *sync.WaitGroup
 	fileC              chan *gtm.Op
 	relateC            chan *gtm.Op
 	filter             gtm.OpFilter
@@ -168,9 +248,14 @@ type indexClient struct {
 	externalShutdown   bool
 	rwmutex            sync.RWMutex
 	bulkErrs           atomic.Int64
+	failed             atomic.Bool
+	fatalOnce          sync.Once
+	stopOnce           sync.Once
 	bulkBackoff        elastic.Backoff
 	bulkBackoffC       chan time.Duration
 	bulkBackoffMax     time.Duration
+	derivedNs          sync.Map
+	derivedCache       *lru.Cache
 }
 
 type sigHandler struct {
@@ -191,9 +276,13 @@ type awsConnect struct {
 }
 
 type executionEnv struct {
-	VM     *otto.Otto
-	Script string
-	lock   *sync.Mutex
+	VM          *otto.Otto
+	Script      string
+	lock        *sync.Mutex
+	timeout     time.Duration
+	errorPolicy scriptErrorPolicy
+	cacheSize   int
+	cacheTTL    time.Duration
 }
 
 type javascript struct {
@@ -201,6 +290,20 @@ type javascript struct {
 	Script    string
 	Path      string
 	Routing   bool
+	Timeout   string
+	OnError   scriptErrorPolicy `toml:"on-error"`
+	CacheSize int               `toml:"cache-size"`
+	CacheTTL  string            `toml:"cache-ttl"`
+	Query     interface{}       // filters only; a query document or Extended JSON string
+	Pushdown  bool              // filters only; also apply the query in MongoDB
+}
+
+// queryFilter is a filter given as a MongoDB query document which is
+// matched in process and optionally pushed down to change streams and
+// direct reads
+type queryFilter struct {
+	query    *query.Query
+	pushdown bool
 }
 
 type relation struct {
@@ -217,9 +320,80 @@ type relation struct {
 }
 
 type indexMapping struct {
+	Namespace     string
+	Index         string
+	Pipeline      string
+	ScriptUpdates []*scriptUpdate `toml:"script-update"`
+	IgnoreUpdates []string        `toml:"ignore-update-fields"`
+	template      *indexTemplate
+	fromDocument  bool
+}
+
+// aggregation materializes the indexed document of a namespace by running
+// an aggregation pipeline which starts with a match on the document _id
+type aggregation struct {
+	Namespace    string
+	Pipeline     string // an Extended JSON array of stages
+	Path         string
+	AllowDiskUse bool `toml:"allow-disk-use"`
+	Timeout      string
+	stages       []interface{}
+	timeout      time.Duration
+}
+
+// operationPolicy limits the operations of a namespace which are applied to
+// Elasticsearch.  The namespace may be a collection or a whole database.
+type operationPolicy struct {
+	Namespace  string
+	Operations []string // insert, update, delete and/or drop
+}
+
+// softDelete treats inserts and updates of documents which match a
+// predicate on a field, e.g. a deletedAt timestamp, as deletes.  The
+// predicate defaults to the field being set to a value other than null.
+type softDelete struct {
 	Namespace string
-	Index     string
-	Pipeline  string
+	Field     string
+	Query     interface{} // a query document or Extended JSON string
+	query     *query.Query
+}
+
+// scriptUpdate runs a painless script against a document in another index
+// when documents in the mapping namespace change.  The id, routing, params
+// and upsert may reference fields of the changed document as {field}.
+type scriptUpdate struct {
+	Index           string
+	ID              string `toml:"id"`
+	Routing         string
+	Script          string
+	Params          map[string]interface{}
+	Upsert          map[string]interface{}
+	ScriptedUpsert  bool     `toml:"scripted-upsert"`
+	RetryOnConflict int      `toml:"retry-on-conflict"`
+	Operations      []string // insert, update and/or delete; defaults to all
+}
+
+// scriptUpdateTarget is a resolved script update saved so that it can be
+// applied when the source document is deleted
+type scriptUpdateTarget struct {
+	Entry   int                    `bson:"entry"`
+	Index   string                 `bson:"index"`
+	ID      string                 `bson:"id"`
+	Routing string                 `bson:"routing,omitempty"`
+	Params  map[string]interface{} `bson:"params,omitempty"`
+	Upsert  map[string]interface{} `bson:"upsert,omitempty"`
+}
+
+// indexTemplate is a mapping index name with {field:layout} placeholders
+// which are replaced with a time taken from the document
+type indexTemplate struct {
+	parts []indexTemplatePart
+}
+
+type indexTemplatePart struct {
+	literal string
+	field   string
+	layout  string
 }
 
 type findConf struct {
@@ -231,17 +405,23 @@ type findConf struct {
 	multi         bool
 	pipe          bool
 	pipeAllowDisk bool
+	timeout       time.Duration
+	cache         *lru.Cache
+	cacheEnabled  bool
+	cacheTTL      time.Duration
 }
 
 type findCall struct {
-	config *findConf
-	client *mongo.Client
-	query  interface{}
-	db     string
-	col    string
-	limit  int
-	sort   map[string]int
-	sel    map[string]int
+	config   *findConf
+	client   *mongo.Client
+	query    interface{}
+	db       string
+	col      string
+	limit    int
+	sort     map[string]int
+	sel      map[string]int
+	useCache bool
+	cacheTTL time.Duration
 }
 
 type logRotate struct {
@@ -252,6 +432,34 @@ type logRotate struct {
 	Compress   bool `toml:"compress"`
 }
 
+// createIndex is the body used to create the index of a collection when a
+// create event is received, before the first document arrives
+type createIndex struct {
+	Namespace string `toml:"namespace"`
+	Body      string `toml:"body"` // JSON settings and mappings
+	Path      string `toml:"path"`
+	body      map[string]interface{}
+}
+
+// dropArchive archives the indexes of dropped collections and databases
+// instead of deleting them.  The mode is close or clone.  Archives may be
+// deleted after a retention period.
+type dropArchive struct {
+	Mode      string `toml:"mode"`
+	Suffix    string `toml:"suffix"`
+	Retention string `toml:"retention"`
+	retention time.Duration
+}
+
+// tombstone configures the fields set on documents deleted with the
+// tombstone delete strategy and an optional archive index to move them to.
+// The archive index may reference the source index as {index}.
+type tombstone struct {
+	DeletedField   string `toml:"deleted-field"`
+	DeletedAtField string `toml:"deleted-at-field"`
+	ArchiveIndex   string `toml:"archive-index"`
+}
+
 type logFiles struct {
 	Info  string
 	Warn  string
@@ -271,6 +479,7 @@ type indexingMeta struct {
 	RetryOnConflict int
 	Skip            bool
 	ID              string
+	Documents       []*monstachemap.DerivedDocument
 }
 
 type gtmSettings struct {
@@ -318,13 +527,15 @@ type statusRequest struct {
 type configOptions struct {
 	EnableTemplate              bool
 	EnvDelimiter                string
-	MongoURL                    string         `toml:"mongo-url"`
-	MongoConfigURL              string         `toml:"mongo-config-url"`
-	MongoOpLogDatabaseName      string         `toml:"mongo-oplog-database-name"`
-	MongoOpLogCollectionName    string         `toml:"mongo-oplog-collection-name"`
-	GtmSettings                 gtmSettings    `toml:"gtm-settings"`
-	AWSConnect                  awsConnect     `toml:"aws-connect"`
-	LogRotate                   logRotate      `toml:"log-rotate"`
+	MongoURL                    string      `toml:"mongo-url"`
+	MongoConfigURL              string      `toml:"mongo-config-url"`
+	MongoOpLogDatabaseName      string      `toml:"mongo-oplog-database-name"`
+	MongoOpLogCollectionName    string      `toml:"mongo-oplog-collection-name"`
+	GtmSettings                 gtmSettings `toml:"gtm-settings"`
+	AWSConnect                  awsConnect  `toml:"aws-connect"`
+	LogRotate                   logRotate   `toml:"log-rotate"`
+	Tombstone                   tombstone
+	DropArchive                 dropArchive    `toml:"drop-archive"`
 	Logs                        logFiles       `toml:"logs"`
 	GraylogAddr                 string         `toml:"graylog-addr"`
 	ElasticUrls                 stringargs     `toml:"elasticsearch-urls"`
@@ -366,6 +577,8 @@ type configOptions struct {
 	DroppedCollections          bool   `toml:"dropped-collections"`
 	IndexFiles                  bool   `toml:"index-files"`
 	IndexAsUpdate               bool   `toml:"index-as-update"`
+	IndexPartialUpdates         bool   `toml:"index-partial-updates"`
+	ExpandedEvents              bool   `toml:"expanded-events"`
 	FileHighlighting            bool   `toml:"file-highlighting"`
 	DisableFilePipelinePut      bool   `toml:"disable-file-pipeline-put"`
 	EnablePatches               bool   `toml:"enable-patches"`
@@ -388,40 +601,59 @@ type configOptions struct {
 	ConfigFile                  string
 	Script                      []javascript
 	Filter                      []javascript
+	DeleteScript                []javascript   `toml:"delete-script"`
+	DDLScript                   []javascript   `toml:"ddl-script"`
+	CreateIndex                 []*createIndex `toml:"create-index"`
 	Pipeline                    []javascript
 	Mapping                     []indexMapping
+	Aggregation                 []*aggregation
+	OperationPolicy             []*operationPolicy `toml:"operation-policy"`
+	SoftDelete                  []*softDelete      `toml:"soft-delete"`
 	Relate                      []relation
 	FileNamespaces              stringargs `toml:"file-namespaces"`
 	PatchNamespaces             stringargs `toml:"patch-namespaces"`
 	Workers                     stringargs
 	Worker                      string
-	ChangeStreamNs              stringargs     `toml:"change-stream-namespaces"`
-	DirectReadNs                stringargs     `toml:"direct-read-namespaces"`
-	DirectReadSplitMax          int            `toml:"direct-read-split-max"`
-	DirectReadConcur            int            `toml:"direct-read-concur"`
-	DirectReadNoTimeout         bool           `toml:"direct-read-no-timeout"`
-	DirectReadBounded           bool           `toml:"direct-read-bounded"`
-	DirectReadStateful          bool           `toml:"direct-read-stateful"`
-	DirectReadExcludeRegex      string         `toml:"direct-read-dynamic-exclude-regex"`
-	DirectReadIncludeRegex      string         `toml:"direct-read-dynamic-include-regex"`
-	MapperPluginPath            string         `toml:"mapper-plugin-path"`
-	EnableHTTPServer            bool           `toml:"enable-http-server"`
-	HTTPServerAddr              string         `toml:"http-server-addr"`
-	TimeMachineNamespaces       stringargs     `toml:"time-machine-namespaces"`
-	TimeMachineIndexPrefix      string         `toml:"time-machine-index-prefix"`
-	TimeMachineIndexSuffix      string         `toml:"time-machine-index-suffix"`
-	TimeMachineDirectReads      bool           `toml:"time-machine-direct-reads"`
-	PipeAllowDisk               bool           `toml:"pipe-allow-disk"`
-	RoutingNamespaces           stringargs     `toml:"routing-namespaces"`
-	DeleteStrategy              deleteStrategy `toml:"delete-strategy"`
-	DeleteIndexPattern          string         `toml:"delete-index-pattern"`
-	ConfigDatabaseName          string         `toml:"config-database-name"`
-	FileDownloaders             int            `toml:"file-downloaders"`
-	RelateThreads               int            `toml:"relate-threads"`
-	RelateBuffer                int            `toml:"relate-buffer"`
-	PostProcessors              int            `toml:"post-processors"`
-	PruneInvalidJSON            bool           `toml:"prune-invalid-json"`
+	ChangeStreamNs              stringargs             `toml:"change-stream-namespaces"`
+	DirectReadNs                stringargs             `toml:"direct-read-namespaces"`
+	DirectReadSplitMax          int                    `toml:"direct-read-split-max"`
+	DirectReadConcur            int                    `toml:"direct-read-concur"`
+	DirectReadNoTimeout         bool                   `toml:"direct-read-no-timeout"`
+	DirectReadBounded           bool                   `toml:"direct-read-bounded"`
+	DirectReadStateful          bool                   `toml:"direct-read-stateful"`
+	DirectReadExcludeRegex      string                 `toml:"direct-read-dynamic-exclude-regex"`
+	DirectReadIncludeRegex      string                 `toml:"direct-read-dynamic-include-regex"`
+	MapperPluginPath            string                 `toml:"mapper-plugin-path"`
+	MapperPluginCommand         string                 `toml:"mapper-plugin-command"`
+	MapperPluginArgs            stringargs             `toml:"mapper-plugin-args"`
+	MapperPluginTimeout         string                 `toml:"mapper-plugin-timeout"`
+	MapperPluginSettings        map[string]interface{} `toml:"mapper-plugin-settings"`
+	ScriptModuleDir             string                 `toml:"script-module-dir"`
+	EnableHTTPServer            bool                   `toml:"enable-http-server"`
+	HTTPServerAddr              string                 `toml:"http-server-addr"`
+	TimeMachineNamespaces       stringargs             `toml:"time-machine-namespaces"`
+	TimeMachineIndexPrefix      string                 `toml:"time-machine-index-prefix"`
+	TimeMachineIndexSuffix      string                 `toml:"time-machine-index-suffix"`
+	TimeMachineDirectReads      bool                   `toml:"time-machine-direct-reads"`
+	PipeAllowDisk               bool                   `toml:"pipe-allow-disk"`
+	RoutingNamespaces           stringargs             `toml:"routing-namespaces"`
+	DeleteStrategy              deleteStrategy         `toml:"delete-strategy"`
+	DeleteIndexPattern          string                 `toml:"delete-index-pattern"`
+	DeleteMetaStore             string                 `toml:"delete-meta-store"`
+	DeleteMetaIndex             string                 `toml:"delete-meta-index"`
+	RenameStrategy              renameStrategy         `toml:"rename-strategy"`
+	ConfigDatabaseName          string                 `toml:"config-database-name"`
+	FileDownloaders             int                    `toml:"file-downloaders"`
+	RelateThreads               int                    `toml:"relate-threads"`
+	RelateBuffer                int                    `toml:"relate-buffer"`
+	PostProcessors              int                    `toml:"post-processors"`
+	ProcessBatchSize            int                    `toml:"process-batch-size"`
+	ProcessBatchSeconds         int                    `toml:"process-batch-seconds"`
+	DeleteBatchSize             int                    `toml:"delete-batch-size"`
+	DeleteBatchMillis           int                    `toml:"delete-batch-millis"`
+	PruneInvalidJSON            bool                   `toml:"prune-invalid-json"`
 	Debug                       bool
+	TestMappingInput            string
 	mongoClientOptions          *options.ClientOptions
 }
 
@@ -517,6 +749,19 @@ func (arg *deleteStrategy) Set(value string) (err error) {
 	return
 }
 
+func (arg *renameStrategy) String() string {
+	return fmt.Sprintf("%d", *arg)
+}
+
+func (arg *renameStrategy) Set(value string) (err error) {
+	var i int
+	if i, err = strconv.Atoi(value); err != nil {
+		return
+	}
+	*arg = renameStrategy(i)
+	return
+}
+
 func (arg *resumeStrategy) String() string {
 	return fmt.Sprintf("%d", *arg)
 }
@@ -544,6 +789,18 @@ func (config *configOptions) readShards() bool {
 	return len(config.ChangeStreamNs) == 0 && config.MongoConfigURL != ""
 }
 
+// scriptModuleDir is the directory against which javascript require calls
+// are resolved.  It defaults to the directory of the config file
+func (config *configOptions) scriptModuleDir() string {
+	if config.ScriptModuleDir != "" {
+		return config.ScriptModuleDir
+	}
+	if config.ConfigFile != "" {
+		return filepath.Dir(config.ConfigFile)
+	}
+	return "."
+}
+
 func (config *configOptions) dynamicDirectReadList() bool {
 	return len(config.DirectReadNs) == 1 && config.DirectReadNs[0] == ""
 }
@@ -558,13 +815,18 @@ func (config *configOptions) ignoreCollectionForDirectReads(col string) bool {
 
 func (ic *indexClient) afterBulk() func(int64, []elastic.BulkableRequest, *elastic.BulkResponse, error) {
 	return func(executionID int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+		ic.metaWritten(requests)
 		if response == nil || !response.Errors {
 			ic.bulkErrs.Store(0)
 			return
 		}
 		if failed := response.Failed(); failed != nil {
 			backoff := false
+			missing := missingTombstones(requests, response)
 			for _, item := range failed {
+				if missing[item] {
+					continue
+				}
 				if item.Status == http.StatusConflict {
 					// ignore version conflict since this simply means the doc
 					// is already in the index
@@ -740,6 +1002,37 @@ func (config *configOptions) testElasticsearchConn(client *elastic.Client) (err
 }
 
 func (ic *indexClient) deleteIndexes(db string) (err error) {
+	indices := dbIndexes(db)
+	if ic.config.DropArchive.Mode != "" {
+		return ic.archiveIndexes(db, indices...)
+	}
+	return ic.deleteConcreteIndexes(indices...)
+}
+
+// deleteConcreteIndexes deletes the indexes matching patterns.  Patterns
+// are resolved to concrete indexes first since an index name may be an
+// alias, e.g. one added for a renamed collection, which cannot be deleted
+// directly.
+func (ic *indexClient) deleteConcreteIndexes(patterns ...string) (err error) {
+	ctx := context.Background()
+	res, err := ic.client.IndexGet(patterns...).IgnoreUnavailable(true).AllowNoIndices(true).Do(ctx)
+	if err != nil {
+		return
+	}
+	var names []string
+	for name := range res {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	_, err = ic.client.DeleteIndex(names...).Do(ctx)
+	return
+}
+
+// dbIndexes returns the index patterns of the namespaces in db
+func dbIndexes(db string) []string {
 	var indices = []string{strings.ToLower(db + ".*")}
 	for ns, m := range mapIndexTypes {
 		dbCol := strings.SplitN(ns, ".", 2)
@@ -756,1239 +1049,2969 @@ func (ic *indexClient) deleteIndexes(db string) (err error) {
 			}
 		}
 	}
-	_, err = ic.client.DeleteIndex(indices...).Do(context.Background())
-	return
+	return indices
 }
 
 func (ic *indexClient) deleteIndex(namespace string) (err error) {
+	if ic.config.DropArchive.Mode != "" {
+		return ic.archiveIndexes(namespace, indexForNamespace(namespace))
+	}
+	return ic.deleteConcreteIndexes(indexForNamespace(namespace))
+}
+
+const archivePrefix = "archived-"
+
+// archiveIndexes archives the indexes matching patterns instead of deleting
+// them.  Each index is cloned to an index with a timestamp suffix, which is
+// added to an alias named after the index, and the original is deleted so
+// that the name is free if the collection is recreated.  In close mode the
+// clone is also closed once the archive is complete.  Each archive is recorded in the archives collection
+// so that it can be expired.
+func (ic *indexClient) archiveIndexes(source string, patterns ...string) (err error) {
 	ctx := context.Background()
-	index := strings.ToLower(namespace)
-	if m := mapIndexTypes[namespace]; m != nil {
-		if m.Index != "" {
-			index = strings.ToLower(m.Index)
+	res, err := ic.client.IndexGet(patterns...).IgnoreUnavailable(true).AllowNoIndices(true).Do(ctx)
+	if err != nil {
+		return
+	}
+	var names []string
+	for name := range res {
+		if !strings.HasPrefix(name, archivePrefix) && !strings.HasPrefix(name, ".") {
+			names = append(names, name)
 		}
 	}
-	_, err = ic.client.DeleteIndex(index).Do(ctx)
-	return err
+	sort.Strings(names)
+	archive := ic.config.DropArchive
+	now := time.Now().UTC()
+	for _, name := range names {
+		target := archivePrefix + name + "-" + now.Format(archive.Suffix)
+		if err = ic.archiveIndex(ctx, name, target); err != nil {
+			return
+		}
+		infoLog.Printf("Archived index %s of dropped %s as %s", name, source, target)
+		if e := ic.recordArchive(source, name, target, now); e != nil {
+			errorLog.Printf("Unable to record archive of index %s: %s", name, e)
+		}
+		if archive.Mode == dropArchiveClose {
+			if _, err = ic.client.CloseIndex(target).Do(ctx); err != nil {
+				return
+			}
+		}
+	}
+	return
 }
 
-func (ic *indexClient) ensureFileMapping() (err error) {
-	config := ic.config
-	if config.DisableFilePipelinePut {
+// archiveIndex clones index to target, aliases the clone and deletes index.
+// If a step fails before index is deleted the clone is removed and index is
+// unblocked so that it keeps receiving writes.
+func (ic *indexClient) archiveIndex(ctx context.Context, index, target string) (err error) {
+	if err = ic.cloneIndex(ctx, index, target); err == nil {
+		if _, err = ic.client.Alias().Add(target, archivePrefix+index).Do(ctx); err == nil {
+			_, err = ic.client.DeleteIndex(index).Do(ctx)
+		}
+	}
+	if err == nil {
+		return
+	}
+	if exists, e := ic.client.IndexExists(index).Do(ctx); e == nil && !exists {
+		// the delete went through so the clone is now the only copy
 		return nil
 	}
-	ctx := context.Background()
-	pipeline := map[string]interface{}{
-		"description": "Extract file information",
-		"processors": [1]map[string]interface{}{
-			{
-				"attachment": map[string]interface{}{
-					"field": "file",
-				},
-			},
-		},
+	ic.undoClone(ctx, index, target)
+	return
+}
+
+// undoClone removes the write block added to index by cloneIndex and
+// deletes the clone, along with its alias, if it was created
+func (ic *indexClient) undoClone(ctx context.Context, index, target string) {
+	_, err := ic.client.IndexPutSettings(index).BodyJson(map[string]interface{}{
+		"index.blocks.write": nil,
+	}).Do(ctx)
+	if err != nil {
+		errorLog.Printf("Unable to remove write block of index %s: %s", index, err)
+	}
+	if _, err = ic.client.DeleteIndex(target).IgnoreUnavailable(true).Do(ctx); err != nil {
+		errorLog.Printf("Unable to delete partial clone %s of index %s: %s", target, index, err)
 	}
-	_, err = ic.client.IngestPutPipeline("attachment").BodyJson(pipeline).Do(ctx)
-	return err
 }
 
-func (ic *indexClient) defaultIndexMapping(op *gtm.Op) *indexMapping {
-	return &indexMapping{
-		Namespace: op.Namespace,
-		Index:     strings.ToLower(op.Namespace),
+func (ic *indexClient) cloneIndex(ctx context.Context, index, target string) (err error) {
+	_, err = ic.client.IndexPutSettings(index).BodyJson(map[string]interface{}{
+		"index.blocks.write": true,
+	}).Do(ctx)
+	if err != nil {
+		return
 	}
+	_, err = ic.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   fmt.Sprintf("/%s/_clone/%s", url.PathEscape(index), url.PathEscape(target)),
+		Body: map[string]interface{}{
+			"settings": map[string]interface{}{"index.blocks.write": nil},
+		},
+	})
+	return
 }
 
-func (ic *indexClient) mapIndex(op *gtm.Op) *indexMapping {
-	mapping := ic.defaultIndexMapping(op)
-	if m := mapIndexTypes[op.Namespace]; m != nil {
-		if m.Index != "" {
-			mapping.Index = m.Index
-		}
-		if m.Pipeline != "" {
-			mapping.Pipeline = m.Pipeline
+func (ic *indexClient) archivesCollection() *mongo.Collection {
+	return ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("archives")
+}
+
+func (ic *indexClient) recordArchive(source, index, archive string, at time.Time) (err error) {
+	if ic.mongo == nil {
+		return
+	}
+	doc := bson.M{
+		"source":     source,
+		"index":      index,
+		"archive":    archive,
+		"mode":       ic.config.DropArchive.Mode,
+		"archivedAt": at,
+	}
+	if retention := ic.config.DropArchive.retention; retention > 0 {
+		doc["expiresAt"] = at.Add(retention)
+	}
+	_, err = ic.archivesCollection().InsertOne(context.Background(), doc)
+	return
+}
+
+// startArchiveRetention periodically deletes archived indexes whose
+// retention period has passed
+func (ic *indexClient) startArchiveRetention() {
+	retention := ic.config.DropArchive.retention
+	if ic.config.DropArchive.Mode == "" || retention == 0 || ic.mongo == nil {
+		return
+	}
+	interval := time.Hour
+	if retention < interval {
+		interval = retention
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ic.stopArchives = cancel
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			// only the active process of a cluster expires archives
+			if ic.isEnabled(ctx) {
+				if err := ic.expireArchives(); err != nil {
+					errorLog.Printf("Unable to expire archived indexes: %s", err)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
+}
+
+// isEnabled asks the event loop whether this process is currently enabled
+func (ic *indexClient) isEnabled(ctx context.Context) bool {
+	respC := make(chan *statusResponse, 1)
+	select {
+	case ic.statusReqC <- &statusRequest{responseC: respC}:
+	case <-ctx.Done():
+		return false
+	}
+	select {
+	case resp := <-respC:
+		return resp != nil && resp.enabled
+	case <-ctx.Done():
+		return false
 	}
-	return mapping
 }
 
-func opIDToString(op *gtm.Op) string {
-	var opIDStr string
-	switch id := op.Id.(type) {
-	case primitive.ObjectID:
-		opIDStr = id.Hex()
-	case primitive.Binary:
-		opIDStr = monstachemap.EncodeBinData(monstachemap.Binary{id})
-	case float64:
-		intID := int(id)
-		if id == float64(intID) {
-			opIDStr = fmt.Sprintf("%v", intID)
-		} else {
-			opIDStr = fmt.Sprintf("%v", op.Id)
+func (ic *indexClient) expireArchives() (err error) {
+	ctx := context.Background()
+	col := ic.archivesCollection()
+	cursor, err := col.Find(ctx, bson.M{"expiresAt": bson.M{"$lte": time.Now().UTC()}})
+	if err != nil {
+		return
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var rec struct {
+			ID      primitive.ObjectID `bson:"_id"`
+			Archive string             `bson:"archive"`
+			Mode    string             `bson:"mode"`
 		}
-	case float32:
-		intID := int(id)
-		if id == float32(intID) {
-			opIDStr = fmt.Sprintf("%v", intID)
+		if err = cursor.Decode(&rec); err != nil {
+			return
+		}
+		if rec.Mode == dropArchiveClose {
+			// only delete the index if it was not reopened or recreated
+			var rows elastic.CatIndicesResponse
+			if rows, err = ic.client.CatIndices().Index(rec.Archive).Columns("status").Do(ctx); err != nil && !elastic.IsNotFound(err) {
+				return
+			}
+			if err == nil && len(rows) == 1 && rows[0].Status == "close" {
+				_, err = ic.client.DeleteIndex(rec.Archive).Do(ctx)
+			}
 		} else {
-			opIDStr = fmt.Sprintf("%v", op.Id)
+			_, err = ic.client.DeleteIndex(rec.Archive).Do(ctx)
+		}
+		if err != nil && !elastic.IsNotFound(err) {
+			return
+		}
+		infoLog.Printf("Expired archived index %s", rec.Archive)
+		if _, err = col.DeleteOne(ctx, bson.M{"_id": rec.ID}); err != nil {
+			return
 		}
-	default:
-		opIDStr = fmt.Sprintf("%v", op.Id)
 	}
-	return opIDStr
+	return cursor.Err()
 }
 
-func convertSliceJavascript(a []interface{}) []interface{} {
-	avs := make([]interface{}, 0, len(a))
-	for _, av := range a {
-		var avc interface{}
-		switch achild := av.(type) {
-		case map[string]interface{}:
-			avc = convertMapJavascript(achild)
-		case []interface{}:
-			avc = convertSliceJavascript(achild)
-		case primitive.ObjectID:
-			avc = achild.Hex()
-		default:
-			avc = av
-		}
-		avs = append(avs, avc)
+// renameOf returns the source and target namespaces of a collection rename
+func renameOf(op *gtm.Op) (from, to string, ok bool) {
+	if op.Operation != "c" || op.Data == nil {
+		return
 	}
-	return avs
+	from, ok = op.Data["renameCollection"].(string)
+	if ok {
+		to, ok = op.Data["to"].(string)
+	}
+	return
 }
 
-func convertMapJavascript(e map[string]interface{}) map[string]interface{} {
-	o := make(map[string]interface{}, len(e))
-	for k, v := range e {
-		switch child := v.(type) {
-		case map[string]interface{}:
-			o[k] = convertMapJavascript(child)
-		case []interface{}:
-			o[k] = convertSliceJavascript(child)
-		case primitive.ObjectID:
-			o[k] = child.Hex()
-		default:
-			o[k] = v
-		}
+func renameOp(from, to string, ts primitive.Timestamp) *gtm.Op {
+	return &gtm.Op{
+		Operation: "c",
+		Namespace: strings.SplitN(from, ".", 2)[0] + ".$cmd",
+		Source:    gtm.OplogQuerySource,
+		Timestamp: ts,
+		Data: map[string]interface{}{
+			"renameCollection": from,
+			"to":               to,
+		},
 	}
-	return o
 }
 
-func fixSlicePruneInvalidJSON(id string, key string, a []interface{}) []interface{} {
-	avs := make([]interface{}, 0, len(a))
-	for _, av := range a {
-		var avc interface{}
-		switch achild := av.(type) {
-		case map[string]interface{}:
-			avc = fixPruneInvalidJSON(id, achild)
-		case []interface{}:
-			avc = fixSlicePruneInvalidJSON(id, key, achild)
-		case time.Time:
-			year := achild.Year()
-			if year < 0 || year > 9999 {
-				// year outside of valid range
-				warnLog.Printf("Dropping key %s element: invalid time.Time value: %s for document _id: %s", key, achild, id)
-				continue
-			} else {
-				avc = av
-			}
-		case float64:
-			if math.IsNaN(achild) {
-				// causes an error in the json serializer
-				warnLog.Printf("Dropping key %s element: invalid float64 value: %v for document _id: %s", key, achild, id)
-				continue
-			} else if math.IsInf(achild, 0) {
-				// causes an error in the json serializer
-				warnLog.Printf("Dropping key %s element: invalid float64 value: %v for document _id: %s", key, achild, id)
-				continue
-			} else {
-				avc = av
-			}
-		default:
-			avc = av
-		}
-		avs = append(avs, avc)
+// ddlEvents are the expanded change events surfaced when expanded-events is
+// enabled
+var ddlEvents = []string{"create", "createIndexes", "modify", "shardCollection"}
+
+// ddlOf returns the change event type of a DDL op
+func ddlOf(op *gtm.Op) (ddl string, ok bool) {
+	if op.Operation != "c" || op.Data == nil {
+		return
 	}
-	return avs
+	ddl, ok = op.Data["ddl"].(string)
+	return
 }
 
-func fixPruneInvalidJSON(id string, e map[string]interface{}) map[string]interface{} {
-	o := make(map[string]interface{}, len(e))
-	for k, v := range e {
-		switch child := v.(type) {
-		case map[string]interface{}:
-			o[k] = fixPruneInvalidJSON(id, child)
-		case []interface{}:
-			o[k] = fixSlicePruneInvalidJSON(id, k, child)
-		case time.Time:
-			year := child.Year()
-			if year < 0 || year > 9999 {
-				// year outside of valid range
-				warnLog.Printf("Dropping key %s: invalid time.Time value: %s for document _id: %s", k, child, id)
-				continue
-			} else {
-				o[k] = v
-			}
-		case float64:
-			if math.IsNaN(child) {
-				// causes an error in the json serializer
-				warnLog.Printf("Dropping key %s: invalid float64 value: %v for document _id: %s", k, child, id)
-				continue
-			} else if math.IsInf(child, 0) {
-				// causes an error in the json serializer
-				warnLog.Printf("Dropping key %s: invalid float64 value: %v for document _id: %s", k, child, id)
-				continue
-			} else {
-				o[k] = v
-			}
-		default:
-			o[k] = v
-		}
+func ddlOp(ddl, ns string, desc map[string]interface{}, ts primitive.Timestamp) *gtm.Op {
+	return &gtm.Op{
+		Operation: "c",
+		Namespace: ns,
+		Source:    gtm.OplogQuerySource,
+		Timestamp: ts,
+		Data: map[string]interface{}{
+			"ddl":                  ddl,
+			"operationDescription": desc,
+		},
 	}
-	return o
 }
 
-func deepExportValue(a interface{}) (b interface{}) {
-	switch t := a.(type) {
-	case otto.Value:
-		ex, err := t.Export()
-		if t.Class() == "Date" {
-			ex, err = time.Parse("Mon, 2 Jan 2006 15:04:05 MST", t.String())
+// startDDLWatch listens for collection renames and, when expanded events
+// are enabled, other DDL events since gtm does not emit them.  The DDL
+// events are watched on the database of each change stream namespace since
+// a rename invalidates a stream on the renamed collection.  The gtm change
+// streams themselves are not widened.  When resuming, each DDL stream
+// continues from the token saved after its last routed event.
+func (ic *indexClient) startDDLWatch(nsFilter gtm.OpFilter) {
+	config := ic.config
+	var events []string
+	if config.RenameStrategy != ignoreRenameStrategy {
+		events = append(events, "rename")
+	}
+	if config.ExpandedEvents {
+		events = append(events, ddlEvents...)
+	}
+	if len(events) == 0 || config.DisableChangeEvents || len(config.ChangeStreamNs) == 0 {
+		return
+	}
+	scopes := make(map[string]bool)
+	for _, ns := range config.ChangeStreamNs {
+		scopes[strings.SplitN(ns, ".", 2)[0]] = true
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ic.stopDDL = cancel
+	ic.ddlC = make(chan *gtm.Op)
+	for scope := range scopes {
+		go ic.watchDDL(ctx, scope, events, nsFilter)
+	}
+}
+
+func (ic *indexClient) watchDDL(ctx context.Context, scope string, events []string, nsFilter gtm.OpFilter) {
+	pipeline := []interface{}{bson.M{"$match": bson.M{"operationType": bson.M{"$in": events}}}}
+	streamID := ddlStreamID(scope)
+	resumeAfter, err := ic.loadDDLToken(streamID)
+	if err != nil {
+		errorLog.Printf("Unable to load resume token of DDL stream %s: %s", streamID, err)
+	}
+	for ctx.Err() == nil {
+		opts := options.ChangeStream()
+		if ic.config.ExpandedEvents {
+			opts.SetShowExpandedEvents(true)
 		}
-		if err == nil {
-			b = deepExportValue(ex)
+		if resumeAfter != nil {
+			opts.SetResumeAfter(resumeAfter)
+		}
+		var stream *mongo.ChangeStream
+		if scope == "" {
+			stream, err = ic.mongo.Watch(ctx, pipeline, opts)
 		} else {
-			errorLog.Printf("Error exporting from javascript: %s", err)
+			stream, err = ic.mongo.Database(scope).Watch(ctx, pipeline, opts)
 		}
-	case map[string]interface{}:
-		b = deepExportMap(t)
-	case []map[string]interface{}:
-		b = deepExportMapSlice(t)
-	case []interface{}:
-		b = deepExportSlice(t)
-	default:
-		b = a
+		if err != nil {
+			if ctx.Err() == nil {
+				errorLog.Printf("Unable to watch DDL events: %s", err)
+				time.Sleep(5 * time.Second)
+			}
+			continue
+		}
+		for stream.Next(ctx) {
+			var event struct {
+				ID                   bson.Raw               `bson:"_id"`
+				OperationType        string                 `bson:"operationType"`
+				ClusterTime          primitive.Timestamp    `bson:"clusterTime"`
+				Ns                   gtm.ChangeDocNs        `bson:"ns"`
+				To                   gtm.ChangeDocNs        `bson:"to"`
+				OperationDescription map[string]interface{} `bson:"operationDescription"`
+			}
+			if err = stream.Decode(&event); err != nil {
+				errorLog.Printf("Unable to decode DDL event: %s", err)
+				continue
+			}
+			resumeAfter = event.ID
+			ns := event.Ns.Database + "." + event.Ns.Collection
+			var op *gtm.Op
+			if event.OperationType == "rename" {
+				to := event.To.Database + "." + event.To.Collection
+				if nsFilter != nil && !nsFilter(&gtm.Op{Namespace: ns}) && !nsFilter(&gtm.Op{Namespace: to}) {
+					continue
+				}
+				op = renameOp(ns, to, event.ClusterTime)
+			} else {
+				if nsFilter != nil && !nsFilter(&gtm.Op{Namespace: ns}) {
+					continue
+				}
+				op = ddlOp(event.OperationType, ns, event.OperationDescription, event.ClusterTime)
+			}
+			op.ResumeToken = gtm.OpResumeToken{StreamID: streamID, ResumeToken: event.ID}
+			select {
+			case ic.ddlC <- op:
+			case <-ctx.Done():
+			}
+		}
+		if err = stream.Err(); err != nil && ctx.Err() == nil {
+			errorLog.Printf("Error watching DDL events: %s", err)
+			time.Sleep(5 * time.Second)
+		}
+		stream.Close(context.Background())
 	}
-	return
 }
 
-func deepExportMapSlice(a []map[string]interface{}) []interface{} {
-	avs := make([]interface{}, 0, len(a))
-	for _, av := range a {
-		avs = append(avs, deepExportMap(av))
+// ddlStreamID names the DDL stream of scope in the tokens collection
+func ddlStreamID(scope string) string {
+	if scope == "" {
+		return "ddl"
 	}
-	return avs
+	return "ddl:" + scope
 }
 
-func deepExportSlice(a []interface{}) []interface{} {
-	avs := make([]interface{}, 0, len(a))
-	for _, av := range a {
-		avs = append(avs, deepExportValue(av))
+// loadDDLToken returns the saved resume token of a DDL stream
+func (ic *indexClient) loadDDLToken(streamID string) (token interface{}, err error) {
+	if !ic.config.Resume {
+		return
 	}
-	return avs
+	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("tokens")
+	result := col.FindOne(context.Background(), bson.M{
+		"resumeName": ic.config.ResumeName,
+		"streamID":   streamID,
+	})
+	if err = result.Err(); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	doc := make(map[string]interface{})
+	if err = result.Decode(&doc); err == nil {
+		if token = doc["token"]; token != nil {
+			infoLog.Printf("Resuming DDL stream '%s' from collection %s.tokens using resume name '%s'",
+				streamID, ic.config.ConfigDatabaseName, ic.config.ResumeName)
+		}
+	}
+	return
 }
 
-func deepExportMap(e map[string]interface{}) map[string]interface{} {
-	o := make(map[string]interface{}, len(e))
-	for k, v := range e {
-		o[k] = deepExportValue(v)
+func indexForNamespace(namespace string) string {
+	index := strings.ToLower(namespace)
+	if m := mapIndexTypes[namespace]; m != nil && m.Index != "" {
+		index = strings.ToLower(m.Index)
 	}
-	return o
+	return index
 }
 
-func (ic *indexClient) mapDataJavascript(op *gtm.Op) error {
-	names := []string{"", op.Namespace}
-	for _, name := range names {
-		env := mapEnvs[name]
-		if env == nil {
-			continue
-		}
-		env.lock.Lock()
-		defer env.lock.Unlock()
-		arg := convertMapJavascript(op.Data)
-		arg2 := op.Namespace
-		arg3 := convertMapJavascript(op.UpdateDescription)
-		val, err := env.VM.Call("module.exports", arg, arg, arg2, arg3)
-		if err != nil {
-			return err
-		}
-		if strings.ToLower(val.Class()) == "object" {
-			data, err := val.Export()
-			if err != nil {
-				return err
-			} else if data == val {
-				return errors.New("Exported function must return an object")
-			} else {
-				dm := data.(map[string]interface{})
-				op.Data = deepExportMap(dm)
-			}
-		} else {
-			indexed, err := val.ToBoolean()
-			if err != nil {
-				return err
-			} else if !indexed {
-				op.Data = nil
-				break
-			}
+// sharesIndex returns true if a mapping other than the one for namespace
+// targets index
+func sharesIndex(namespace, index string) bool {
+	for ns, m := range mapIndexTypes {
+		if ns != namespace && m.Index != "" && strings.ToLower(m.Index) == index {
+			return true
 		}
 	}
-	return nil
+	return false
 }
 
-func (ic *indexClient) mapDataGolang(op *gtm.Op) error {
-	input := &monstachemap.MapperPluginInput{
-		Document:          op.Data,
-		Namespace:         op.Namespace,
-		Database:          op.GetDatabase(),
-		Collection:        op.GetCollection(),
-		Operation:         op.Operation,
-		MongoClient:       ic.mongo,
-		UpdateDescription: op.UpdateDescription,
+// doRename moves the documents of a renamed collection to the index of the
+// new namespace, either by reindexing them or by adding the new index name
+// as an alias of the old index, and updates stateful delete metadata
+func (ic *indexClient) doRename(from, to string) (err error) {
+	ctx := context.Background()
+	fromIndex, toIndex := indexForNamespace(from), indexForNamespace(to)
+	for _, ns := range []string{from, to} {
+		if m := mapIndexTypes[ns]; m != nil && m.template != nil {
+			warnLog.Printf("Not moving documents of renamed collection %s with a templated index", from)
+			return ic.renameMeta(from, to, "", "")
+		}
 	}
-	output, err := mapperPlugin(input)
-	if err != nil {
-		return err
+	if fromIndex == toIndex {
+		return ic.renameMeta(from, to, "", "")
 	}
-	if output == nil {
-		return nil
+	if sharesIndex(from, fromIndex) {
+		warnLog.Printf("Not moving documents of renamed collection %s since index %s is shared", from, fromIndex)
+		return ic.renameMeta(from, to, "", "")
 	}
-	if output.Drop {
-		op.Data = nil
-	} else {
-		if output.Skip {
-			op.Data = map[string]interface{}{}
-		} else if output.Passthrough == false {
-			if output.Document == nil {
-				return errors.New("Map function must return a non-nil document")
-			}
-			op.Data = output.Document
+	exists, err := ic.client.IndexExists(fromIndex).Do(ctx)
+	if err != nil || !exists {
+		if err == nil {
+			err = ic.renameMeta(from, to, "", "")
 		}
-		meta := make(map[string]interface{})
-		if output.Skip {
-			meta["skip"] = true
+		return
+	}
+	strategy := ic.config.RenameStrategy
+	if strategy == aliasRenameStrategy {
+		if exists, err = ic.client.IndexExists(toIndex).Do(ctx); err != nil {
+			return
 		}
-		if output.Index != "" {
-			meta["index"] = output.Index
+		if exists {
+			warnLog.Printf("Index %s already exists so reindexing renamed collection %s instead of aliasing", toIndex, from)
+			strategy = reindexRenameStrategy
+		} else {
+			if _, err = ic.client.Alias().Add(fromIndex, toIndex).Do(ctx); err == nil {
+				infoLog.Printf("Aliased index %s as %s after rename of %s to %s", fromIndex, toIndex, from, to)
+				err = ic.renameMeta(from, to, "", "")
+			}
+			return
 		}
-		if output.ID != "" {
-			meta["id"] = output.ID
+	}
+	if strategy == reindexRenameStrategy {
+		dest := elastic.NewReindexDestination().Index(toIndex)
+		if ic.config.IndexAsUpdate {
+			// without versions only missing documents are created so that
+			// documents written to the new index are not overwritten
+			dest.OpType("create")
+		} else {
+			// keep newer versions already written to the new index
+			dest.VersionType("external")
+		}
+		reindex := ic.client.Reindex()
+		reindex.Source(elastic.NewReindexSource().Index(fromIndex))
+		reindex.Destination(dest)
+		reindex.ProceedOnVersionConflict()
+		reindex.Refresh("true")
+		var task *elastic.StartTaskResult
+		if task, err = reindex.DoAsync(ctx); err != nil {
+			return
 		}
-		if output.Type != "" {
-			meta["type"] = output.Type
+		infoLog.Printf("Reindexing %s to %s after rename of %s to %s in task %s", fromIndex, toIndex, from, to, task.TaskId)
+		ic.renameWg.Add(1)
+		go func() {
+			defer ic.renameWg.Done()
+			if err := ic.completeRename(task.TaskId, from, to, fromIndex, toIndex); err != nil {
+				errorLog.Printf("Unable to complete rename of %s to %s: %s", from, to, err)
+			}
+		}()
+	}
+	return
+}
+
+// ddlIdleDuration is how long the main change stream must be idle before
+// held DDL events are routed
+const ddlIdleDuration = time.Second
+
+// scriptUpdateFlushDuration is how often the saved targets of script
+// updates are written to the config database
+const scriptUpdateFlushDuration = time.Second
+
+// renameTaskPoll is how often a reindex task started for a rename is checked
+var renameTaskPoll = 5 * time.Second
+
+// completeRename waits for the reindex task of a renamed collection to
+// finish without blocking the event loop.  The old index is only deleted
+// when all the documents were reindexed.
+func (ic *indexClient) completeRename(taskID, from, to, fromIndex, toIndex string) (err error) {
+	ctx := context.Background()
+	var task struct {
+		Completed bool                  `json:"completed"`
+		Error     *elastic.ErrorDetails `json:"error"`
+		Response  struct {
+			Created  int64         `json:"created"`
+			Updated  int64         `json:"updated"`
+			Failures []interface{} `json:"failures"`
+		} `json:"response"`
+	}
+	for {
+		var res *elastic.Response
+		res, err = ic.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+			Method: "GET",
+			Path:   "/_tasks/" + url.PathEscape(taskID),
+		})
+		if err != nil {
+			return
 		}
-		if output.Routing != "" {
-			meta["routing"] = output.Routing
+		if err = json.Unmarshal(res.Body, &task); err != nil {
+			return
 		}
-		if output.Parent != "" {
-			meta["parent"] = output.Parent
+		if task.Completed {
+			break
 		}
-		if output.Version != 0 {
-			meta["version"] = output.Version
+		time.Sleep(renameTaskPoll)
+	}
+	if task.Error != nil {
+		return fmt.Errorf("Reindex of %s to %s failed: %s", fromIndex, toIndex, task.Error.Reason)
+	}
+	if len(task.Response.Failures) > 0 {
+		return fmt.Errorf("Failures reindexing %s to %s: %+v", fromIndex, toIndex, task.Response.Failures)
+	}
+	infoLog.Printf("Reindexed %d documents from %s to %s after rename of %s to %s",
+		task.Response.Created+task.Response.Updated, fromIndex, toIndex, from, to)
+	if _, err = ic.client.DeleteIndex(fromIndex).Do(ctx); err != nil {
+		return
+	}
+	return ic.renameMeta(from, to, fromIndex, toIndex)
+}
+
+// renameMeta moves the stateful delete metadata of a renamed collection to
+// the new namespace.  Saved indexes equal to fromIndex are changed to
+// toIndex.
+func (ic *indexClient) renameMeta(from, to, fromIndex, toIndex string) (err error) {
+	if ic.config.DeleteStrategy != statefulDeleteStrategy {
+		return
+	}
+	ctx := context.Background()
+	db := strings.SplitN(to, ".", 2)[0]
+	if ic.metaInElastic() {
+		script := elastic.NewScript(renameMetaScript).Params(map[string]interface{}{
+			"from":      from,
+			"to":        to,
+			"db":        db,
+			"fromIndex": fromIndex,
+			"toIndex":   toIndex,
+		})
+		reindex := ic.client.Reindex()
+		reindex.Source(elastic.NewReindexSource().Index(ic.config.DeleteMetaIndex).Query(elastic.NewTermQuery("namespace", from)))
+		reindex.DestinationIndex(ic.config.DeleteMetaIndex)
+		reindex.Script(script)
+		reindex.WaitForCompletion(true)
+		reindex.Refresh("true")
+		if _, err = reindex.Do(ctx); err == nil {
+			err = ic.dropElasticMeta("namespace", from)
 		}
-		if output.VersionType != "" {
-			meta["versionType"] = output.VersionType
+		return
+	}
+	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("meta")
+	cursor, err := col.Find(ctx, bson.M{"namespace": from})
+	if err != nil {
+		return
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err = cursor.Decode(&doc); err != nil {
+			return
 		}
-		if output.Pipeline != "" {
-			meta["pipeline"] = output.Pipeline
+		oldID, _ := doc["_id"].(string)
+		doc["_id"] = to + strings.TrimPrefix(oldID, from)
+		doc["namespace"] = to
+		doc["db"] = db
+		if fromIndex != "" && doc["index"] == fromIndex {
+			doc["index"] = toIndex
 		}
-		if output.RetryOnConflict != 0 {
-			meta["retryOnConflict"] = output.RetryOnConflict
+		opts := options.Replace().SetUpsert(true)
+		if _, err = col.ReplaceOne(ctx, bson.M{"_id": doc["_id"]}, doc, opts); err != nil {
+			return
 		}
-		if len(meta) > 0 {
-			op.Data["_meta_monstache"] = meta
+		if _, err = col.DeleteOne(ctx, bson.M{"_id": oldID}); err != nil {
+			return
 		}
 	}
-	return nil
+	return cursor.Err()
 }
 
-func (ic *indexClient) mapData(op *gtm.Op) error {
-	if mapperPlugin != nil {
-		return ic.mapDataGolang(op)
+const renameMetaScript = `
+ctx._id = params.to + ctx._id.substring(params.from.length());
+ctx._source.namespace = params.to;
+ctx._source.db = params.db;
+if (params.fromIndex != '' && params.fromIndex.equals(ctx._source.index)) {
+  ctx._source.index = params.toIndex;
+}`
+
+func (ic *indexClient) ensureFileMapping() (err error) {
+	config := ic.config
+	if config.DisableFilePipelinePut {
+		return nil
 	}
-	return ic.mapDataJavascript(op)
+	ctx := context.Background()
+	pipeline := map[string]interface{}{
+		"description": "Extract file information",
+		"processors": [1]map[string]interface{}{
+			{
+				"attachment": map[string]interface{}{
+					"field": "file",
+				},
+			},
+		},
+	}
+	_, err = ic.client.IngestPutPipeline("attachment").BodyJson(pipeline).Do(ctx)
+	return err
 }
 
-func extractData(srcField string, data map[string]interface{}) (result interface{}, err error) {
-	var cur = data
-	fields := strings.Split(srcField, ".")
-	flen := len(fields)
-	for i, field := range fields {
-		if i+1 == flen {
-			result = cur[field]
-		} else {
-			if next, ok := cur[field].(map[string]interface{}); ok {
-				cur = next
-			} else {
-				break
-			}
+func (ic *indexClient) defaultIndexMapping(op *gtm.Op) *indexMapping {
+	return &indexMapping{
+		Namespace: op.Namespace,
+		Index:     strings.ToLower(op.Namespace),
+	}
+}
+
+func (ic *indexClient) mapIndex(op *gtm.Op) *indexMapping {
+	mapping := ic.defaultIndexMapping(op)
+	if m := mapIndexTypes[op.Namespace]; m != nil {
+		if m.Index != "" {
+			mapping.Index = m.Index
+		}
+		if m.Pipeline != "" {
+			mapping.Pipeline = m.Pipeline
+		}
+		if m.template != nil {
+			mapping.template = m.template
+			mapping.Index, mapping.fromDocument = m.template.resolve(op)
 		}
 	}
-	if result == nil {
-		var detail interface{}
-		b, e := json.Marshal(data)
-		if e == nil {
-			detail = string(b)
+	return mapping
+}
+
+const indexTemplateLayoutDefault = "2006.01.02"
+
+func parseIndexTemplate(index string) (*indexTemplate, error) {
+	if !strings.Contains(index, "{") {
+		return nil, nil
+	}
+	t := &indexTemplate{}
+	rest := index
+	for rest != "" {
+		start := strings.Index(rest, "{")
+		if start == -1 {
+			t.parts = append(t.parts, indexTemplatePart{literal: rest})
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, indexTemplatePart{literal: rest[:start]})
+		}
+		end := strings.Index(rest[start:], "}")
+		if end == -1 {
+			return nil, fmt.Errorf("Unclosed placeholder in index template %s", index)
+		}
+		placeholder := rest[start+1 : start+end]
+		part := indexTemplatePart{layout: indexTemplateLayoutDefault}
+		if i := strings.Index(placeholder, ":"); i != -1 {
+			part.field, part.layout = placeholder[:i], placeholder[i+1:]
 		} else {
-			detail = err
+			part.field = placeholder
 		}
-		err = fmt.Errorf("Source field %s not found in document: %s", srcField, detail)
+		if part.field == "" || part.layout == "" {
+			return nil, fmt.Errorf("Invalid placeholder {%s} in index template %s", placeholder, index)
+		}
+		t.parts = append(t.parts, part)
+		rest = rest[start+end+1:]
 	}
-	return
+	return t, nil
 }
 
-func buildSelector(matchField string, data interface{}) bson.M {
-	sel := bson.M{}
-	var cur bson.M = sel
-	fields := strings.Split(matchField, ".")
-	flen := len(fields)
-	for i, field := range fields {
-		if i+1 == flen {
-			cur[field] = data
+// pattern returns an index pattern matching all the indexes of the template
+func (t *indexTemplate) pattern() string {
+	var sb strings.Builder
+	for _, part := range t.parts {
+		if part.field == "" {
+			sb.WriteString(part.literal)
 		} else {
-			next := bson.M{}
-			cur[field] = next
-			cur = next
+			sb.WriteString("*")
 		}
 	}
-	return sel
+	return strings.ToLower(sb.String())
 }
 
-func convertSrcDataToString(srcData interface{}) (value string) {
-	switch v := srcData.(type) {
-	case primitive.ObjectID:
-		value = v.Hex()
-	default:
-		value = fmt.Sprintf("%v", v)
+// fromID reports whether the index depends only on the document _id, in
+// which case deletes can compute it without any saved metadata
+func (t *indexTemplate) fromID() bool {
+	for _, part := range t.parts {
+		if part.field != "" && part.field != "_id" {
+			return false
+		}
 	}
-	return
+	return true
 }
 
-func convertSrcDataToObjectID(srcData interface{}) (objectID primitive.ObjectID, err error) {
-	value := fmt.Sprintf("%v", srcData)
-	objectID, err = primitive.ObjectIDFromHex(value)
+// resolve returns the index for the document and whether all the times were
+// found in the document.  Missing times fall back to the oplog timestamp.
+func (t *indexTemplate) resolve(op *gtm.Op) (index string, fromDocument bool) {
+	fromDocument = true
+	var sb strings.Builder
+	for _, part := range t.parts {
+		if part.field == "" {
+			sb.WriteString(part.literal)
+			continue
+		}
+		var tm time.Time
+		ok := false
+		if part.field == "_id" {
+			tm, ok = templateTime(op.Id)
+		} else if op.Data != nil {
+			if v, err := extractData(part.field, op.Data); err == nil {
+				tm, ok = templateTime(v)
+			}
+		}
+		if !ok {
+			fromDocument = false
+			tm = opTime(op)
+		}
+		sb.WriteString(tm.UTC().Format(part.layout))
+	}
+	index = strings.ToLower(sb.String())
 	return
 }
 
-func convertSrcDataToInt(srcData interface{}) (val int64, err error) {
-	switch v := srcData.(type) {
-	case int:
-		return int64(v), nil
-	case int64:
-		return int64(v), nil
-	case int32:
-		return int64(v), nil
+func opTime(op *gtm.Op) time.Time {
+	if op.Timestamp.T > 0 {
+		return time.Unix(int64(op.Timestamp.T), 0)
+	}
+	return time.Now()
+}
+
+func templateTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case monstachemap.Time:
+		return t.Time, true
+	case primitive.DateTime:
+		return t.Time(), true
+	case primitive.Timestamp:
+		return time.Unix(int64(t.T), 0), true
+	case primitive.ObjectID:
+		return t.Timestamp(), true
+	case string:
+		if tm, err := time.Parse(time.RFC3339, t); err == nil {
+			return tm, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func opIDToString(op *gtm.Op) string {
+	var opIDStr string
+	switch id := op.Id.(type) {
+	case primitive.ObjectID:
+		opIDStr = id.Hex()
+	case primitive.Binary:
+		opIDStr = monstachemap.EncodeBinData(monstachemap.Binary{id})
 	case float64:
-		return int64(v), nil
+		intID := int(id)
+		if id == float64(intID) {
+			opIDStr = fmt.Sprintf("%v", intID)
+		} else {
+			opIDStr = fmt.Sprintf("%v", op.Id)
+		}
 	case float32:
-		return int64(v), nil
-	case string:
-		return strconv.ParseInt(v, 10, 64)
-	case bool:
-		vals := map[bool]int64{false: 0, true: 1}
-		return vals[v], nil
-	case primitive.Decimal128:
-		return strconv.ParseInt(v.String(), 10, 64)
+		intID := int(id)
+		if id == float32(intID) {
+			opIDStr = fmt.Sprintf("%v", intID)
+		} else {
+			opIDStr = fmt.Sprintf("%v", op.Id)
+		}
+	default:
+		opIDStr = fmt.Sprintf("%v", op.Id)
 	}
-	return 0, fmt.Errorf("Failed to convert match field of type %T to int64", srcData)
+	return opIDStr
 }
 
-func convertSrcDataToDecimal(srcData interface{}) (decimal primitive.Decimal128, err error) {
-	switch v := srcData.(type) {
-	case int, int64, int32, float64, float32:
-		return primitive.ParseDecimal128(fmt.Sprintf("%v", v))
-	case string:
-		return primitive.ParseDecimal128(v)
-	case primitive.Decimal128:
-		return v, nil
+func convertSliceJavascript(a []interface{}) []interface{} {
+	avs := make([]interface{}, 0, len(a))
+	for _, av := range a {
+		var avc interface{}
+		switch achild := av.(type) {
+		case map[string]interface{}:
+			avc = convertMapJavascript(achild)
+		case []interface{}:
+			avc = convertSliceJavascript(achild)
+		case primitive.ObjectID:
+			avc = achild.Hex()
+		default:
+			avc = av
+		}
+		avs = append(avs, avc)
 	}
-	return decimal, fmt.Errorf("Failed to convert match field of type %T to decimal", srcData)
+	return avs
 }
 
-func convertSrcDataToMatchFieldType(srcData interface{}, matchFieldType string) (result interface{}, err error) {
-	if matchFieldType == "objectId" {
-		result, err = convertSrcDataToObjectID(srcData)
-	} else if matchFieldType == "string" {
-		result = convertSrcDataToString(srcData)
-	} else if matchFieldType == "int" || matchFieldType == "long" {
-		result, err = convertSrcDataToInt(srcData)
-	} else if matchFieldType == "decimal" {
-		result, err = convertSrcDataToDecimal(srcData)
+func convertMapJavascript(e map[string]interface{}) map[string]interface{} {
+	o := make(map[string]interface{}, len(e))
+	for k, v := range e {
+		switch child := v.(type) {
+		case map[string]interface{}:
+			o[k] = convertMapJavascript(child)
+		case []interface{}:
+			o[k] = convertSliceJavascript(child)
+		case primitive.ObjectID:
+			o[k] = child.Hex()
+		default:
+			o[k] = v
+		}
 	}
-	return
+	return o
 }
 
-func (ic *indexClient) processRelated(root *gtm.Op) (err error) {
-	var q []*gtm.Op
-	batch := []*gtm.Op{root}
-	depth := 1
-	for len(batch) > 0 {
-		for _, e := range batch {
-			op := e
-			if op.Data == nil {
+func fixSlicePruneInvalidJSON(id string, key string, a []interface{}) []interface{} {
+	avs := make([]interface{}, 0, len(a))
+	for _, av := range a {
+		var avc interface{}
+		switch achild := av.(type) {
+		case map[string]interface{}:
+			avc = fixPruneInvalidJSON(id, achild)
+		case []interface{}:
+			avc = fixSlicePruneInvalidJSON(id, key, achild)
+		case time.Time:
+			year := achild.Year()
+			if year < 0 || year > 9999 {
+				// year outside of valid range
+				warnLog.Printf("Dropping key %s element: invalid time.Time value: %s for document _id: %s", key, achild, id)
 				continue
+			} else {
+				avc = av
 			}
-			rs := relates[op.Namespace]
-			if len(rs) == 0 {
+		case float64:
+			if math.IsNaN(achild) {
+				// causes an error in the json serializer
+				warnLog.Printf("Dropping key %s element: invalid float64 value: %v for document _id: %s", key, achild, id)
+				continue
+			} else if math.IsInf(achild, 0) {
+				// causes an error in the json serializer
+				warnLog.Printf("Dropping key %s element: invalid float64 value: %v for document _id: %s", key, achild, id)
 				continue
+			} else {
+				avc = av
 			}
-			for _, r := range rs {
-				if r.MaxDepth > 0 && r.MaxDepth < depth {
-					continue
-				}
-				if op.IsDelete() && r.IsIdentity() {
-					rop := &gtm.Op{
-						Id:        op.Id,
-						Operation: op.Operation,
-						Namespace: r.WithNamespace,
-						Source:    op.Source,
-						Timestamp: op.Timestamp,
-						Data:      op.Data,
-					}
-					ic.doDelete(rop)
-					q = append(q, rop)
-					continue
-				}
-				var srcData interface{}
-				if srcData, err = extractData(r.SrcField, op.Data); err != nil {
-					ic.processErr(err)
-					continue
-				}
-
-				if r.MatchFieldType != "" {
-					if srcData, err = convertSrcDataToMatchFieldType(srcData, r.MatchFieldType); err != nil {
-						ic.processErr(err)
-						continue
-					}
-				}
+		default:
+			avc = av
+		}
+		avs = append(avs, avc)
+	}
+	return avs
+}
 
-				opts := &options.FindOptions{}
-				if ic.config.DirectReadNoTimeout {
-					opts.SetNoCursorTimeout(true)
-				}
-				col := ic.mongo.Database(r.db).Collection(r.col)
-				var sel bson.M
-				if r.DotNotation {
-					sel = bson.M{r.MatchField: srcData}
-				} else {
-					sel = buildSelector(r.MatchField, srcData)
-				}
-				cursor, err := col.Find(context.Background(), sel, opts)
-				if err != nil {
-					ic.processErr(err)
-					continue
-				}
-
-				doc := make(map[string]interface{})
-				for cursor.Next(context.Background()) {
-					if err = cursor.Decode(&doc); err != nil {
-						ic.processErr(err)
-						continue
-					}
-					now := time.Now().UTC()
-					tstamp := primitive.Timestamp{
-						T: uint32(now.Unix()),
-						I: uint32(now.Nanosecond()),
-					}
-					rop := &gtm.Op{
-						Id:                doc["_id"],
-						Data:              doc,
-						Operation:         root.Operation,
-						Namespace:         r.WithNamespace,
-						Source:            gtm.DirectQuerySource,
-						Timestamp:         tstamp,
-						UpdateDescription: root.UpdateDescription,
-					}
-					doc = make(map[string]interface{})
-					if ic.filter != nil && !ic.filter(rop) {
-						continue
-					}
-					if processPlugin != nil {
-						pop := &gtm.Op{
-							Id:                rop.Id,
-							Operation:         rop.Operation,
-							Namespace:         rop.Namespace,
-							Source:            rop.Source,
-							Timestamp:         rop.Timestamp,
-							UpdateDescription: rop.UpdateDescription,
-						}
-						var data []byte
-						data, err = bson.Marshal(rop.Data)
-						if err == nil {
-							var m map[string]interface{}
-							err = bson.Unmarshal(data, &m)
-							if err == nil {
-								pop.Data = m
-							}
-						}
-						ic.processC <- pop
-					}
-					skip := false
-					if rs2 := relates[rop.Namespace]; len(rs2) != 0 {
-						skip = true
-						visit := false
-						for _, r2 := range rs2 {
-							if r2.KeepSrc {
-								skip = false
-							}
-							if r2.MaxDepth < 1 || r2.MaxDepth >= (depth+1) {
-								visit = true
-							}
-						}
-						if visit {
-							q = append(q, rop)
-						}
-					}
-					if !skip {
-						if ic.hasFileContent(rop) {
-							ic.fileC <- rop
-						} else {
-							ic.indexC <- rop
-						}
-					}
-				}
-				cursor.Close(context.Background())
+func fixPruneInvalidJSON(id string, e map[string]interface{}) map[string]interface{} {
+	o := make(map[string]interface{}, len(e))
+	for k, v := range e {
+		switch child := v.(type) {
+		case map[string]interface{}:
+			o[k] = fixPruneInvalidJSON(id, child)
+		case []interface{}:
+			o[k] = fixSlicePruneInvalidJSON(id, k, child)
+		case time.Time:
+			year := child.Year()
+			if year < 0 || year > 9999 {
+				// year outside of valid range
+				warnLog.Printf("Dropping key %s: invalid time.Time value: %s for document _id: %s", k, child, id)
+				continue
+			} else {
+				o[k] = v
+			}
+		case float64:
+			if math.IsNaN(child) {
+				// causes an error in the json serializer
+				warnLog.Printf("Dropping key %s: invalid float64 value: %v for document _id: %s", k, child, id)
+				continue
+			} else if math.IsInf(child, 0) {
+				// causes an error in the json serializer
+				warnLog.Printf("Dropping key %s: invalid float64 value: %v for document _id: %s", k, child, id)
+				continue
+			} else {
+				o[k] = v
 			}
+		default:
+			o[k] = v
 		}
-		depth++
-		batch = q
-		q = nil
+	}
+	return o
+}
+
+func deepExportValue(a interface{}) (b interface{}) {
+	switch t := a.(type) {
+	case otto.Value:
+		ex, err := t.Export()
+		if t.Class() == "Date" {
+			ex, err = time.Parse("Mon, 2 Jan 2006 15:04:05 MST", t.String())
+		}
+		if err == nil {
+			b = deepExportValue(ex)
+		} else {
+			errorLog.Printf("Error exporting from javascript: %s", err)
+		}
+	case map[string]interface{}:
+		b = deepExportMap(t)
+	case []map[string]interface{}:
+		b = deepExportMapSlice(t)
+	case []interface{}:
+		b = deepExportSlice(t)
+	default:
+		b = a
 	}
 	return
 }
 
-func (ic *indexClient) prepareDataForIndexing(op *gtm.Op) {
-	config := ic.config
-	data := op.Data
-	if config.IndexOplogTime {
-		secs := op.Timestamp.T
-		t := time.Unix(int64(secs), 0).UTC()
-		data[config.OplogTsFieldName] = op.Timestamp
-		data[config.OplogDateFieldName] = t.Format(config.OplogDateFieldFormat)
+func deepExportMapSlice(a []map[string]interface{}) []interface{} {
+	avs := make([]interface{}, 0, len(a))
+	for _, av := range a {
+		avs = append(avs, deepExportMap(av))
 	}
-	delete(data, "_id")
-	delete(data, "_meta_monstache")
-	if config.PruneInvalidJSON {
-		op.Data = fixPruneInvalidJSON(opIDToString(op), data)
+	return avs
+}
+
+func deepExportSlice(a []interface{}) []interface{} {
+	avs := make([]interface{}, 0, len(a))
+	for _, av := range a {
+		avs = append(avs, deepExportValue(av))
 	}
-	op.Data = monstachemap.ConvertMapForJSON(op.Data)
+	return avs
 }
 
-func parseIndexMeta(op *gtm.Op) (meta *indexingMeta) {
-	meta = &indexingMeta{
-		Version:     tsVersion(op),
-		VersionType: "external",
+func deepExportMap(e map[string]interface{}) map[string]interface{} {
+	o := make(map[string]interface{}, len(e))
+	for k, v := range e {
+		o[k] = deepExportValue(v)
 	}
-	if m, ok := op.Data["_meta_monstache"]; ok {
-		switch m.(type) {
-		case map[string]interface{}:
-			metaAttrs := m.(map[string]interface{})
-			meta.load(metaAttrs)
-		case otto.Value:
-			ex, err := m.(otto.Value).Export()
-			if err == nil && ex != m {
-				switch ex.(type) {
-				case map[string]interface{}:
-					metaAttrs := ex.(map[string]interface{})
-					meta.load(metaAttrs)
-				default:
-					errorLog.Println("Invalid indexing metadata")
-				}
-			}
-		default:
-			errorLog.Println("Invalid indexing metadata")
-		}
+	return o
+}
+
+func opSourceToString(op *gtm.Op) string {
+	if op.IsSourceDirect() {
+		return "direct"
 	}
-	return meta
+	return "oplog"
 }
 
-func (ic *indexClient) addFileContent(op *gtm.Op) (err error) {
-	op.Data["file"] = ""
-	var fileContentBuilder strings.Builder
-	db, bucketName :=
-		ic.mongo.Database(op.GetDatabase()),
-		strings.SplitN(op.GetCollection(), ".", 2)[0]
-	encoder := base64.NewEncoder(base64.StdEncoding, &fileContentBuilder)
-	opts := &options.BucketOptions{}
-	opts.SetName(bucketName)
-	var bucket *gridfs.Bucket
-	bucket, err = gridfs.NewBucket(db, opts)
-	if err != nil {
-		return
+// opPreImage returns the pre-image of a change event if a change stream
+// pipeline has projected fullDocumentBeforeChange into the document.  gtm
+// does not expose the field of the change event itself, so the projected
+// copy is read here and stripped again by prepareDataForIndexing
+func opPreImage(op *gtm.Op) map[string]interface{} {
+	if op.Data == nil {
+		return nil
 	}
-	var size int64
-	if size, err = bucket.DownloadToStream(op.Id, encoder); err != nil {
-		return
+	if before, ok := op.Data[preImageField].(map[string]interface{}); ok {
+		return before
 	}
-	if ic.config.MaxFileSize > 0 && size > ic.config.MaxFileSize {
-		warnLog.Printf("File size %d exceeds max file size. file content omitted.", size)
-		encoder.Close()
-		return
+	return nil
+}
+
+// scriptContext builds the context object passed as the final argument to
+// javascript mapping and filter functions
+func scriptContext(op *gtm.Op) map[string]interface{} {
+	ctx := map[string]interface{}{
+		"operation":  op.Operation,
+		"namespace":  op.Namespace,
+		"database":   op.GetDatabase(),
+		"collection": op.GetCollection(),
+		"source":     opSourceToString(op),
+		"timestamp": map[string]interface{}{
+			"t": int64(op.Timestamp.T),
+			"i": int64(op.Timestamp.I),
+		},
+		preImageField: nil,
 	}
-	if err = encoder.Close(); err != nil {
-		return
+	if before := opPreImage(op); before != nil {
+		ctx[preImageField] = convertMapJavascript(before)
 	}
-	op.Data["file"] = fileContentBuilder.String()
-	return
+	return ctx
 }
 
-func notMonstache(config *configOptions) gtm.OpFilter {
-	db := config.ConfigDatabaseName
-	return func(op *gtm.Op) bool {
-		return op.GetDatabase() != db
+func skipOp(op *gtm.Op) {
+	op.Data = map[string]interface{}{
+		"_meta_monstache": map[string]interface{}{"skip": true},
 	}
 }
 
-func notChunks(op *gtm.Op) bool {
-	return !chunksRegex.MatchString(op.GetCollection())
+// fatalError is an error which stops monstache.  It is handled by processErr
+// with a clean shutdown so that earlier events are still flushed
+type fatalError struct {
+	err error
 }
 
-func notConfig(op *gtm.Op) bool {
-	return op.GetDatabase() != "config"
+func (e *fatalError) Error() string {
+	return e.err.Error()
 }
 
-func notSystem(op *gtm.Op) bool {
-	return !systemsRegex.MatchString(op.GetCollection())
+func (e *fatalError) Unwrap() error {
+	return e.err
 }
 
-func filterWithRegex(regex string) gtm.OpFilter {
-	var validNameSpace = regexp.MustCompile(regex)
-	return func(op *gtm.Op) bool {
-		if op.IsDrop() {
-			return true
-		}
-		return validNameSpace.MatchString(op.Namespace)
-	}
+func isFatal(err error) bool {
+	var fe *fatalError
+	return errors.As(err, &fe)
 }
 
-func filterDropWithRegex(regex string) gtm.OpFilter {
-	var validNameSpace = regexp.MustCompile(regex)
-	return func(op *gtm.Op) bool {
-		if op.IsDrop() {
-			return validNameSpace.MatchString(op.Namespace)
+func (policy scriptErrorPolicy) keepDocument() bool {
+	return policy == indexScriptErrorPolicy
+}
+
+// onScriptError applies the error policy of the script environment.  It
+// returns the error unchanged when no policy is configured, a fatalError for
+// the fail policy and nil otherwise
+func (ic *indexClient) onScriptError(env *executionEnv, op *gtm.Op, err error) error {
+	if env.errorPolicy == defaultScriptErrorPolicy {
+		return err
+	}
+	err = fmt.Errorf("Script error for document %s in namespace %s: %s", opIDToString(op), op.Namespace, err)
+	switch env.errorPolicy {
+	case skipScriptErrorPolicy:
+		warnLog.Printf("Skipping document. %s", err)
+	case indexScriptErrorPolicy:
+		warnLog.Printf("Indexing unmapped document. %s", err)
+	case deadLetterScriptErrorPolicy:
+		warnLog.Printf("Saving document as a dead letter. %s", err)
+		if e := ic.saveDeadLetter(op, err); e != nil {
+			errorLog.Printf("Unable to save dead letter: %s", e)
 		}
-		return true
+	case failScriptErrorPolicy:
+		return &fatalError{err: err}
 	}
+	return nil
 }
 
-func filterWithPlugin(mc *mongo.Client) gtm.OpFilter {
-	return func(op *gtm.Op) bool {
-		var keep = true
-		if (op.IsInsert() || op.IsUpdate()) && op.Data != nil {
-			keep = false
-			input := &monstachemap.MapperPluginInput{
-				Document:          op.Data,
-				Namespace:         op.Namespace,
+func (ic *indexClient) saveDeadLetter(op *gtm.Op, cause error) error {
+	if ic.mongo == nil {
+		return errors.New("MongoDB client is unavailable")
+	}
+	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("deadletters")
+	doc := bson.M{
+		"resumeName":        ic.config.ResumeName,
+		"namespace":         op.Namespace,
+		"id":                op.Id,
+		"operation":         op.Operation,
+		"source":            opSourceToString(op),
+		"ts":                op.Timestamp,
+		"data":              op.Data,
+		"updateDescription": op.UpdateDescription,
+		"error":             cause.Error(),
+		"created":           time.Now().UTC(),
+	}
+	_, err := col.InsertOne(context.Background(), doc)
+	return err
+}
+
+func (ic *indexClient) mapDataJavascript(op *gtm.Op) error {
+	names := []string{"", op.Namespace}
+	for _, name := range names {
+		env := mapEnvs[name]
+		if env == nil {
+			continue
+		}
+		env.lock.Lock()
+		defer env.lock.Unlock()
+		arg := convertMapJavascript(op.Data)
+		arg2 := op.Namespace
+		arg3 := convertMapJavascript(op.UpdateDescription)
+		arg4 := scriptContext(op)
+		val, err := env.call(arg, arg2, arg3, arg4)
+		if err != nil {
+			if err = ic.onScriptError(env, op, err); err == nil && !env.errorPolicy.keepDocument() {
+				skipOp(op)
+			}
+			return err
+		}
+		if strings.ToLower(val.Class()) == "object" {
+			data, err := val.Export()
+			if err != nil {
+				return err
+			} else if data == val {
+				return errors.New("Exported function must return an object")
+			} else {
+				dm := data.(map[string]interface{})
+				op.Data = deepExportMap(dm)
+			}
+		} else {
+			indexed, err := val.ToBoolean()
+			if err != nil {
+				return err
+			} else if !indexed {
+				op.Data = nil
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (ic *indexClient) mapDataGolang(op *gtm.Op) error {
+	input := &monstachemap.MapperPluginInput{
+		Document:          op.Data,
+		Namespace:         op.Namespace,
+		Database:          op.GetDatabase(),
+		Collection:        op.GetCollection(),
+		Operation:         op.Operation,
+		MongoClient:       ic.mongo,
+		UpdateDescription: op.UpdateDescription,
+		Context:           pluginCtx,
+		Logger:            pluginLog,
+	}
+	output, err := mapperPlugin(input)
+	if err != nil {
+		return err
+	}
+	if output == nil {
+		return nil
+	}
+	if output.Drop {
+		op.Data = nil
+	} else {
+		if output.Skip {
+			op.Data = map[string]interface{}{}
+		} else if output.Passthrough == false {
+			if output.Document == nil {
+				return errors.New("Map function must return a non-nil document")
+			}
+			op.Data = output.Document
+		}
+		meta := make(map[string]interface{})
+		if output.Skip {
+			meta["skip"] = true
+		}
+		if output.Index != "" {
+			meta["index"] = output.Index
+		}
+		if output.ID != "" {
+			meta["id"] = output.ID
+		}
+		if output.Type != "" {
+			meta["type"] = output.Type
+		}
+		if output.Routing != "" {
+			meta["routing"] = output.Routing
+		}
+		if output.Parent != "" {
+			meta["parent"] = output.Parent
+		}
+		if output.Version != 0 {
+			meta["version"] = output.Version
+		}
+		if output.VersionType != "" {
+			meta["versionType"] = output.VersionType
+		}
+		if output.Pipeline != "" {
+			meta["pipeline"] = output.Pipeline
+		}
+		if output.RetryOnConflict != 0 {
+			meta["retryOnConflict"] = output.RetryOnConflict
+		}
+		if len(output.Documents) > 0 {
+			meta["documents"] = output.Documents
+		}
+		if len(meta) > 0 {
+			op.Data["_meta_monstache"] = meta
+		}
+	}
+	return nil
+}
+
+func (ic *indexClient) mapData(op *gtm.Op) error {
+	if mapperPlugin != nil {
+		return ic.mapDataGolang(op)
+	}
+	return ic.mapDataJavascript(op)
+}
+
+func extractData(srcField string, data map[string]interface{}) (result interface{}, err error) {
+	var cur = data
+	fields := strings.Split(srcField, ".")
+	flen := len(fields)
+	for i, field := range fields {
+		if i+1 == flen {
+			result = cur[field]
+		} else {
+			if next, ok := cur[field].(map[string]interface{}); ok {
+				cur = next
+			} else {
+				break
+			}
+		}
+	}
+	if result == nil {
+		var detail interface{}
+		b, e := json.Marshal(data)
+		if e == nil {
+			detail = string(b)
+		} else {
+			detail = err
+		}
+		err = fmt.Errorf("Source field %s not found in document: %s", srcField, detail)
+	}
+	return
+}
+
+func buildSelector(matchField string, data interface{}) bson.M {
+	sel := bson.M{}
+	var cur bson.M = sel
+	fields := strings.Split(matchField, ".")
+	flen := len(fields)
+	for i, field := range fields {
+		if i+1 == flen {
+			cur[field] = data
+		} else {
+			next := bson.M{}
+			cur[field] = next
+			cur = next
+		}
+	}
+	return sel
+}
+
+func convertSrcDataToString(srcData interface{}) (value string) {
+	switch v := srcData.(type) {
+	case primitive.ObjectID:
+		value = v.Hex()
+	default:
+		value = fmt.Sprintf("%v", v)
+	}
+	return
+}
+
+func convertSrcDataToObjectID(srcData interface{}) (objectID primitive.ObjectID, err error) {
+	value := fmt.Sprintf("%v", srcData)
+	objectID, err = primitive.ObjectIDFromHex(value)
+	return
+}
+
+func convertSrcDataToInt(srcData interface{}) (val int64, err error) {
+	switch v := srcData.(type) {
+	case int:
+		return int64(v), nil
+	case int64:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case float64:
+		return int64(v), nil
+	case float32:
+		return int64(v), nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case bool:
+		vals := map[bool]int64{false: 0, true: 1}
+		return vals[v], nil
+	case primitive.Decimal128:
+		return strconv.ParseInt(v.String(), 10, 64)
+	}
+	return 0, fmt.Errorf("Failed to convert match field of type %T to int64", srcData)
+}
+
+func convertSrcDataToDecimal(srcData interface{}) (decimal primitive.Decimal128, err error) {
+	switch v := srcData.(type) {
+	case int, int64, int32, float64, float32:
+		return primitive.ParseDecimal128(fmt.Sprintf("%v", v))
+	case string:
+		return primitive.ParseDecimal128(v)
+	case primitive.Decimal128:
+		return v, nil
+	}
+	return decimal, fmt.Errorf("Failed to convert match field of type %T to decimal", srcData)
+}
+
+func convertSrcDataToMatchFieldType(srcData interface{}, matchFieldType string) (result interface{}, err error) {
+	if matchFieldType == "objectId" {
+		result, err = convertSrcDataToObjectID(srcData)
+	} else if matchFieldType == "string" {
+		result = convertSrcDataToString(srcData)
+	} else if matchFieldType == "int" || matchFieldType == "long" {
+		result, err = convertSrcDataToInt(srcData)
+	} else if matchFieldType == "decimal" {
+		result, err = convertSrcDataToDecimal(srcData)
+	}
+	return
+}
+
+func (ic *indexClient) processRelated(root *gtm.Op) (err error) {
+	var q []*gtm.Op
+	batch := []*gtm.Op{root}
+	depth := 1
+	for len(batch) > 0 {
+		for _, e := range batch {
+			op := e
+			if op.Data == nil {
+				continue
+			}
+			rs := relates[op.Namespace]
+			if len(rs) == 0 {
+				continue
+			}
+			for _, r := range rs {
+				if r.MaxDepth > 0 && r.MaxDepth < depth {
+					continue
+				}
+				if op.IsDelete() && r.IsIdentity() {
+					rop := &gtm.Op{
+						Id:        op.Id,
+						Operation: op.Operation,
+						Namespace: r.WithNamespace,
+						Source:    op.Source,
+						Timestamp: op.Timestamp,
+						Data:      op.Data,
+					}
+					ic.doDelete(rop)
+					q = append(q, rop)
+					continue
+				}
+				var srcData interface{}
+				if srcData, err = extractData(r.SrcField, op.Data); err != nil {
+					ic.processErr(err)
+					continue
+				}
+
+				if r.MatchFieldType != "" {
+					if srcData, err = convertSrcDataToMatchFieldType(srcData, r.MatchFieldType); err != nil {
+						ic.processErr(err)
+						continue
+					}
+				}
+
+				opts := &options.FindOptions{}
+				if ic.config.DirectReadNoTimeout {
+					opts.SetNoCursorTimeout(true)
+				}
+				col := ic.mongo.Database(r.db).Collection(r.col)
+				var sel bson.M
+				if r.DotNotation {
+					sel = bson.M{r.MatchField: srcData}
+				} else {
+					sel = buildSelector(r.MatchField, srcData)
+				}
+				cursor, err := col.Find(context.Background(), sel, opts)
+				if err != nil {
+					ic.processErr(err)
+					continue
+				}
+
+				doc := make(map[string]interface{})
+				for cursor.Next(context.Background()) {
+					if err = cursor.Decode(&doc); err != nil {
+						ic.processErr(err)
+						continue
+					}
+					now := time.Now().UTC()
+					tstamp := primitive.Timestamp{
+						T: uint32(now.Unix()),
+						I: uint32(now.Nanosecond()),
+					}
+					rop := &gtm.Op{
+						Id:                doc["_id"],
+						Data:              doc,
+						Operation:         root.Operation,
+						Namespace:         r.WithNamespace,
+						Source:            gtm.DirectQuerySource,
+						Timestamp:         tstamp,
+						UpdateDescription: root.UpdateDescription,
+					}
+					doc = make(map[string]interface{})
+					if ic.filter != nil && !ic.filter(rop) {
+						continue
+					}
+					if hasProcessPlugin() {
+						pop := &gtm.Op{
+							Id:                rop.Id,
+							Operation:         rop.Operation,
+							Namespace:         rop.Namespace,
+							Source:            rop.Source,
+							Timestamp:         rop.Timestamp,
+							UpdateDescription: rop.UpdateDescription,
+						}
+						var data []byte
+						data, err = bson.Marshal(rop.Data)
+						if err == nil {
+							var m map[string]interface{}
+							err = bson.Unmarshal(data, &m)
+							if err == nil {
+								pop.Data = m
+							}
+						}
+						ic.processC <- pop
+					}
+					skip := false
+					if rs2 := relates[rop.Namespace]; len(rs2) != 0 {
+						skip = true
+						visit := false
+						for _, r2 := range rs2 {
+							if r2.KeepSrc {
+								skip = false
+							}
+							if r2.MaxDepth < 1 || r2.MaxDepth >= (depth+1) {
+								visit = true
+							}
+						}
+						if visit {
+							q = append(q, rop)
+						}
+					}
+					if !skip {
+						if ic.hasFileContent(rop) {
+							ic.fileC <- rop
+						} else {
+							ic.indexC <- rop
+						}
+					}
+				}
+				cursor.Close(context.Background())
+			}
+		}
+		depth++
+		batch = q
+		q = nil
+	}
+	return
+}
+
+func (ic *indexClient) prepareDataForIndexing(op *gtm.Op) {
+	config := ic.config
+	data := op.Data
+	if config.IndexOplogTime {
+		secs := op.Timestamp.T
+		t := time.Unix(int64(secs), 0).UTC()
+		data[config.OplogTsFieldName] = op.Timestamp
+		data[config.OplogDateFieldName] = t.Format(config.OplogDateFieldFormat)
+	}
+	delete(data, "_id")
+	delete(data, "_meta_monstache")
+	if op.IsSourceOplog() {
+		delete(data, preImageField)
+	}
+	if config.PruneInvalidJSON {
+		op.Data = fixPruneInvalidJSON(opIDToString(op), data)
+	}
+	op.Data = monstachemap.ConvertMapForJSON(op.Data)
+}
+
+func parseIndexMeta(op *gtm.Op) (meta *indexingMeta) {
+	meta = &indexingMeta{
+		Version:     tsVersion(op),
+		VersionType: "external",
+	}
+	if m, ok := op.Data["_meta_monstache"]; ok {
+		switch m.(type) {
+		case map[string]interface{}:
+			metaAttrs := m.(map[string]interface{})
+			meta.load(metaAttrs)
+		case otto.Value:
+			ex, err := m.(otto.Value).Export()
+			if err == nil && ex != m {
+				switch ex.(type) {
+				case map[string]interface{}:
+					metaAttrs := ex.(map[string]interface{})
+					meta.load(metaAttrs)
+				default:
+					errorLog.Println("Invalid indexing metadata")
+				}
+			}
+		default:
+			errorLog.Println("Invalid indexing metadata")
+		}
+	}
+	return meta
+}
+
+func (ic *indexClient) addFileContent(op *gtm.Op) (err error) {
+	op.Data["file"] = ""
+	var fileContentBuilder strings.Builder
+	db, bucketName :=
+		ic.mongo.Database(op.GetDatabase()),
+		strings.SplitN(op.GetCollection(), ".", 2)[0]
+	encoder := base64.NewEncoder(base64.StdEncoding, &fileContentBuilder)
+	opts := &options.BucketOptions{}
+	opts.SetName(bucketName)
+	var bucket *gridfs.Bucket
+	bucket, err = gridfs.NewBucket(db, opts)
+	if err != nil {
+		return
+	}
+	var size int64
+	if size, err = bucket.DownloadToStream(op.Id, encoder); err != nil {
+		return
+	}
+	if ic.config.MaxFileSize > 0 && size > ic.config.MaxFileSize {
+		warnLog.Printf("File size %d exceeds max file size. file content omitted.", size)
+		encoder.Close()
+		return
+	}
+	if err = encoder.Close(); err != nil {
+		return
+	}
+	op.Data["file"] = fileContentBuilder.String()
+	return
+}
+
+func notMonstache(config *configOptions) gtm.OpFilter {
+	db := config.ConfigDatabaseName
+	return func(op *gtm.Op) bool {
+		return op.GetDatabase() != db
+	}
+}
+
+func notChunks(op *gtm.Op) bool {
+	return !chunksRegex.MatchString(op.GetCollection())
+}
+
+func notConfig(op *gtm.Op) bool {
+	return op.GetDatabase() != "config"
+}
+
+func notSystem(op *gtm.Op) bool {
+	return !systemsRegex.MatchString(op.GetCollection())
+}
+
+func filterWithRegex(regex string) gtm.OpFilter {
+	var validNameSpace = regexp.MustCompile(regex)
+	return func(op *gtm.Op) bool {
+		if op.IsDrop() {
+			return true
+		}
+		return validNameSpace.MatchString(op.Namespace)
+	}
+}
+
+func filterDropWithRegex(regex string) gtm.OpFilter {
+	var validNameSpace = regexp.MustCompile(regex)
+	return func(op *gtm.Op) bool {
+		if op.IsDrop() {
+			return validNameSpace.MatchString(op.Namespace)
+		}
+		return true
+	}
+}
+
+func filterWithPlugin(mc *mongo.Client) gtm.OpFilter {
+	return func(op *gtm.Op) bool {
+		var keep = true
+		if (op.IsInsert() || op.IsUpdate()) && op.Data != nil {
+			keep = false
+			input := &monstachemap.MapperPluginInput{
+				Document:          op.Data,
+				Namespace:         op.Namespace,
 				Database:          op.GetDatabase(),
 				Collection:        op.GetCollection(),
 				Operation:         op.Operation,
 				UpdateDescription: op.UpdateDescription,
 				MongoClient:       mc,
+				Context:           pluginCtx,
+				Logger:            pluginLog,
+			}
+			if ok, err := filterPlugin(input); err == nil {
+				keep = ok
+			} else {
+				errorLog.Println(err)
+			}
+		}
+		return keep
+	}
+}
+
+func (ic *indexClient) filterWithScript() gtm.OpFilter {
+	return func(op *gtm.Op) bool {
+		var keep = true
+		if (op.IsInsert() || op.IsUpdate()) && op.Data != nil {
+			nss := []string{"", op.Namespace}
+			for _, ns := range nss {
+				if env := filterEnvs[ns]; env != nil {
+					keep = false
+					arg := convertMapJavascript(op.Data)
+					arg2 := op.Namespace
+					arg3 := convertMapJavascript(op.UpdateDescription)
+					arg4 := scriptContext(op)
+					env.lock.Lock()
+					defer env.lock.Unlock()
+					val, err := env.call(arg, arg2, arg3, arg4)
+					if err != nil {
+						if err = ic.onScriptError(env, op, err); isFatal(err) {
+							ic.processErr(err)
+						} else if err != nil {
+							errorLog.Println(err)
+						} else {
+							keep = env.errorPolicy.keepDocument()
+						}
+					} else {
+						if ok, err := val.ToBoolean(); err == nil {
+							keep = ok
+						} else {
+							errorLog.Println(err)
+						}
+					}
+				}
+				if !keep {
+					break
+				}
+			}
+		}
+		return keep
+	}
+}
+
+func filterWithQuery() gtm.OpFilter {
+	return func(op *gtm.Op) bool {
+		if (op.IsInsert() || op.IsUpdate()) && op.Data != nil {
+			nss := []string{"", op.Namespace}
+			for _, ns := range nss {
+				if qf := queryFilters[ns]; qf != nil && !qf.query.Match(op.Data) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+}
+
+func filterInverseWithRegex(regex string) gtm.OpFilter {
+	var invalidNameSpace = regexp.MustCompile(regex)
+	return func(op *gtm.Op) bool {
+		if op.IsDrop() {
+			return true
+		}
+		return !invalidNameSpace.MatchString(op.Namespace)
+	}
+}
+
+func filterDropInverseWithRegex(regex string) gtm.OpFilter {
+	var invalidNameSpace = regexp.MustCompile(regex)
+	return func(op *gtm.Op) bool {
+		if op.IsDrop() {
+			return !invalidNameSpace.MatchString(op.Namespace)
+		}
+		return true
+	}
+}
+
+func (ic *indexClient) ensureClusterTTL() error {
+	io := options.Index()
+	io.SetName("expireAt")
+	io.SetBackground(true)
+	io.SetExpireAfterSeconds(30)
+	im := mongo.IndexModel{
+		Keys:    bson.M{"expireAt": 1},
+		Options: io,
+	}
+	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("cluster")
+	iv := col.Indexes()
+	_, err := iv.CreateOne(context.Background(), im)
+	return err
+}
+
+func (ic *indexClient) enableProcess() (bool, error) {
+	var err error
+	var host string
+	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("cluster")
+	findOneOpts := options.FindOne().SetProjection(bson.M{"_id": 1})
+	sr := col.FindOne(context.Background(), bson.M{"_id": ic.config.ResumeName}, findOneOpts)
+	err = sr.Err()
+	if err != mongo.ErrNoDocuments {
+		// only attempt the insert if no documents match
+		return false, err
+	}
+	doc := bson.M{}
+	doc["_id"] = ic.config.ResumeName
+	doc["pid"] = os.Getpid()
+	if host, err = os.Hostname(); err == nil {
+		doc["host"] = host
+	} else {
+		return false, err
+	}
+	doc["expireAt"] = time.Now().UTC()
+	_, err = col.InsertOne(context.Background(), doc)
+	if err == nil {
+		// update using $currentDate
+		_, err = ic.ensureEnabled()
+		if err == nil {
+			return true, nil
+		}
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (ic *indexClient) resetClusterState() error {
+	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("cluster")
+	_, err := col.DeleteOne(context.Background(), bson.M{"_id": ic.config.ResumeName})
+	return err
+}
+
+func (ic *indexClient) ensureEnabled() (enabled bool, err error) {
+	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("cluster")
+	result := col.FindOne(context.Background(), bson.M{
+		"_id": ic.config.ResumeName,
+	})
+	if err = result.Err(); err == nil {
+		doc := make(map[string]interface{})
+		if err = result.Decode(&doc); err == nil {
+			if doc["pid"] != nil && doc["host"] != nil {
+				var hostname string
+				pid := doc["pid"].(int32)
+				host := doc["host"].(string)
+				if hostname, err = os.Hostname(); err == nil {
+					enabled = (int(pid) == os.Getpid() && host == hostname)
+					if enabled {
+						_, err = col.UpdateOne(context.Background(), bson.M{
+							"_id": ic.config.ResumeName,
+						}, bson.M{
+							"$currentDate": bson.M{"expireAt": true},
+						})
+					}
+				}
+			}
+		}
+	}
+	if err == mongo.ErrNoDocuments {
+		err = nil
+	}
+	return
+}
+
+func (ic *indexClient) pauseWork() {
+	ic.gtmCtx.Pause()
+}
+
+func (ic *indexClient) resumeWork() {
+	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("monstache")
+	result := col.FindOne(context.Background(), bson.M{
+		"_id": ic.config.ResumeName,
+	})
+	if err := result.Err(); err == nil {
+		doc := make(map[string]interface{})
+		if err = result.Decode(&doc); err == nil {
+			if doc["ts"] != nil {
+				ts := doc["ts"].(primitive.Timestamp)
+				ic.gtmCtx.Since(ts)
+			}
+		}
+	}
+	ic.loadDerived()
+	ic.gtmCtx.Resume()
+}
+
+func (ic *indexClient) saveTokens() error {
+	err := ic.saveTokenDocs(ic.tokens)
+	if err == nil {
+		ic.tokens = bson.M{}
+	}
+	return err
+}
+
+// saveDDLTokens saves the resume tokens of the DDL events routed so far
+func (ic *indexClient) saveDDLTokens() error {
+	err := ic.saveTokenDocs(ic.ddlTokens)
+	if err == nil {
+		ic.ddlTokens = bson.M{}
+	}
+	return err
+}
+
+func (ic *indexClient) saveTokenDocs(tokens bson.M) error {
+	var err error
+	if len(tokens) == 0 {
+		return err
+	}
+	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("tokens")
+	bwo := options.BulkWrite().SetOrdered(false)
+	var models []mongo.WriteModel
+	for streamID, token := range tokens {
+		filter := bson.M{
+			"resumeName": ic.config.ResumeName,
+			"streamID":   streamID,
+		}
+		replacement := bson.M{
+			"resumeName": ic.config.ResumeName,
+			"streamID":   streamID,
+			"token":      token,
+		}
+		model := mongo.NewReplaceOneModel()
+		model.SetUpsert(true)
+		model.SetFilter(filter)
+		model.SetReplacement(replacement)
+		models = append(models, model)
+	}
+	_, err = col.BulkWrite(context.Background(), models, bwo)
+	return err
+}
+
+func (ic *indexClient) saveTimestamp() error {
+	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("monstache")
+	doc := map[string]interface{}{
+		"ts": ic.lastTs,
+	}
+	opts := options.Update()
+	opts.SetUpsert(true)
+	_, err := col.UpdateOne(context.Background(), bson.M{
+		"_id": ic.config.ResumeName,
+	}, bson.M{
+		"$set": doc,
+	}, opts)
+	return err
+}
+
+func (ic *indexClient) filterDirectReadNamespaces(wanted []string) (results []string, err error) {
+	results = make([]string, 0)
+	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("directreads")
+	filter := bson.M{
+		"_id": ic.config.ResumeName,
+	}
+	result := col.FindOne(context.Background(), filter)
+	if err = result.Err(); err == nil {
+		var doc struct {
+			Ns []string `bson:"ns"`
+		}
+		if err = result.Decode(&doc); err == nil {
+			var ns, skipped []string
+			if len(doc.Ns) > 0 {
+				ns = doc.Ns
+			}
+			for _, name := range wanted {
+				markedDone := false
+				for _, n := range ns {
+					if name == n {
+						markedDone = true
+						break
+					}
+				}
+				if !markedDone {
+					results = append(results, name)
+				} else {
+					skipped = append(skipped, name)
+				}
+			}
+			if len(skipped) > 0 {
+				infoLog.Printf("Skipping direct reads for namespaces marked complete: %+q", skipped)
+			}
+		}
+	} else if err == mongo.ErrNoDocuments {
+		err = nil
+		results = wanted
+	}
+	return
+}
+
+func (ic *indexClient) saveDirectReadNamespaces() (err error) {
+	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("directreads")
+	filter := bson.M{
+		"_id": ic.config.ResumeName,
+	}
+	ts := time.Now().UTC()
+	update := bson.M{
+		"$set":         bson.M{"updated": ts},
+		"$setOnInsert": bson.M{"created": ts},
+		"$addToSet":    bson.M{"ns": bson.M{"$each": ic.config.DirectReadNs}},
+	}
+	opts := options.Update().SetUpsert(true)
+	_, err = col.UpdateOne(context.Background(), filter, update, opts)
+	return
+}
+
+func (config *configOptions) parseCommandLineFlags() *configOptions {
+	flag.BoolVar(&config.Print, "print-config", false, "Print the configuration and then exit")
+	flag.BoolVar(&config.EnableTemplate, "tpl", false, "True to interpret the config file as a template")
+	flag.StringVar(&config.EnvDelimiter, "env-delimiter", ",", "A delimiter to use when splitting environment variable values")
+	flag.StringVar(&config.MongoURL, "mongo-url", "", "MongoDB server or router server connection URL")
+	flag.StringVar(&config.MongoConfigURL, "mongo-config-url", "", "MongoDB config server connection URL")
+	flag.StringVar(&config.MongoOpLogDatabaseName, "mongo-oplog-database-name", "", "Override the database name which contains the mongodb oplog")
+	flag.StringVar(&config.MongoOpLogCollectionName, "mongo-oplog-collection-name", "", "Override the collection name which contains the mongodb oplog")
+	flag.StringVar(&config.GraylogAddr, "graylog-addr", "", "Send logs to a Graylog server at this address")
+	flag.StringVar(&config.ElasticVersion, "elasticsearch-version", "", "Specify elasticsearch version directly instead of getting it from the server")
+	flag.StringVar(&config.ElasticAPIKey, "elasticsearch-api-key", "", "Base64 encoded elasticsearch APIKey value")
+	flag.StringVar(&config.ElasticUser, "elasticsearch-user", "", "The elasticsearch user name for basic auth")
+	flag.StringVar(&config.ElasticPassword, "elasticsearch-password", "", "The elasticsearch password for basic auth")
+	flag.StringVar(&config.ElasticPemFile, "elasticsearch-pem-file", "", "Path to a PEM file for secure connections to elasticsearch")
+	flag.BoolVar(&config.ElasticValidatePemFile, "elasticsearch-validate-pem-file", true, "Set to boolean false to not validate the Elasticsearch PEM file")
+	flag.IntVar(&config.ElasticMaxConns, "elasticsearch-max-conns", 0, "Elasticsearch max connections")
+	flag.IntVar(&config.PostProcessors, "post-processors", 0, "Number of post-processing go routines")
+	flag.IntVar(&config.ProcessBatchSize, "process-batch-size", 0, "Number of ops to hold before calling the ProcessBatch plugin function")
+	flag.IntVar(&config.ProcessBatchSeconds, "process-batch-seconds", 0, "Number of seconds before calling the ProcessBatch plugin function with the ops held")
+	flag.IntVar(&config.DeleteBatchSize, "delete-batch-size", 0, "Number of stateless deletes to resolve with a single search")
+	flag.IntVar(&config.DeleteBatchMillis, "delete-batch-millis", 0, "Number of milliseconds to hold stateless deletes before resolving them")
+	flag.IntVar(&config.FileDownloaders, "file-downloaders", 0, "GridFs download go routines")
+	flag.IntVar(&config.RelateThreads, "relate-threads", 0, "Number of threads dedicated to processing relationships")
+	flag.IntVar(&config.RelateBuffer, "relate-buffer", 0, "Number of relates to queue before skipping and reporting an error")
+	flag.BoolVar(&config.ElasticRetry, "elasticsearch-retry", false, "True to retry failed request to Elasticsearch")
+	flag.IntVar(&config.ElasticMaxDocs, "elasticsearch-max-docs", 0, "Number of docs to hold before flushing to Elasticsearch")
+	flag.IntVar(&config.ElasticMaxBytes, "elasticsearch-max-bytes", 0, "Number of bytes to hold before flushing to Elasticsearch")
+	flag.IntVar(&config.ElasticMaxSeconds, "elasticsearch-max-seconds", 0, "Number of seconds before flushing to Elasticsearch")
+	flag.IntVar(&config.ElasticClientTimeout, "elasticsearch-client-timeout", 0, "Number of seconds before a request to Elasticsearch is timed out")
+	flag.Int64Var(&config.MaxFileSize, "max-file-size", 0, "GridFs file content exceeding this limit in bytes will not be indexed in Elasticsearch")
+	flag.StringVar(&config.ConfigFile, "f", "", "Location of configuration file")
+	flag.BoolVar(&config.DroppedDatabases, "dropped-databases", true, "True to delete indexes from dropped databases")
+	flag.BoolVar(&config.DroppedCollections, "dropped-collections", true, "True to delete indexes from dropped collections")
+	flag.BoolVar(&config.Version, "v", false, "True to print the version number")
+	flag.BoolVar(&config.Gzip, "gzip", false, "True to enable gzip for requests to Elasticsearch")
+	flag.BoolVar(&config.Verbose, "verbose", false, "True to output verbose messages")
+	flag.BoolVar(&config.Pprof, "pprof", false, "True to enable pprof endpoints")
+	flag.BoolVar(&config.EnableOplog, "enable-oplog", false, "True to enable direct tailing of the oplog")
+	flag.BoolVar(&config.DisableChangeEvents, "disable-change-events", false, "True to disable listening for changes.  You must provide direct-reads in this case")
+	flag.BoolVar(&config.DisableDeleteProtection, "disable-delete-protection", false, "True to disable delete protection and allow multiple deletes in Elasticsearch per event in MongoDB")
+	flag.BoolVar(&config.EnableEasyJSON, "enable-easy-json", false, "True to enable easy-json serialization")
+	flag.BoolVar(&config.Stats, "stats", false, "True to print out statistics")
+	flag.BoolVar(&config.IndexStats, "index-stats", false, "True to index stats in elasticsearch")
+	flag.StringVar(&config.StatsDuration, "stats-duration", "", "The duration after which stats are logged")
+	flag.StringVar(&config.StatsIndexFormat, "stats-index-format", "", "time.Time supported format to use for the stats index names")
+	flag.BoolVar(&config.Resume, "resume", false, "True to capture the last timestamp of this run and resume on a subsequent run")
+	flag.Var(&config.ResumeStrategy, "resume-strategy", "Strategy to use for resuming. 0=timestamp,1=token")
+	flag.Int64Var(&config.ResumeFromTimestamp, "resume-from-timestamp", 0, "Timestamp to resume syncing from")
+	flag.BoolVar(&config.ResumeFromEarliestTimestamp, "resume-from-earliest-timestamp", false, "Automatically select an earliest timestamp to resume syncing from")
+	flag.BoolVar(&config.ResumeWriteUnsafe, "resume-write-unsafe", false, "True to speedup writes of the last timestamp synched for resuming at the cost of error checking")
+	flag.BoolVar(&config.Replay, "replay", false, "True to replay all events from the oplog and index them in elasticsearch")
+	flag.BoolVar(&config.IndexFiles, "index-files", false, "True to index gridfs files into elasticsearch. Requires the elasticsearch mapper-attachments (deprecated) or ingest-attachment plugin")
+	flag.BoolVar(&config.DisableFilePipelinePut, "disable-file-pipeline-put", false, "True to disable auto-creation of the ingest plugin pipeline")
+	flag.BoolVar(&config.IndexAsUpdate, "index-as-update", false, "True to index documents as updates instead of overwrites")
+	flag.BoolVar(&config.IndexPartialUpdates, "index-partial-updates", false, "True to send only the changed fields of updates when indexing as updates")
+	flag.BoolVar(&config.ExpandedEvents, "expanded-events", false, "True to listen for DDL change events such as create, createIndexes, modify and shardCollection (MongoDB 6+)")
+	flag.BoolVar(&config.FileHighlighting, "file-highlighting", false, "True to enable the ability to highlight search times for a file query")
+	flag.BoolVar(&config.EnablePatches, "enable-patches", false, "True to include an json-patch field on updates")
+	flag.BoolVar(&config.FailFast, "fail-fast", false, "True to exit if a single _bulk request fails")
+	flag.BoolVar(&config.IndexOplogTime, "index-oplog-time", false, "True to add date/time information from the oplog to each document when indexing")
+	flag.BoolVar(&config.ExitAfterDirectReads, "exit-after-direct-reads", false, "True to exit the program after reading directly from the configured namespaces")
+	flag.StringVar(&config.MergePatchAttr, "merge-patch-attribute", "", "Attribute to store json-patch values under")
+	flag.StringVar(&config.ResumeName, "resume-name", "", "Name under which to load/store the resume state. Defaults to 'default'")
+	flag.StringVar(&config.ClusterName, "cluster-name", "", "Name of the monstache process cluster")
+	flag.StringVar(&config.Worker, "worker", "", "The name of this worker in a multi-worker configuration")
+	flag.StringVar(&config.MapperPluginPath, "mapper-plugin-path", "", "The path to a .so file to load as a document mapper plugin")
+	flag.StringVar(&config.MapperPluginCommand, "mapper-plugin-command", "", "The path to an executable to run as an out-of-process mapper plugin")
+	flag.Var(&config.MapperPluginArgs, "mapper-plugin-arg", "A list of arguments passed to the mapper plugin command")
+	flag.StringVar(&config.MapperPluginTimeout, "mapper-plugin-timeout", "", "The maximum duration of a call to the mapper plugin command before it is restarted")
+	flag.StringVar(&config.DirectReadExcludeRegex, "direct-read-dynamic-exclude-regex", "", "A regex to use for excluding namespaces when using dynamic direct reads")
+	flag.StringVar(&config.DirectReadIncludeRegex, "direct-read-dynamic-include-regex", "", "A regex to use for including namespaces when using dynamic direct reads")
+	flag.StringVar(&config.NsRegex, "namespace-regex", "", "A regex which is matched against an operation's namespace (<database>.<collection>).  Only operations which match are synched to elasticsearch")
+	flag.StringVar(&config.NsDropRegex, "namespace-drop-regex", "", "A regex which is matched against a drop operation's namespace (<database>.<collection>).  Only drop operations which match are synched to elasticsearch")
+	flag.StringVar(&config.NsExcludeRegex, "namespace-exclude-regex", "", "A regex which is matched against an operation's namespace (<database>.<collection>).  Only operations which do not match are synched to elasticsearch")
+	flag.StringVar(&config.NsDropExcludeRegex, "namespace-drop-exclude-regex", "", "A regex which is matched against a drop operation's namespace (<database>.<collection>).  Only drop operations which do not match are synched to elasticsearch")
+	flag.Var(&config.ChangeStreamNs, "change-stream-namespace", "A list of change stream namespaces")
+	flag.Var(&config.DirectReadNs, "direct-read-namespace", "A list of direct read namespaces")
+	flag.IntVar(&config.DirectReadSplitMax, "direct-read-split-max", 0, "Max number of times to split a collection for direct reads")
+	flag.IntVar(&config.DirectReadConcur, "direct-read-concur", 0, "Max number of direct-read-namespaces to read concurrently. By default all givne are read concurrently")
+	flag.BoolVar(&config.DirectReadNoTimeout, "direct-read-no-timeout", false, "True to set the no cursor timeout flag for direct reads")
+	flag.BoolVar(&config.DirectReadBounded, "direct-read-bounded", false, "True to limit direct reads to the docs present at query start time")
+	flag.BoolVar(&config.DirectReadStateful, "direct-read-stateful", false, "True to mark direct read namespaces as complete and not sync them in future runs")
+	flag.Var(&config.RoutingNamespaces, "routing-namespace", "A list of namespaces that override routing information")
+	flag.Var(&config.TimeMachineNamespaces, "time-machine-namespace", "A list of direct read namespaces")
+	flag.StringVar(&config.TimeMachineIndexPrefix, "time-machine-index-prefix", "", "A prefix to preprend to time machine indexes")
+	flag.StringVar(&config.TimeMachineIndexSuffix, "time-machine-index-suffix", "", "A suffix to append to time machine indexes")
+	flag.BoolVar(&config.TimeMachineDirectReads, "time-machine-direct-reads", false, "True to index the results of direct reads into the any time machine indexes")
+	flag.BoolVar(&config.PipeAllowDisk, "pipe-allow-disk", false, "True to allow MongoDB to use the disk for pipeline options with lots of results")
+	flag.Var(&config.ElasticUrls, "elasticsearch-url", "A list of Elasticsearch URLs")
+	flag.Var(&config.FileNamespaces, "file-namespace", "A list of file namespaces")
+	flag.Var(&config.PatchNamespaces, "patch-namespace", "A list of patch namespaces")
+	flag.Var(&config.Workers, "workers", "A list of worker names")
+	flag.BoolVar(&config.EnableHTTPServer, "enable-http-server", false, "True to enable an internal http server")
+	flag.StringVar(&config.HTTPServerAddr, "http-server-addr", "", "The address the internal http server listens on")
+	flag.BoolVar(&config.PruneInvalidJSON, "prune-invalid-json", false, "True to omit values which do not serialize to JSON such as +Inf and -Inf and thus cause errors")
+	flag.Var(&config.DeleteStrategy, "delete-strategy", "Stategy to use for deletes. 0=stateless,1=stateful,2=ignore,3=tombstone")
+	flag.Var(&config.RenameStrategy, "rename-strategy", "Strategy to use for collection renames. 0=ignore,1=reindex,2=alias")
+	flag.StringVar(&config.DeleteIndexPattern, "delete-index-pattern", "", "An Elasticsearch index-pattern to restric the scope of stateless deletes")
+	flag.StringVar(&config.DeleteMetaStore, "delete-meta-store", "", "Where stateful deletes keep document metadata. mongodb or elasticsearch")
+	flag.StringVar(&config.DeleteMetaIndex, "delete-meta-index", "", "The Elasticsearch index holding document metadata when delete-meta-store is elasticsearch")
+	flag.StringVar(&config.ConfigDatabaseName, "config-database-name", "", "The MongoDB database name that monstache uses to store metadata")
+	flag.StringVar(&config.OplogTsFieldName, "oplog-ts-field-name", "", "Field name to use for the oplog timestamp")
+	flag.StringVar(&config.OplogDateFieldName, "oplog-date-field-name", "", "Field name to use for the oplog date")
+	flag.StringVar(&config.OplogDateFieldFormat, "oplog-date-field-format", "", "Format to use for the oplog date")
+	flag.BoolVar(&config.Debug, "debug", false, "True to enable verbose debug information")
+	flag.StringVar(&config.TestMappingInput, "test-mapping-input", "", "Path to a file of Extended JSON test events for the test-mapping command. Defaults to stdin")
+	flag.Parse()
+	return config
+}
+
+func (config *configOptions) loadReplacements() {
+	if config.Relate != nil {
+		for _, r := range config.Relate {
+			if r.Namespace != "" || r.WithNamespace != "" {
+				dbCol := strings.SplitN(r.WithNamespace, ".", 2)
+				if len(dbCol) != 2 {
+					errorLog.Fatalf("Replacement namespace is invalid: %s", r.WithNamespace)
+				}
+				database, collection := dbCol[0], dbCol[1]
+				r := &relation{
+					Namespace:      r.Namespace,
+					WithNamespace:  r.WithNamespace,
+					SrcField:       r.SrcField,
+					MatchField:     r.MatchField,
+					KeepSrc:        r.KeepSrc,
+					DotNotation:    r.DotNotation,
+					MaxDepth:       r.MaxDepth,
+					MatchFieldType: r.MatchFieldType,
+					db:             database,
+					col:            collection,
+				}
+				if r.SrcField == "" {
+					r.SrcField = "_id"
+				}
+				if r.MatchField == "" {
+					r.MatchField = "_id"
+				}
+				relates[r.Namespace] = append(relates[r.Namespace], r)
+			} else {
+				errorLog.Fatalln("Relates must specify namespace and with-namespace")
+			}
+		}
+	}
+}
+
+func (config *configOptions) loadIndexTypes() {
+	if config.Mapping != nil {
+		for _, m := range config.Mapping {
+			for _, su := range m.ScriptUpdates {
+				if err := su.validate(); err != nil {
+					errorLog.Fatalf("Invalid script update for mapping %s: %s", m.Namespace, err)
+				}
+			}
+			for _, f := range m.IgnoreUpdates {
+				if _, err := path.Match(f, ""); err != nil {
+					errorLog.Fatalf("Invalid ignore-update-fields path %s for mapping %s: %s", f, m.Namespace, err)
+				}
+			}
+			if m.Namespace != "" && m.Index == "" && (len(m.ScriptUpdates) > 0 || len(m.IgnoreUpdates) > 0) {
+				mapIndexTypes[m.Namespace] = &indexMapping{
+					Namespace:     m.Namespace,
+					ScriptUpdates: m.ScriptUpdates,
+					IgnoreUpdates: m.IgnoreUpdates,
+				}
+			} else if m.Namespace != "" && m.Index != "" {
+				template, err := parseIndexTemplate(m.Index)
+				if err != nil {
+					errorLog.Fatalln(err)
+				}
+				index := strings.ToLower(m.Index)
+				if template != nil {
+					index = template.pattern()
+				}
+				mapIndexTypes[m.Namespace] = &indexMapping{
+					Namespace:     m.Namespace,
+					Index:         index,
+					ScriptUpdates: m.ScriptUpdates,
+					IgnoreUpdates: m.IgnoreUpdates,
+					template:      template,
+				}
+			} else {
+				errorLog.Fatalln("Mappings must specify namespace and index, script-update or ignore-update-fields")
+			}
+		}
+	}
+}
+
+func parseAggregationStages(pipeline string) ([]interface{}, error) {
+	var doc struct {
+		Stages []interface{} `bson:"stages"`
+	}
+	ext := fmt.Sprintf(`{"stages": %s}`, pipeline)
+	if err := bson.UnmarshalExtJSON([]byte(ext), false, &doc); err != nil {
+		return nil, fmt.Errorf("pipeline must be an array of stages: %s", err)
+	}
+	return doc.Stages, nil
+}
+
+func (config *configOptions) loadAggregations() {
+	for _, a := range config.Aggregation {
+		if a.Namespace == "" {
+			errorLog.Fatalln("Aggregations must specify a namespace")
+		}
+		if a.Path == "" && a.Pipeline == "" {
+			errorLog.Fatalln("Aggregations must specify path or pipeline attributes")
+		}
+		if a.Path != "" && a.Pipeline != "" {
+			errorLog.Fatalln("Aggregations must specify path or pipeline but not both")
+		}
+		if a.Path != "" {
+			if pipeline, err := ioutil.ReadFile(a.Path); err == nil {
+				a.Pipeline = string(pipeline)
+			} else {
+				errorLog.Fatalf("Unable to load aggregation at path %s: %s", a.Path, err)
+			}
+		}
+		if _, exists := aggregations[a.Namespace]; exists {
+			errorLog.Fatalf("Multiple aggregations with namespace: %s", a.Namespace)
+		}
+		stages, err := parseAggregationStages(a.Pipeline)
+		if err != nil {
+			errorLog.Fatalf("Invalid aggregation for namespace %s: %s", a.Namespace, err)
+		}
+		a.stages = stages
+		if a.Timeout != "" {
+			if a.timeout, err = time.ParseDuration(a.Timeout); err != nil {
+				errorLog.Fatalf("Unable to parse aggregation timeout for namespace %s: %s", a.Namespace, err)
+			}
+		}
+		aggregations[a.Namespace] = a
+	}
+}
+
+func (config *configOptions) loadOperationPolicies() {
+	for _, p := range config.OperationPolicy {
+		if err := p.validate(); err != nil {
+			errorLog.Fatalf("Invalid operation policy for namespace %s: %s", p.Namespace, err)
+		}
+		if _, exists := operationPolicies[p.Namespace]; exists {
+			errorLog.Fatalf("Multiple operation policies with namespace: %s", p.Namespace)
+		}
+		operationPolicies[p.Namespace] = p
+	}
+}
+
+func (config *configOptions) loadSoftDeletes() {
+	for _, sd := range config.SoftDelete {
+		if sd.Namespace == "" {
+			errorLog.Fatalln("Soft deletes must specify a namespace")
+		}
+		if sd.Field == "" && sd.Query == nil {
+			errorLog.Fatalln("Soft deletes must specify field or query attributes")
+		}
+		if _, exists := softDeletes[sd.Namespace]; exists {
+			errorLog.Fatalf("Multiple soft deletes with namespace: %s", sd.Namespace)
+		}
+		var q interface{} = sd.Query
+		if q == nil {
+			q = map[string]interface{}{sd.Field: map[string]interface{}{"$ne": nil}}
+		}
+		var err error
+		if sd.query, err = compileQuery(q); err != nil {
+			errorLog.Fatalf("Invalid soft delete query for namespace %s: %s", sd.Namespace, err)
+		}
+		softDeletes[sd.Namespace] = sd
+	}
+}
+
+// softDeleted returns true if the data of op matches the soft delete rule
+// of its namespace
+func softDeleted(op *gtm.Op) bool {
+	sd := softDeletes[op.Namespace]
+	return sd != nil && op.Data != nil && sd.query.Match(op.Data)
+}
+
+func (p *operationPolicy) validate() error {
+	if p.Namespace == "" {
+		return errors.New("a namespace is required")
+	}
+	// an empty list would silently exclude every operation
+	if len(p.Operations) == 0 {
+		return errors.New("at least one operation is required")
+	}
+	for _, o := range p.Operations {
+		switch o {
+		case "insert", "update", "delete", "drop":
+		default:
+			return fmt.Errorf("invalid operation %q: must be insert, update, delete or drop", o)
+		}
+	}
+	return nil
+}
+
+func (p *operationPolicy) allows(operation string) bool {
+	for _, o := range p.Operations {
+		if o == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsOperation returns true unless the policy of the namespace, or else
+// of its database, excludes the operation
+func allowsOperation(ns, operation string) bool {
+	p := operationPolicies[ns]
+	if p == nil {
+		p = operationPolicies[strings.SplitN(ns, ".", 2)[0]]
+	}
+	return p == nil || p.allows(operation)
+}
+
+// allowsOp returns true unless an operation policy excludes the insert,
+// update, delete or drop of op
+func allowsOp(op *gtm.Op) bool {
+	if db, drop := op.IsDropDatabase(); drop {
+		return allowsDropDatabase(db)
+	} else if col, drop := op.IsDropCollection(); drop {
+		return allowsOperation(op.GetDatabase()+"."+col, "drop")
+	} else if op.IsInsert() || op.IsUpdate() || op.IsDelete() {
+		return allowsOperation(op.Namespace, opOperationName(op))
+	}
+	return true
+}
+
+// allowsDropDatabase returns true if neither the database nor any of its
+// collections has a policy excluding drops
+func allowsDropDatabase(db string) bool {
+	if !allowsOperation(db, "drop") {
+		return false
+	}
+	for ns, p := range operationPolicies {
+		if strings.HasPrefix(ns, db+".") && !p.allows("drop") {
+			return false
+		}
+	}
+	return true
+}
+
+func (config *configOptions) loadPipelines() {
+	for _, s := range config.Pipeline {
+		if s.Path == "" && s.Script == "" {
+			errorLog.Fatalln("Pipelines must specify path or script attributes")
+		}
+		if s.Path != "" && s.Script != "" {
+			errorLog.Fatalln("Pipelines must specify path or script but not both")
+		}
+		if s.Path != "" {
+			if script, err := ioutil.ReadFile(s.Path); err == nil {
+				s.Script = string(script[:])
+			} else {
+				errorLog.Fatalf("Unable to load pipeline at path %s: %s", s.Path, err)
+			}
+		}
+		if _, exists := filterEnvs[s.Namespace]; exists {
+			errorLog.Fatalf("Multiple pipelines with namespace: %s", s.Namespace)
+		}
+		env := s.newExecutionEnv(config.scriptModuleDir())
+		if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
+			errorLog.Fatalln(err)
+		}
+		if err := env.VM.Set("stringFromBinData", jsStringFromBinData); err != nil {
+			errorLog.Fatalln(err)
+		}
+		if _, err := env.VM.Run(env.Script); err != nil {
+			errorLog.Fatalln(err)
+		}
+		val, err := env.VM.Run("module.exports")
+		if err != nil {
+			errorLog.Fatalln(err)
+		} else if !val.IsFunction() {
+			errorLog.Fatalln("module.exports must be a function")
+		}
+		pipeEnvs[s.Namespace] = env
+	}
+}
+
+// compileQuery compiles a query given in TOML as a document or as an
+// Extended JSON string
+func compileQuery(q interface{}) (*query.Query, error) {
+	switch q := q.(type) {
+	case string:
+		return query.Parse(q)
+	case map[string]interface{}:
+		return query.Compile(q)
+	}
+	return nil, fmt.Errorf("query must be a document or an Extended JSON string")
+}
+
+func (config *configOptions) loadFilters() {
+	for _, s := range config.Filter {
+		if s.Query != nil {
+			if _, exists := queryFilters[s.Namespace]; exists {
+				errorLog.Fatalf("Multiple query filters with namespace: %s", s.Namespace)
+			}
+			q, err := compileQuery(s.Query)
+			if err != nil {
+				errorLog.Fatalf("Invalid query for filter with namespace %s: %s", s.Namespace, err)
+			}
+			queryFilters[s.Namespace] = &queryFilter{query: q, pushdown: s.Pushdown}
+			if s.Script == "" && s.Path == "" {
+				continue
+			}
+		}
+		if s.Script != "" || s.Path != "" {
+			if s.Path != "" && s.Script != "" {
+				errorLog.Fatalln("Filters must specify path or script but not both")
+			}
+			if s.Path != "" {
+				if script, err := ioutil.ReadFile(s.Path); err == nil {
+					s.Script = string(script[:])
+				} else {
+					errorLog.Fatalf("Unable to load filter at path %s: %s", s.Path, err)
+				}
+			}
+			if _, exists := filterEnvs[s.Namespace]; exists {
+				errorLog.Fatalf("Multiple filters with namespace: %s", s.Namespace)
+			}
+			env := s.newExecutionEnv(config.scriptModuleDir())
+			if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
+				errorLog.Fatalln(err)
 			}
-			if ok, err := filterPlugin(input); err == nil {
-				keep = ok
+			if err := env.VM.Set("stringFromBinData", jsStringFromBinData); err != nil {
+				errorLog.Fatalln(err)
+			}
+			if _, err := env.VM.Run(env.Script); err != nil {
+				errorLog.Fatalln(err)
+			}
+			val, err := env.VM.Run("module.exports")
+			if err != nil {
+				errorLog.Fatalln(err)
+			} else if !val.IsFunction() {
+				errorLog.Fatalln("module.exports must be a function")
+			}
+			filterEnvs[s.Namespace] = env
+		} else {
+			errorLog.Fatalln("Filters must specify path, script or query attributes")
+		}
+	}
+}
+
+func (config *configOptions) loadDDLScripts() {
+	for _, s := range config.DDLScript {
+		if s.Path == "" && s.Script == "" {
+			errorLog.Fatalln("DDL scripts must specify path or script attributes")
+		}
+		if s.Path != "" && s.Script != "" {
+			errorLog.Fatalln("DDL scripts must specify path or script but not both")
+		}
+		if s.Path != "" {
+			if script, err := ioutil.ReadFile(s.Path); err == nil {
+				s.Script = string(script[:])
 			} else {
-				errorLog.Println(err)
+				errorLog.Fatalf("Unable to load DDL script at path %s: %s", s.Path, err)
 			}
 		}
-		return keep
+		if _, exists := ddlEnvs[s.Namespace]; exists {
+			errorLog.Fatalf("Multiple DDL scripts with namespace: %s", s.Namespace)
+		}
+		env := s.newExecutionEnv(config.scriptModuleDir())
+		if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
+			errorLog.Fatalln(err)
+		}
+		if _, err := env.VM.Run(env.Script); err != nil {
+			errorLog.Fatalln(err)
+		}
+		val, err := env.VM.Run("module.exports")
+		if err != nil {
+			errorLog.Fatalln(err)
+		} else if !val.IsFunction() {
+			errorLog.Fatalln("module.exports must be a function")
+		}
+		ddlEnvs[s.Namespace] = env
 	}
 }
 
-func filterWithScript() gtm.OpFilter {
-	return func(op *gtm.Op) bool {
-		var keep = true
-		if (op.IsInsert() || op.IsUpdate()) && op.Data != nil {
-			nss := []string{"", op.Namespace}
-			for _, ns := range nss {
-				if env := filterEnvs[ns]; env != nil {
-					keep = false
-					arg := convertMapJavascript(op.Data)
-					arg2 := op.Namespace
-					arg3 := convertMapJavascript(op.UpdateDescription)
-					env.lock.Lock()
-					defer env.lock.Unlock()
-					val, err := env.VM.Call("module.exports", arg, arg, arg2, arg3)
-					if err != nil {
-						errorLog.Println(err)
-					} else {
-						if ok, err := val.ToBoolean(); err == nil {
-							keep = ok
-						} else {
-							errorLog.Println(err)
-						}
-					}
-				}
-				if !keep {
-					break
-				}
+func (config *configOptions) loadCreateIndexes() {
+	for _, c := range config.CreateIndex {
+		if c.Body == "" && c.Path == "" {
+			errorLog.Fatalln("Create index settings must specify path or body attributes")
+		}
+		if c.Body != "" && c.Path != "" {
+			errorLog.Fatalln("Create index settings must specify path or body but not both")
+		}
+		if c.Path != "" {
+			if body, err := ioutil.ReadFile(c.Path); err == nil {
+				c.Body = string(body)
+			} else {
+				errorLog.Fatalf("Unable to load create index body at path %s: %s", c.Path, err)
 			}
 		}
-		return keep
+		if _, exists := createIndexes[c.Namespace]; exists {
+			errorLog.Fatalf("Multiple create index settings with namespace: %s", c.Namespace)
+		}
+		if err := json.Unmarshal([]byte(c.Body), &c.body); err != nil {
+			errorLog.Fatalf("Invalid create index body for namespace %s: %s", c.Namespace, err)
+		}
+		createIndexes[c.Namespace] = c
 	}
 }
 
-func filterInverseWithRegex(regex string) gtm.OpFilter {
-	var invalidNameSpace = regexp.MustCompile(regex)
-	return func(op *gtm.Op) bool {
-		if op.IsDrop() {
-			return true
+// routeDDL creates the index of a created collection from the configured
+// create index body and passes the event to any DDL script.  A script error
+// under the fail policy stops monstache before the DDL resume token is saved.
+// DDL events that happen while monstache is stopped are only replayed when
+// resume is enabled; otherwise an index for a collection created during the
+// downtime is created by the first insert with default settings.
+func (ic *indexClient) routeDDL(op *gtm.Op, ddl string) (err error) {
+	if ddl == "create" {
+		err = ic.createIndexFor(op)
+	}
+	if e := ic.runDDLScript(op, ddl); e != nil {
+		if isFatal(e) {
+			return e
 		}
-		return !invalidNameSpace.MatchString(op.Namespace)
+		errorLog.Printf("Unable to run DDL script for %s event on %s: %s", ddl, op.Namespace, e)
 	}
+	return
 }
 
-func filterDropInverseWithRegex(regex string) gtm.OpFilter {
-	var invalidNameSpace = regexp.MustCompile(regex)
-	return func(op *gtm.Op) bool {
-		if op.IsDrop() {
-			return !invalidNameSpace.MatchString(op.Namespace)
+func (ic *indexClient) createIndexFor(op *gtm.Op) (err error) {
+	c := createIndexes[op.Namespace]
+	if c == nil {
+		c = createIndexes[""]
+	}
+	if c == nil {
+		return
+	}
+	if desc := toMap(op.Data["operationDescription"]); desc != nil && desc["viewOn"] != nil {
+		return
+	}
+	if m := mapIndexTypes[op.Namespace]; m != nil && m.template != nil {
+		return
+	}
+	ctx := context.Background()
+	index := indexForNamespace(op.Namespace)
+	exists, err := ic.client.IndexExists(index).Do(ctx)
+	if err != nil || exists {
+		return
+	}
+	if _, err = ic.client.CreateIndex(index).BodyJson(c.body).Do(ctx); err != nil {
+		var ee *elastic.Error
+		if errors.As(err, &ee) && ee.Details != nil && ee.Details.Type == "resource_already_exists_exception" {
+			return nil
 		}
-		return true
+		return
 	}
+	infoLog.Printf("Created index %s for new collection %s", index, op.Namespace)
+	return
 }
 
-func (ic *indexClient) ensureClusterTTL() error {
-	io := options.Index()
-	io.SetName("expireAt")
-	io.SetBackground(true)
-	io.SetExpireAfterSeconds(30)
-	im := mongo.IndexModel{
-		Keys:    bson.M{"expireAt": 1},
-		Options: io,
+func (ic *indexClient) runDDLScript(op *gtm.Op, ddl string) (err error) {
+	env := ddlEnvs[op.Namespace]
+	if env == nil {
+		env = ddlEnvs[""]
 	}
-	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("cluster")
-	iv := col.Indexes()
-	_, err := iv.CreateOne(context.Background(), im)
-	return err
+	if env == nil {
+		return
+	}
+	event := map[string]interface{}{
+		"type":                 ddl,
+		"operationDescription": op.Data["operationDescription"],
+	}
+	arg := convertMapJavascript(event)
+	arg2 := op.Namespace
+	arg3 := scriptContext(op)
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	if _, err = env.call(arg, arg2, arg3); err != nil {
+		err = ic.onScriptError(env, op, err)
+	}
+	return
 }
 
-func (ic *indexClient) enableProcess() (bool, error) {
-	var err error
-	var host string
-	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("cluster")
-	findOneOpts := options.FindOne().SetProjection(bson.M{"_id": 1})
-	sr := col.FindOne(context.Background(), bson.M{"_id": ic.config.ResumeName}, findOneOpts)
-	err = sr.Err()
-	if err != mongo.ErrNoDocuments {
-		// only attempt the insert if no documents match
-		return false, err
+func (config *configOptions) loadDeleteScripts() {
+	for _, s := range config.DeleteScript {
+		if s.Path == "" && s.Script == "" {
+			errorLog.Fatalln("Delete scripts must specify path or script attributes")
+		}
+		if s.Path != "" && s.Script != "" {
+			errorLog.Fatalln("Delete scripts must specify path or script but not both")
+		}
+		if s.Path != "" {
+			if script, err := ioutil.ReadFile(s.Path); err == nil {
+				s.Script = string(script[:])
+			} else {
+				errorLog.Fatalf("Unable to load delete script at path %s: %s", s.Path, err)
+			}
+		}
+		if _, exists := deleteEnvs[s.Namespace]; exists {
+			errorLog.Fatalf("Multiple delete scripts with namespace: %s", s.Namespace)
+		}
+		env := s.newExecutionEnv(config.scriptModuleDir())
+		if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
+			errorLog.Fatalln(err)
+		}
+		if err := env.VM.Set("stringFromBinData", jsStringFromBinData); err != nil {
+			errorLog.Fatalln(err)
+		}
+		if _, err := env.VM.Run(env.Script); err != nil {
+			errorLog.Fatalln(err)
+		}
+		val, err := env.VM.Run("module.exports")
+		if err != nil {
+			errorLog.Fatalln(err)
+		} else if !val.IsFunction() {
+			errorLog.Fatalln("module.exports must be a function")
+		}
+		deleteEnvs[s.Namespace] = env
 	}
-	doc := bson.M{}
-	doc["_id"] = ic.config.ResumeName
-	doc["pid"] = os.Getpid()
-	if host, err = os.Hostname(); err == nil {
-		doc["host"] = host
-	} else {
-		return false, err
+}
+
+func (policy scriptErrorPolicy) validate() error {
+	switch policy {
+	case defaultScriptErrorPolicy, skipScriptErrorPolicy, indexScriptErrorPolicy,
+		deadLetterScriptErrorPolicy, failScriptErrorPolicy:
+		return nil
 	}
-	doc["expireAt"] = time.Now().UTC()
-	_, err = col.InsertOne(context.Background(), doc)
-	if err == nil {
-		// update using $currentDate
-		_, err = ic.ensureEnabled()
-		if err == nil {
-			return true, nil
+	return fmt.Errorf("Invalid script on-error policy %q: must be one of skip, index, dead-letter or fail", string(policy))
+}
+
+func (s *javascript) newExecutionEnv(moduleDir string) *executionEnv {
+	env := &executionEnv{
+		VM:          otto.New(),
+		Script:      s.Script,
+		lock:        &sync.Mutex{},
+		errorPolicy: s.OnError,
+	}
+	modules := &jsModules{
+		dir:     moduleDir,
+		vm:      env.VM,
+		modules: make(map[string]*otto.Object),
+	}
+	if err := env.VM.Set("require", modules.require); err != nil {
+		errorLog.Fatalln(err)
+	}
+	if err := loadLibraryFunctions(env.VM, s.Namespace); err != nil {
+		errorLog.Fatalln(err)
+	}
+	if err := s.OnError.validate(); err != nil {
+		errorLog.Fatalf("Script for namespace %q is invalid: %s", s.Namespace, err)
+	}
+	if s.CacheSize < 0 {
+		errorLog.Fatalf("Script cache-size for namespace %q must not be negative", s.Namespace)
+	}
+	env.cacheSize = s.CacheSize
+	if s.CacheTTL != "" {
+		ttl, err := time.ParseDuration(s.CacheTTL)
+		if err != nil {
+			errorLog.Fatalf("Unable to parse script cache-ttl for namespace %q: %s", s.Namespace, err)
 		}
+		env.cacheTTL = ttl
 	}
-	if mongo.IsDuplicateKeyError(err) {
-		return false, nil
+	if s.Timeout != "" {
+		timeout, err := time.ParseDuration(s.Timeout)
+		if err != nil {
+			errorLog.Fatalf("Unable to parse script timeout for namespace %q: %s", s.Namespace, err)
+		}
+		env.timeout = timeout
 	}
-	return false, err
+	return env
 }
 
-func (ic *indexClient) resetClusterState() error {
-	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("cluster")
-	_, err := col.DeleteOne(context.Background(), bson.M{"_id": ic.config.ResumeName})
-	return err
+type scriptCounters struct {
+	sync.Mutex
+	counts map[string]int64
 }
 
-func (ic *indexClient) ensureEnabled() (enabled bool, err error) {
-	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("cluster")
-	result := col.FindOne(context.Background(), bson.M{
-		"_id": ic.config.ResumeName,
-	})
-	if err = result.Err(); err == nil {
-		doc := make(map[string]interface{})
-		if err = result.Decode(&doc); err == nil {
-			if doc["pid"] != nil && doc["host"] != nil {
-				var hostname string
-				pid := doc["pid"].(int32)
-				host := doc["host"].(string)
-				if hostname, err = os.Hostname(); err == nil {
-					enabled = (int(pid) == os.Getpid() && host == hostname)
-					if enabled {
-						_, err = col.UpdateOne(context.Background(), bson.M{
-							"_id": ic.config.ResumeName,
-						}, bson.M{
-							"$currentDate": bson.M{"expireAt": true},
-						})
-					}
-				}
-			}
+var counters = &scriptCounters{counts: make(map[string]int64)}
+
+func (c *scriptCounters) add(name string, delta int64) int64 {
+	c.Lock()
+	defer c.Unlock()
+	c.counts[name] += delta
+	return c.counts[name]
+}
+
+func (c *scriptCounters) snapshot() map[string]int64 {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.counts) == 0 {
+		return nil
+	}
+	snap := make(map[string]int64, len(c.counts))
+	for k, v := range c.counts {
+		snap[k] = v
+	}
+	return snap
+}
+
+type monstacheStats struct {
+	elastic.BulkProcessorStats
+	Counters map[string]int64 `json:",omitempty"`
+}
+
+func statsSnapshot(bulk *elastic.BulkProcessor) monstacheStats {
+	return monstacheStats{
+		BulkProcessorStats: bulk.Stats(),
+		Counters:           counters.snapshot(),
+	}
+}
+
+type jsLibrary struct {
+	vm *otto.Otto
+	ns string
+}
+
+func (lib *jsLibrary) logError(name string, err error) otto.Value {
+	errorLog.Printf("Error in function %s: %s", name, err)
+	return otto.NullValue()
+}
+
+func (lib *jsLibrary) toValue(v interface{}) otto.Value {
+	val, err := lib.vm.ToValue(v)
+	if err != nil {
+		errorLog.Printf("Error converting value for javascript: %s", err)
+		return otto.NullValue()
+	}
+	return val
+}
+
+func (lib *jsLibrary) toDate(t time.Time) (otto.Value, error) {
+	return lib.vm.Call("new Date", nil, float64(t.UnixNano()/int64(time.Millisecond)))
+}
+
+func (lib *jsLibrary) fromDate(v otto.Value) (t time.Time, err error) {
+	if v.Class() == "Date" {
+		var ms otto.Value
+		if ms, err = v.Object().Call("getTime"); err != nil {
+			return
+		}
+		var f float64
+		if f, err = ms.ToFloat(); err == nil {
+			t = time.Unix(0, int64(f)*int64(time.Millisecond)).UTC()
+		}
+	} else if v.IsNumber() {
+		var f float64
+		if f, err = v.ToFloat(); err == nil {
+			t = time.Unix(0, int64(f)*int64(time.Millisecond)).UTC()
+		}
+	} else if v.IsString() {
+		t, err = time.Parse(time.RFC3339Nano, v.String())
+	} else {
+		err = errors.New("Expected a Date, number of milliseconds or RFC3339 string")
+	}
+	return
+}
+
+func (lib *jsLibrary) location(v otto.Value) (*time.Location, error) {
+	if !v.IsDefined() || v.IsNull() || v.String() == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(v.String())
+}
+
+func (lib *jsLibrary) objectID(v otto.Value) (oid primitive.ObjectID, err error) {
+	exported, err := v.Export()
+	if err != nil {
+		return
+	}
+	switch id := exported.(type) {
+	case primitive.ObjectID:
+		oid = id
+	case string:
+		oid, err = primitive.ObjectIDFromHex(id)
+	default:
+		err = fmt.Errorf("Expected an ObjectId or hex string but got %T", exported)
+	}
+	return
+}
+
+func (lib *jsLibrary) hash(name string, h func() hash.Hash) func(otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		if !call.Argument(0).IsDefined() {
+			return lib.logError(name, errors.New("A value to hash is required"))
 		}
+		hasher := h()
+		hasher.Write([]byte(call.Argument(0).String()))
+		return lib.toValue(hex.EncodeToString(hasher.Sum(nil)))
 	}
-	if err == mongo.ErrNoDocuments {
-		err = nil
+}
+
+func (lib *jsLibrary) hmac(call otto.FunctionCall) otto.Value {
+	var h func() hash.Hash
+	switch strings.ToLower(call.Argument(0).String()) {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	case "sha512":
+		h = sha512.New
+	default:
+		return lib.logError("hmac", fmt.Errorf("Unsupported hmac algorithm %s", call.Argument(0)))
 	}
-	return
+	mac := hmac.New(h, []byte(call.Argument(1).String()))
+	mac.Write([]byte(call.Argument(2).String()))
+	return lib.toValue(hex.EncodeToString(mac.Sum(nil)))
 }
 
-func (ic *indexClient) pauseWork() {
-	ic.gtmCtx.Pause()
+// uuid returns a random version 4 UUID in its string form
+func (lib *jsLibrary) uuid(call otto.FunctionCall) otto.Value {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return lib.logError("uuid", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	bin := monstachemap.Binary{Binary: primitive.Binary{Subtype: 0x04, Data: b}}
+	return lib.toValue(monstachemap.EncodeBinData(bin))
 }
 
-func (ic *indexClient) resumeWork() {
-	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("monstache")
-	result := col.FindOne(context.Background(), bson.M{
-		"_id": ic.config.ResumeName,
-	})
-	if err := result.Err(); err == nil {
-		doc := make(map[string]interface{})
-		if err = result.Decode(&doc); err == nil {
-			if doc["ts"] != nil {
-				ts := doc["ts"].(primitive.Timestamp)
-				ic.gtmCtx.Since(ts)
-			}
-		}
+// binDataFromUUID converts the string form of a UUID into BinData for use in
+// queries.  It is the inverse of stringFromBinData
+func (lib *jsLibrary) binDataFromUUID(call otto.FunctionCall) otto.Value {
+	s := strings.Replace(call.Argument(0).String(), "-", "", -1)
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 16 {
+		return lib.logError("binDataFromUUID", fmt.Errorf("Invalid UUID %s", call.Argument(0)))
 	}
-	ic.gtmCtx.Resume()
+	return lib.toValue(primitive.Binary{Subtype: 0x04, Data: b})
 }
 
-func (ic *indexClient) saveTokens() error {
-	var err error
-	if len(ic.tokens) == 0 {
-		return err
+func (lib *jsLibrary) newObjectID(call otto.FunctionCall) otto.Value {
+	return lib.toValue(primitive.NewObjectID().Hex())
+}
+
+func (lib *jsLibrary) objectIDTime(call otto.FunctionCall) otto.Value {
+	oid, err := lib.objectID(call.Argument(0))
+	if err != nil {
+		return lib.logError("objectIdTime", err)
 	}
-	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("tokens")
-	bwo := options.BulkWrite().SetOrdered(false)
-	var models []mongo.WriteModel
-	for streamID, token := range ic.tokens {
-		filter := bson.M{
-			"resumeName": ic.config.ResumeName,
-			"streamID":   streamID,
-		}
-		replacement := bson.M{
-			"resumeName": ic.config.ResumeName,
-			"streamID":   streamID,
-			"token":      token,
-		}
-		model := mongo.NewReplaceOneModel()
-		model.SetUpsert(true)
-		model.SetFilter(filter)
-		model.SetReplacement(replacement)
-		models = append(models, model)
+	date, err := lib.toDate(oid.Timestamp())
+	if err != nil {
+		return lib.logError("objectIdTime", err)
 	}
-	_, err = col.BulkWrite(context.Background(), models, bwo)
-	if err == nil {
-		ic.tokens = bson.M{}
+	return date
+}
+
+func (lib *jsLibrary) objectIDFromTime(call otto.FunctionCall) otto.Value {
+	t, err := lib.fromDate(call.Argument(0))
+	if err != nil {
+		return lib.logError("objectIdFromTime", err)
 	}
-	return err
+	// zero the remaining bytes so the result can bound range queries on _id
+	var oid primitive.ObjectID
+	binary.BigEndian.PutUint32(oid[0:4], uint32(t.Unix()))
+	return lib.toValue(oid.Hex())
 }
 
-func (ic *indexClient) saveTimestamp() error {
-	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("monstache")
-	doc := map[string]interface{}{
-		"ts": ic.lastTs,
+func (lib *jsLibrary) parseDate(call otto.FunctionCall) otto.Value {
+	layout := time.RFC3339Nano
+	if arg := call.Argument(1); arg.IsString() && arg.String() != "" {
+		layout = arg.String()
 	}
-	opts := options.Update()
-	opts.SetUpsert(true)
-	_, err := col.UpdateOne(context.Background(), bson.M{
-		"_id": ic.config.ResumeName,
-	}, bson.M{
-		"$set": doc,
-	}, opts)
-	return err
+	loc, err := lib.location(call.Argument(2))
+	if err != nil {
+		return lib.logError("parseDate", err)
+	}
+	t, err := time.ParseInLocation(layout, call.Argument(0).String(), loc)
+	if err != nil {
+		return lib.logError("parseDate", err)
+	}
+	date, err := lib.toDate(t)
+	if err != nil {
+		return lib.logError("parseDate", err)
+	}
+	return date
 }
 
-func (ic *indexClient) filterDirectReadNamespaces(wanted []string) (results []string, err error) {
-	results = make([]string, 0)
-	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("directreads")
-	filter := bson.M{
-		"_id": ic.config.ResumeName,
+func (lib *jsLibrary) formatDate(call otto.FunctionCall) otto.Value {
+	t, err := lib.fromDate(call.Argument(0))
+	if err != nil {
+		return lib.logError("formatDate", err)
 	}
-	result := col.FindOne(context.Background(), filter)
-	if err = result.Err(); err == nil {
-		var doc struct {
-			Ns []string `bson:"ns"`
-		}
-		if err = result.Decode(&doc); err == nil {
-			var ns, skipped []string
-			if len(doc.Ns) > 0 {
-				ns = doc.Ns
-			}
-			for _, name := range wanted {
-				markedDone := false
-				for _, n := range ns {
-					if name == n {
-						markedDone = true
-						break
+	layout := time.RFC3339Nano
+	if arg := call.Argument(1); arg.IsString() && arg.String() != "" {
+		layout = arg.String()
+	}
+	loc, err := lib.location(call.Argument(2))
+	if err != nil {
+		return lib.logError("formatDate", err)
+	}
+	return lib.toValue(t.In(loc).Format(layout))
+}
+
+func (lib *jsLibrary) log(logger *log.Logger) func(otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		msg := call.Argument(0).String()
+		if fields := call.Argument(1); fields.IsObject() {
+			if exported, err := fields.Export(); err == nil {
+				if m, ok := deepExportValue(exported).(map[string]interface{}); ok {
+					if b, err := json.Marshal(monstachemap.ConvertMapForJSON(m)); err == nil {
+						msg = msg + " " + string(b)
 					}
 				}
-				if !markedDone {
-					results = append(results, name)
-				} else {
-					skipped = append(skipped, name)
-				}
-			}
-			if len(skipped) > 0 {
-				infoLog.Printf("Skipping direct reads for namespaces marked complete: %+q", skipped)
 			}
 		}
-	} else if err == mongo.ErrNoDocuments {
-		err = nil
-		results = wanted
+		logger.Printf("[%s] %s", lib.ns, msg)
+		return otto.UndefinedValue()
 	}
-	return
 }
 
-func (ic *indexClient) saveDirectReadNamespaces() (err error) {
-	col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("directreads")
-	filter := bson.M{
-		"_id": ic.config.ResumeName,
+func (lib *jsLibrary) incCounter(call otto.FunctionCall) otto.Value {
+	name := call.Argument(0).String()
+	if !call.Argument(0).IsString() || name == "" {
+		return lib.logError("incCounter", errors.New("A counter name is required"))
 	}
-	ts := time.Now().UTC()
-	update := bson.M{
-		"$set":         bson.M{"updated": ts},
-		"$setOnInsert": bson.M{"created": ts},
-		"$addToSet":    bson.M{"ns": bson.M{"$each": ic.config.DirectReadNs}},
+	var delta int64 = 1
+	if arg := call.Argument(1); arg.IsNumber() {
+		var err error
+		if delta, err = arg.ToInteger(); err != nil {
+			return lib.logError("incCounter", err)
+		}
+	}
+	return lib.toValue(counters.add(name, delta))
+}
+
+// loadLibraryFunctions installs the builtins which do not require a
+// connection to MongoDB
+func loadLibraryFunctions(vm *otto.Otto, ns string) error {
+	lib := &jsLibrary{vm: vm, ns: ns}
+	if ns == "" {
+		lib.ns = "global"
+	}
+	funcs := map[string]func(otto.FunctionCall) otto.Value{
+		"sha1":             lib.hash("sha1", sha1.New),
+		"sha256":           lib.hash("sha256", sha256.New),
+		"hmac":             lib.hmac,
+		"uuid":             lib.uuid,
+		"binDataFromUUID":  lib.binDataFromUUID,
+		"newObjectId":      lib.newObjectID,
+		"objectIdTime":     lib.objectIDTime,
+		"objectIdFromTime": lib.objectIDFromTime,
+		"parseDate":        lib.parseDate,
+		"formatDate":       lib.formatDate,
+		"logInfo":          lib.log(infoLog),
+		"logWarn":          lib.log(warnLog),
+		"logError":         lib.log(errorLog),
+		"incCounter":       lib.incCounter,
+	}
+	for name, fn := range funcs {
+		if err := vm.Set(name, fn); err != nil {
+			return err
+		}
 	}
-	opts := options.Update().SetUpsert(true)
-	_, err = col.UpdateOne(context.Background(), filter, update, opts)
-	return
+	return nil
 }
 
-func (config *configOptions) parseCommandLineFlags() *configOptions {
-	flag.BoolVar(&config.Print, "print-config", false, "Print the configuration and then exit")
-	flag.BoolVar(&config.EnableTemplate, "tpl", false, "True to interpret the config file as a template")
-	flag.StringVar(&config.EnvDelimiter, "env-delimiter", ",", "A delimiter to use when splitting environment variable values")
-	flag.StringVar(&config.MongoURL, "mongo-url", "", "MongoDB server or router server connection URL")
-	flag.StringVar(&config.MongoConfigURL, "mongo-config-url", "", "MongoDB config server connection URL")
-	flag.StringVar(&config.MongoOpLogDatabaseName, "mongo-oplog-database-name", "", "Override the database name which contains the mongodb oplog")
-	flag.StringVar(&config.MongoOpLogCollectionName, "mongo-oplog-collection-name", "", "Override the collection name which contains the mongodb oplog")
-	flag.StringVar(&config.GraylogAddr, "graylog-addr", "", "Send logs to a Graylog server at this address")
-	flag.StringVar(&config.ElasticVersion, "elasticsearch-version", "", "Specify elasticsearch version directly instead of getting it from the server")
-	flag.StringVar(&config.ElasticAPIKey, "elasticsearch-api-key", "", "Base64 encoded elasticsearch APIKey value")
-	flag.StringVar(&config.ElasticUser, "elasticsearch-user", "", "The elasticsearch user name for basic auth")
-	flag.StringVar(&config.ElasticPassword, "elasticsearch-password", "", "The elasticsearch password for basic auth")
-	flag.StringVar(&config.ElasticPemFile, "elasticsearch-pem-file", "", "Path to a PEM file for secure connections to elasticsearch")
-	flag.BoolVar(&config.ElasticValidatePemFile, "elasticsearch-validate-pem-file", true, "Set to boolean false to not validate the Elasticsearch PEM file")
-	flag.IntVar(&config.ElasticMaxConns, "elasticsearch-max-conns", 0, "Elasticsearch max connections")
-	flag.IntVar(&config.PostProcessors, "post-processors", 0, "Number of post-processing go routines")
-	flag.IntVar(&config.FileDownloaders, "file-downloaders", 0, "GridFs download go routines")
-	flag.IntVar(&config.RelateThreads, "relate-threads", 0, "Number of threads dedicated to processing relationships")
-	flag.IntVar(&config.RelateBuffer, "relate-buffer", 0, "Number of relates to queue before skipping and reporting an error")
-	flag.BoolVar(&config.ElasticRetry, "elasticsearch-retry", false, "True to retry failed request to Elasticsearch")
-	flag.IntVar(&config.ElasticMaxDocs, "elasticsearch-max-docs", 0, "Number of docs to hold before flushing to Elasticsearch")
-	flag.IntVar(&config.ElasticMaxBytes, "elasticsearch-max-bytes", 0, "Number of bytes to hold before flushing to Elasticsearch")
-	flag.IntVar(&config.ElasticMaxSeconds, "elasticsearch-max-seconds", 0, "Number of seconds before flushing to Elasticsearch")
-	flag.IntVar(&config.ElasticClientTimeout, "elasticsearch-client-timeout", 0, "Number of seconds before a request to Elasticsearch is timed out")
-	flag.Int64Var(&config.MaxFileSize, "max-file-size", 0, "GridFs file content exceeding this limit in bytes will not be indexed in Elasticsearch")
-	flag.StringVar(&config.ConfigFile, "f", "", "Location of configuration file")
-	flag.BoolVar(&config.DroppedDatabases, "dropped-databases", true, "True to delete indexes from dropped databases")
-	flag.BoolVar(&config.DroppedCollections, "dropped-collections", true, "True to delete indexes from dropped collections")
-	flag.BoolVar(&config.Version, "v", false, "True to print the version number")
-	flag.BoolVar(&config.Gzip, "gzip", false, "True to enable gzip for requests to Elasticsearch")
-	flag.BoolVar(&config.Verbose, "verbose", false, "True to output verbose messages")
-	flag.BoolVar(&config.Pprof, "pprof", false, "True to enable pprof endpoints")
-	flag.BoolVar(&config.EnableOplog, "enable-oplog", false, "True to enable direct tailing of the oplog")
-	flag.BoolVar(&config.DisableChangeEvents, "disable-change-events", false, "True to disable listening for changes.  You must provide direct-reads in this case")
-	flag.BoolVar(&config.DisableDeleteProtection, "disable-delete-protection", false, "True to disable delete protection and allow multiple deletes in Elasticsearch per event in MongoDB")
-	flag.BoolVar(&config.EnableEasyJSON, "enable-easy-json", false, "True to enable easy-json serialization")
-	flag.BoolVar(&config.Stats, "stats", false, "True to print out statistics")
-	flag.BoolVar(&config.IndexStats, "index-stats", false, "True to index stats in elasticsearch")
-	flag.StringVar(&config.StatsDuration, "stats-duration", "", "The duration after which stats are logged")
-	flag.StringVar(&config.StatsIndexFormat, "stats-index-format", "", "time.Time supported format to use for the stats index names")
-	flag.BoolVar(&config.Resume, "resume", false, "True to capture the last timestamp of this run and resume on a subsequent run")
-	flag.Var(&config.ResumeStrategy, "resume-strategy", "Strategy to use for resuming. 0=timestamp,1=token")
-	flag.Int64Var(&config.ResumeFromTimestamp, "resume-from-timestamp", 0, "Timestamp to resume syncing from")
-	flag.BoolVar(&config.ResumeFromEarliestTimestamp, "resume-from-earliest-timestamp", false, "Automatically select an earliest timestamp to resume syncing from")
-	flag.BoolVar(&config.ResumeWriteUnsafe, "resume-write-unsafe", false, "True to speedup writes of the last timestamp synched for resuming at the cost of error checking")
-	flag.BoolVar(&config.Replay, "replay", false, "True to replay all events from the oplog and index them in elasticsearch")
-	flag.BoolVar(&config.IndexFiles, "index-files", false, "True to index gridfs files into elasticsearch. Requires the elasticsearch mapper-attachments (deprecated) or ingest-attachment plugin")
-	flag.BoolVar(&config.DisableFilePipelinePut, "disable-file-pipeline-put", false, "True to disable auto-creation of the ingest plugin pipeline")
-	flag.BoolVar(&config.IndexAsUpdate, "index-as-update", false, "True to index documents as updates instead of overwrites")
-	flag.BoolVar(&config.FileHighlighting, "file-highlighting", false, "True to enable the ability to highlight search times for a file query")
-	flag.BoolVar(&config.EnablePatches, "enable-patches", false, "True to include an json-patch field on updates")
-	flag.BoolVar(&config.FailFast, "fail-fast", false, "True to exit if a single _bulk request fails")
-	flag.BoolVar(&config.IndexOplogTime, "index-oplog-time", false, "True to add date/time information from the oplog to each document when indexing")
-	flag.BoolVar(&config.ExitAfterDirectReads, "exit-after-direct-reads", false, "True to exit the program after reading directly from the configured namespaces")
-	flag.StringVar(&config.MergePatchAttr, "merge-patch-attribute", "", "Attribute to store json-patch values under")
-	flag.StringVar(&config.ResumeName, "resume-name", "", "Name under which to load/store the resume state. Defaults to 'default'")
-	flag.StringVar(&config.ClusterName, "cluster-name", "", "Name of the monstache process cluster")
-	flag.StringVar(&config.Worker, "worker", "", "The name of this worker in a multi-worker configuration")
-	flag.StringVar(&config.MapperPluginPath, "mapper-plugin-path", "", "The path to a .so file to load as a document mapper plugin")
-	flag.StringVar(&config.DirectReadExcludeRegex, "direct-read-dynamic-exclude-regex", "", "A regex to use for excluding namespaces when using dynamic direct reads")
-	flag.StringVar(&config.DirectReadIncludeRegex, "direct-read-dynamic-include-regex", "", "A regex to use for including namespaces when using dynamic direct reads")
-	flag.StringVar(&config.NsRegex, "namespace-regex", "", "A regex which is matched against an operation's namespace (<database>.<collection>).  Only operations which match are synched to elasticsearch")
-	flag.StringVar(&config.NsDropRegex, "namespace-drop-regex", "", "A regex which is matched against a drop operation's namespace (<database>.<collection>).  Only drop operations which match are synched to elasticsearch")
-	flag.StringVar(&config.NsExcludeRegex, "namespace-exclude-regex", "", "A regex which is matched against an operation's namespace (<database>.<collection>).  Only operations which do not match are synched to elasticsearch")
-	flag.StringVar(&config.NsDropExcludeRegex, "namespace-drop-exclude-regex", "", "A regex which is matched against a drop operation's namespace (<database>.<collection>).  Only drop operations which do not match are synched to elasticsearch")
-	flag.Var(&config.ChangeStreamNs, "change-stream-namespace", "A list of change stream namespaces")
-	flag.Var(&config.DirectReadNs, "direct-read-namespace", "A list of direct read namespaces")
-	flag.IntVar(&config.DirectReadSplitMax, "direct-read-split-max", 0, "Max number of times to split a collection for direct reads")
-	flag.IntVar(&config.DirectReadConcur, "direct-read-concur", 0, "Max number of direct-read-namespaces to read concurrently. By default all givne are read concurrently")
-	flag.BoolVar(&config.DirectReadNoTimeout, "direct-read-no-timeout", false, "True to set the no cursor timeout flag for direct reads")
-	flag.BoolVar(&config.DirectReadBounded, "direct-read-bounded", false, "True to limit direct reads to the docs present at query start time")
-	flag.BoolVar(&config.DirectReadStateful, "direct-read-stateful", false, "True to mark direct read namespaces as complete and not sync them in future runs")
-	flag.Var(&config.RoutingNamespaces, "routing-namespace", "A list of namespaces that override routing information")
-	flag.Var(&config.TimeMachineNamespaces, "time-machine-namespace", "A list of direct read namespaces")
-	flag.StringVar(&config.TimeMachineIndexPrefix, "time-machine-index-prefix", "", "A prefix to preprend to time machine indexes")
-	flag.StringVar(&config.TimeMachineIndexSuffix, "time-machine-index-suffix", "", "A suffix to append to time machine indexes")
-	flag.BoolVar(&config.TimeMachineDirectReads, "time-machine-direct-reads", false, "True to index the results of direct reads into the any time machine indexes")
-	flag.BoolVar(&config.PipeAllowDisk, "pipe-allow-disk", false, "True to allow MongoDB to use the disk for pipeline options with lots of results")
-	flag.Var(&config.ElasticUrls, "elasticsearch-url", "A list of Elasticsearch URLs")
-	flag.Var(&config.FileNamespaces, "file-namespace", "A list of file namespaces")
-	flag.Var(&config.PatchNamespaces, "patch-namespace", "A list of patch namespaces")
-	flag.Var(&config.Workers, "workers", "A list of worker names")
-	flag.BoolVar(&config.EnableHTTPServer, "enable-http-server", false, "True to enable an internal http server")
-	flag.StringVar(&config.HTTPServerAddr, "http-server-addr", "", "The address the internal http server listens on")
-	flag.BoolVar(&config.PruneInvalidJSON, "prune-invalid-json", false, "True to omit values which do not serialize to JSON such as +Inf and -Inf and thus cause errors")
-	flag.Var(&config.DeleteStrategy, "delete-strategy", "Stategy to use for deletes. 0=stateless,1=stateful,2=ignore")
-	flag.StringVar(&config.DeleteIndexPattern, "delete-index-pattern", "", "An Elasticsearch index-pattern to restric the scope of stateless deletes")
-	flag.StringVar(&config.ConfigDatabaseName, "config-database-name", "", "The MongoDB database name that monstache uses to store metadata")
-	flag.StringVar(&config.OplogTsFieldName, "oplog-ts-field-name", "", "Field name to use for the oplog timestamp")
-	flag.StringVar(&config.OplogDateFieldName, "oplog-date-field-name", "", "Field name to use for the oplog date")
-	flag.StringVar(&config.OplogDateFieldFormat, "oplog-date-field-format", "", "Format to use for the oplog date")
-	flag.BoolVar(&config.Debug, "debug", false, "True to enable verbose debug information")
-	flag.Parse()
-	return config
+// jsModules resolves require calls within a single VM.  Modules are loaded
+// once per VM and cached by their resolved path
+type jsModules struct {
+	dir     string
+	vm      *otto.Otto
+	modules map[string]*otto.Object
 }
 
-func (config *configOptions) loadReplacements() {
-	if config.Relate != nil {
-		for _, r := range config.Relate {
-			if r.Namespace != "" || r.WithNamespace != "" {
-				dbCol := strings.SplitN(r.WithNamespace, ".", 2)
-				if len(dbCol) != 2 {
-					errorLog.Fatalf("Replacement namespace is invalid: %s", r.WithNamespace)
-				}
-				database, collection := dbCol[0], dbCol[1]
-				r := &relation{
-					Namespace:      r.Namespace,
-					WithNamespace:  r.WithNamespace,
-					SrcField:       r.SrcField,
-					MatchField:     r.MatchField,
-					KeepSrc:        r.KeepSrc,
-					DotNotation:    r.DotNotation,
-					MaxDepth:       r.MaxDepth,
-					MatchFieldType: r.MatchFieldType,
-					db:             database,
-					col:            collection,
-				}
-				if r.SrcField == "" {
-					r.SrcField = "_id"
-				}
-				if r.MatchField == "" {
-					r.MatchField = "_id"
-				}
-				relates[r.Namespace] = append(relates[r.Namespace], r)
-			} else {
-				errorLog.Fatalln("Relates must specify namespace and with-namespace")
-			}
+// resolve maps a module name to a file within the module directory.  Names
+// starting with ./ or ../ are relative to the directory of the requiring
+// module (base) while other names are relative to the module directory
+func (m *jsModules) resolve(base, name string) (string, error) {
+	if name == "" {
+		return "", errors.New("require must be called with a module path")
+	}
+	dir, err := filepath.Abs(m.dir)
+	if err != nil {
+		return "", err
+	}
+	from := dir
+	if base != "" && (strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../")) {
+		from = base
+	}
+	path := filepath.Join(from, filepath.FromSlash(name))
+	if path != dir && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("Module %s is outside of the script module directory %s", name, dir)
+	}
+	if filepath.Ext(path) == "" {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			path += ".js"
 		}
 	}
+	return path, nil
 }
 
-func (config *configOptions) loadIndexTypes() {
-	if config.Mapping != nil {
-		for _, m := range config.Mapping {
-			if m.Namespace != "" && m.Index != "" {
-				mapIndexTypes[m.Namespace] = &indexMapping{
-					Namespace: m.Namespace,
-					Index:     strings.ToLower(m.Index),
-				}
-			} else {
-				errorLog.Fatalln("Mappings must specify namespace and index")
-			}
-		}
+func (m *jsModules) load(path string) (*otto.Object, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	wrapper := "(function(module, exports, require) {\n" + string(src) + "\n})"
+	fn, err := m.vm.Run(wrapper)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load module %s: %s", path, err)
 	}
+	module, err := m.vm.Object("({exports: {}})")
+	if err != nil {
+		return nil, err
+	}
+	// register before running the module so that cyclic requires see the
+	// partially loaded exports instead of recursing
+	m.modules[path] = module
+	exports, _ := module.Get("exports")
+	require := m.requireFrom(filepath.Dir(path))
+	if _, err = fn.Call(otto.UndefinedValue(), module.Value(), exports, require); err != nil {
+		delete(m.modules, path)
+		return nil, fmt.Errorf("Unable to load module %s: %s", path, err)
+	}
+	return module, nil
 }
 
-func (config *configOptions) loadPipelines() {
-	for _, s := range config.Pipeline {
-		if s.Path == "" && s.Script == "" {
-			errorLog.Fatalln("Pipelines must specify path or script attributes")
+// require is the require function given to scripts.  Relative names are
+// resolved against the module directory
+func (m *jsModules) require(call otto.FunctionCall) otto.Value {
+	return m.requireFrom("")(call)
+}
+
+// requireFrom returns the require function given to a module loaded from
+// the directory base
+func (m *jsModules) requireFrom(base string) func(otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		var name string
+		if arg := call.Argument(0); arg.IsString() {
+			name = arg.String()
 		}
-		if s.Path != "" && s.Script != "" {
-			errorLog.Fatalln("Pipelines must specify path or script but not both")
+		path, err := m.resolve(base, name)
+		if err != nil {
+			panic(m.vm.MakeCustomError("Error", err.Error()))
 		}
-		if s.Path != "" {
-			if script, err := ioutil.ReadFile(s.Path); err == nil {
-				s.Script = string(script[:])
-			} else {
-				errorLog.Fatalf("Unable to load pipeline at path %s: %s", s.Path, err)
+		module := m.modules[path]
+		if module == nil {
+			if module, err = m.load(path); err != nil {
+				panic(m.vm.MakeCustomError("Error", err.Error()))
 			}
 		}
-		if _, exists := filterEnvs[s.Namespace]; exists {
-			errorLog.Fatalf("Multiple pipelines with namespace: %s", s.Namespace)
-		}
-		env := &executionEnv{
-			VM:     otto.New(),
-			Script: s.Script,
-			lock:   &sync.Mutex{},
-		}
-		if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
-			errorLog.Fatalln(err)
-		}
-		if err := env.VM.Set("stringFromBinData", jsStringFromBinData); err != nil {
-			errorLog.Fatalln(err)
-		}
-		if _, err := env.VM.Run(env.Script); err != nil {
-			errorLog.Fatalln(err)
-		}
-		val, err := env.VM.Run("module.exports")
-		if err != nil {
-			errorLog.Fatalln(err)
-		} else if !val.IsFunction() {
-			errorLog.Fatalln("module.exports must be a function")
-		}
-		pipeEnvs[s.Namespace] = env
+		exports, _ := module.Get("exports")
+		return exports
 	}
 }
 
-func (config *configOptions) loadFilters() {
-	for _, s := range config.Filter {
-		if s.Script != "" || s.Path != "" {
-			if s.Path != "" && s.Script != "" {
-				errorLog.Fatalln("Filters must specify path or script but not both")
-			}
-			if s.Path != "" {
-				if script, err := ioutil.ReadFile(s.Path); err == nil {
-					s.Script = string(script[:])
-				} else {
-					errorLog.Fatalf("Unable to load filter at path %s: %s", s.Path, err)
-				}
-			}
-			if _, exists := filterEnvs[s.Namespace]; exists {
-				errorLog.Fatalf("Multiple filters with namespace: %s", s.Namespace)
-			}
-			env := &executionEnv{
-				VM:     otto.New(),
-				Script: s.Script,
-				lock:   &sync.Mutex{},
-			}
-			if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
-				errorLog.Fatalln(err)
-			}
-			if err := env.VM.Set("stringFromBinData", jsStringFromBinData); err != nil {
-				errorLog.Fatalln(err)
-			}
-			if _, err := env.VM.Run(env.Script); err != nil {
-				errorLog.Fatalln(err)
-			}
-			val, err := env.VM.Run("module.exports")
-			if err != nil {
-				errorLog.Fatalln(err)
-			} else if !val.IsFunction() {
-				errorLog.Fatalln("module.exports must be a function")
+// setFindCache gives each lookup builtin its own cache.  Lookups are cached
+// by default when the script configures a cache-size and otherwise only
+// when a call passes the cache or cacheTTL options
+func (env *executionEnv) setFindCache(fa *findConf) {
+	size := env.cacheSize
+	if size == 0 {
+		size = lookupCacheSizeDefault
+	}
+	fa.cache = lru.New(size, env.cacheTTL)
+	fa.cacheEnabled = env.cacheSize > 0
+	fa.cacheTTL = env.cacheTTL
+}
+
+// call invokes module.exports with the first argument as this.  When a
+// timeout is configured the VM is interrupted once the timeout elapses
+func (env *executionEnv) call(args ...interface{}) (val otto.Value, err error) {
+	var this interface{}
+	if len(args) > 0 {
+		this = args[0]
+	}
+	if env.timeout <= 0 {
+		return env.VM.Call("module.exports", this, args...)
+	}
+	defer func() {
+		if caught := recover(); caught != nil {
+			if caught == errScriptTimeout {
+				err = fmt.Errorf("%s after %s", errScriptTimeout, env.timeout)
+				return
 			}
-			filterEnvs[s.Namespace] = env
-		} else {
-			errorLog.Fatalln("Filters must specify path or script attributes")
+			panic(caught)
 		}
-	}
+	}()
+	interrupt := make(chan func(), 1)
+	env.VM.Interrupt = interrupt
+	timer := time.AfterFunc(env.timeout, func() {
+		interrupt <- func() {
+			panic(errScriptTimeout)
+		}
+	})
+	defer timer.Stop()
+	return env.VM.Call("module.exports", this, args...)
 }
+
 func jsStringFromBinData(call otto.FunctionCall) otto.Value {
 	exported, err := call.Argument(0).Export()
 	if err != nil {
@@ -2020,11 +4043,7 @@ func (config *configOptions) loadScripts() {
 			if _, exists := mapEnvs[s.Namespace]; exists {
 				errorLog.Fatalf("Multiple scripts with namespace: %s", s.Namespace)
 			}
-			env := &executionEnv{
-				VM:     otto.New(),
-				Script: s.Script,
-				lock:   &sync.Mutex{},
-			}
+			env := s.newExecutionEnv(config.scriptModuleDir())
 			if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
 				errorLog.Fatalln(err)
 			}
@@ -2048,7 +4067,340 @@ func (config *configOptions) loadScripts() {
 	}
 }
 
+// stdioPlugin runs the plugin functions in an external process using the
+// protocol described in monstachemap/stdio.go.  Requests are sent one at a
+// time.  The process is killed if a request takes longer than the timeout
+// and is restarted on the next request if it exits.  A restarted process
+// receives the hello and init requests again before any other request.
+type stdioPlugin struct {
+	sync.Mutex
+	path        string
+	args        []string
+	timeout     time.Duration
+	cmd         *exec.Cmd
+	stdin       io.WriteCloser
+	writer      *bufio.Writer
+	reader      *bufio.Reader
+	nextID      int64
+	started     bool
+	initialized bool
+	settings    map[string]interface{}
+}
+
+func newStdioPlugin(path string, args []string, timeout time.Duration) *stdioPlugin {
+	return &stdioPlugin{path: path, args: args, timeout: timeout}
+}
+
+func (sp *stdioPlugin) start() (err error) {
+	cmd := exec.Command(sp.path, sp.args...)
+	cmd.Stderr = os.Stderr
+	if sp.stdin, err = cmd.StdinPipe(); err != nil {
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	sp.cmd = cmd
+	sp.writer = bufio.NewWriter(sp.stdin)
+	sp.reader = bufio.NewReader(stdout)
+	return
+}
+
+func (sp *stdioPlugin) kill() {
+	if sp.cmd != nil {
+		sp.cmd.Process.Kill()
+		sp.cmd.Wait()
+		sp.cmd = nil
+	}
+	sp.writer, sp.reader = nil, nil
+}
+
+func (sp *stdioPlugin) call(method string, input *monstachemap.StdioInput) (*monstachemap.StdioOutput, error) {
+	sp.Lock()
+	defer sp.Unlock()
+	if sp.writer == nil {
+		if err := sp.start(); err != nil {
+			return nil, fmt.Errorf("Unable to start mapper plugin %s: %s", sp.path, err)
+		}
+		if sp.started {
+			if err := sp.handshake(method); err != nil {
+				sp.kill()
+				return nil, fmt.Errorf("Unable to restart mapper plugin %s: %s", sp.path, err)
+			}
+		}
+	}
+	sp.started = true
+	out, err := sp.request(method, input)
+	if err == nil && method == monstachemap.StdioInit && input != nil {
+		sp.initialized = true
+		sp.settings = input.Settings
+	}
+	return out, err
+}
+
+// handshake repeats the hello and init requests for a restarted process so
+// that it is initialized with the plugin settings like the first process
+func (sp *stdioPlugin) handshake(method string) error {
+	if method == monstachemap.StdioHello {
+		return nil
+	}
+	if _, err := sp.request(monstachemap.StdioHello, nil); err != nil {
+		return err
+	}
+	if sp.initialized && method != monstachemap.StdioInit {
+		if _, err := sp.request(monstachemap.StdioInit, &monstachemap.StdioInput{Settings: sp.settings}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// request sends a single request to a running process and waits for the
+// response
+func (sp *stdioPlugin) request(method string, input *monstachemap.StdioInput) (*monstachemap.StdioOutput, error) {
+	sp.nextID++
+	req := &monstachemap.StdioMessage{
+		ID:     sp.nextID,
+		Method: method,
+		Input:  input,
+	}
+	resp, err := sp.exchange(req)
+	if err != nil {
+		sp.kill()
+		return nil, err
+	}
+	if resp.ID != req.ID {
+		sp.kill()
+		return nil, fmt.Errorf("Mapper plugin response id %d does not match request id %d", resp.ID, req.ID)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	if resp.Output == nil {
+		return &monstachemap.StdioOutput{}, nil
+	}
+	return resp.Output, nil
+}
+
+// exchange sends a request and reads its response.  With a timeout the
+// exchange runs in its own goroutine and the process is killed if it does not
+// answer in time, which unblocks the pending read or write
+func (sp *stdioPlugin) exchange(req *monstachemap.StdioMessage) (*monstachemap.StdioMessage, error) {
+	writer, reader := sp.writer, sp.reader
+	roundTrip := func() (*monstachemap.StdioMessage, error) {
+		err := monstachemap.WriteStdioMessage(writer, req)
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to send %s request to mapper plugin: %s", req.Method, err)
+		}
+		resp, err := monstachemap.ReadStdioMessage(reader)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read %s response from mapper plugin: %s", req.Method, err)
+		}
+		return resp, nil
+	}
+	if sp.timeout == 0 {
+		return roundTrip()
+	}
+	type result struct {
+		resp *monstachemap.StdioMessage
+		err  error
+	}
+	resultC := make(chan result, 1)
+	go func() {
+		resp, err := roundTrip()
+		resultC <- result{resp, err}
+	}()
+	timer := time.NewTimer(sp.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-resultC:
+		return r.resp, r.err
+	case <-timer.C:
+		sp.kill()
+		<-resultC
+		return nil, fmt.Errorf("Mapper plugin did not answer %s request within %s", req.Method, sp.timeout)
+	}
+}
+
+// stop closes the plugin stdin and gives the process a few seconds to exit
+func (sp *stdioPlugin) stop() {
+	sp.Lock()
+	defer sp.Unlock()
+	if sp.cmd == nil {
+		return
+	}
+	sp.writer, sp.reader = nil, nil
+	sp.stdin.Close()
+	doneC := make(chan error, 1)
+	go func(cmd *exec.Cmd) {
+		doneC <- cmd.Wait()
+	}(sp.cmd)
+	select {
+	case <-doneC:
+	case <-time.After(5 * time.Second):
+		sp.cmd.Process.Kill()
+		<-doneC
+	}
+	sp.cmd = nil
+}
+
+func newStdioInput(input *monstachemap.MapperPluginInput) *monstachemap.StdioInput {
+	return &monstachemap.StdioInput{
+		Document:          input.Document,
+		Database:          input.Database,
+		Collection:        input.Collection,
+		Namespace:         input.Namespace,
+		Operation:         input.Operation,
+		UpdateDescription: input.UpdateDescription,
+	}
+}
+
+func addBulkRequests(bulk *elastic.BulkProcessor, reqs []*monstachemap.BulkRequest) error {
+	for _, r := range reqs {
+		if r.Index == "" || r.ID == "" {
+			return errors.New("Bulk requests from the mapper plugin must include an index and id")
+		}
+		switch r.Action {
+		case "index":
+			req := elastic.NewBulkIndexRequest().Index(r.Index).Id(r.ID).Doc(r.Document)
+			if r.Routing != "" {
+				req.Routing(r.Routing)
+			}
+			if r.Pipeline != "" {
+				req.Pipeline(r.Pipeline)
+			}
+			bulk.Add(req)
+		case "update":
+			req := elastic.NewBulkUpdateRequest().Index(r.Index).Id(r.ID).Doc(r.Document)
+			if r.Routing != "" {
+				req.Routing(r.Routing)
+			}
+			bulk.Add(req)
+		case "delete":
+			req := elastic.NewBulkDeleteRequest().Index(r.Index).Id(r.ID)
+			if r.Routing != "" {
+				req.Routing(r.Routing)
+			}
+			bulk.Add(req)
+		default:
+			return fmt.Errorf("Unknown bulk request action %q from the mapper plugin", r.Action)
+		}
+	}
+	return nil
+}
+
+func (config *configOptions) loadStdioPlugin() {
+	var timeout time.Duration
+	if config.MapperPluginTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(config.MapperPluginTimeout); err != nil {
+			errorLog.Fatalf("Unable to parse mapper-plugin-timeout: %s", err)
+		}
+	}
+	sp := newStdioPlugin(config.MapperPluginCommand, config.MapperPluginArgs, timeout)
+	hello, err := sp.call(monstachemap.StdioHello, nil)
+	if err != nil {
+		errorLog.Fatalf("Unable to load mapper plugin %s: %s", config.MapperPluginCommand, err)
+	}
+	stdioPluginProcess = sp
+	for _, method := range hello.Methods {
+		switch method {
+		case monstachemap.StdioInit:
+			initPlugin = func(settings map[string]interface{}) error {
+				_, err := sp.call(monstachemap.StdioInit, &monstachemap.StdioInput{Settings: settings})
+				return err
+			}
+		case monstachemap.StdioClose:
+			closePlugin = func() error {
+				_, err := sp.call(monstachemap.StdioClose, nil)
+				return err
+			}
+		case monstachemap.StdioMap:
+			mapperPlugin = func(input *monstachemap.MapperPluginInput) (*monstachemap.MapperPluginOutput, error) {
+				out, err := sp.call(monstachemap.StdioMap, newStdioInput(input))
+				if err != nil {
+					return nil, err
+				}
+				return out.Map.MapperPluginOutput(), nil
+			}
+		case monstachemap.StdioFilter:
+			filterPlugin = func(input *monstachemap.MapperPluginInput) (bool, error) {
+				out, err := sp.call(monstachemap.StdioFilter, newStdioInput(input))
+				if err != nil {
+					return false, err
+				}
+				return out.Filter, nil
+			}
+		case monstachemap.StdioDelete:
+			deletePlugin = func(input *monstachemap.MapperPluginInput) (*monstachemap.DeletePluginOutput, error) {
+				out, err := sp.call(monstachemap.StdioDelete, newStdioInput(input))
+				if err != nil {
+					return nil, err
+				}
+				return out.Delete, nil
+			}
+		case monstachemap.StdioProcess:
+			processPlugin = func(input *monstachemap.ProcessPluginInput) error {
+				in := newStdioInput(&input.MapperPluginInput)
+				in.Timestamp = input.Timestamp
+				out, err := sp.call(monstachemap.StdioProcess, in)
+				if err != nil {
+					return err
+				}
+				return addBulkRequests(input.ElasticBulkProcessor, out.Requests)
+			}
+		case monstachemap.StdioProcessBatch:
+			processBatchPlugin = func(inputs []*monstachemap.ProcessPluginInput) error {
+				if len(inputs) == 0 {
+					return nil
+				}
+				in := &monstachemap.StdioInput{}
+				for _, input := range inputs {
+					item := newStdioInput(&input.MapperPluginInput)
+					item.Timestamp = input.Timestamp
+					in.Inputs = append(in.Inputs, item)
+				}
+				out, err := sp.call(monstachemap.StdioProcessBatch, in)
+				if err != nil {
+					return err
+				}
+				return addBulkRequests(inputs[0].ElasticBulkProcessor, out.Requests)
+			}
+		case monstachemap.StdioPipeline:
+			pipePlugin = func(ns string, changeEvent bool) ([]interface{}, error) {
+				in := &monstachemap.StdioInput{
+					Namespace:   ns,
+					ChangeEvent: changeEvent,
+				}
+				out, err := sp.call(monstachemap.StdioPipeline, in)
+				if err != nil {
+					return nil, err
+				}
+				return out.Pipeline, nil
+			}
+		default:
+			warnLog.Printf("Ignoring unknown method %q advertised by mapper plugin", method)
+		}
+	}
+	if mapperPlugin == nil && filterPlugin == nil && deletePlugin == nil && !hasProcessPlugin() && pipePlugin == nil {
+		warnLog.Println("Plugin started but did not advertise a map, filter, delete, process or pipeline method")
+	}
+}
+
 func (config *configOptions) loadPlugins() *configOptions {
+	if config.MapperPluginPath != "" && config.MapperPluginCommand != "" {
+		errorLog.Fatalln("Only one of mapper-plugin-path and mapper-plugin-command may be configured")
+	}
+	if config.MapperPluginCommand != "" {
+		config.loadStdioPlugin()
+	}
 	if config.MapperPluginPath != "" {
 		funcDefined := false
 		p, err := plugin.Open(config.MapperPluginPath)
@@ -2076,6 +4428,15 @@ func (config *configOptions) loadPlugins() *configOptions {
 			}
 
 		}
+		del, err := p.Lookup("Delete")
+		if err == nil {
+			switch del.(type) {
+			case func(*monstachemap.MapperPluginInput) (*monstachemap.DeletePluginOutput, error):
+				deletePlugin = del.(func(*monstachemap.MapperPluginInput) (*monstachemap.DeletePluginOutput, error))
+			default:
+				errorLog.Fatalf("Plugin 'Delete' function must be typed %T", deletePlugin)
+			}
+		}
 		process, err := p.Lookup("Process")
 		if err == nil {
 			funcDefined = true
@@ -2086,6 +4447,16 @@ func (config *configOptions) loadPlugins() *configOptions {
 				errorLog.Fatalf("Plugin 'Process' function must be typed %T", processPlugin)
 			}
 		}
+		processBatch, err := p.Lookup("ProcessBatch")
+		if err == nil {
+			funcDefined = true
+			switch processBatch.(type) {
+			case func([]*monstachemap.ProcessPluginInput) error:
+				processBatchPlugin = processBatch.(func([]*monstachemap.ProcessPluginInput) error)
+			default:
+				errorLog.Fatalf("Plugin 'ProcessBatch' function must be typed %T", processBatchPlugin)
+			}
+		}
 		pipe, err := p.Lookup("Pipeline")
 		if err == nil {
 			funcDefined = true
@@ -2096,13 +4467,65 @@ func (config *configOptions) loadPlugins() *configOptions {
 				errorLog.Fatalf("Plugin 'Pipeline' function must be typed %T", pipePlugin)
 			}
 		}
+		if init, err := p.Lookup("Init"); err == nil {
+			switch init.(type) {
+			case func(map[string]interface{}) error:
+				initPlugin = init.(func(map[string]interface{}) error)
+			default:
+				errorLog.Fatalf("Plugin 'Init' function must be typed %T", initPlugin)
+			}
+		}
+		if cl, err := p.Lookup("Close"); err == nil {
+			switch cl.(type) {
+			case func() error:
+				closePlugin = cl.(func() error)
+			default:
+				errorLog.Fatalf("Plugin 'Close' function must be typed %T", closePlugin)
+			}
+		}
 		if !funcDefined {
-			warnLog.Println("Plugin loaded but did not find a Map, Filter, Process or Pipeline function")
+			warnLog.Println("Plugin loaded but did not find a Map, Filter, Process, ProcessBatch or Pipeline function")
+		}
+	}
+	if processPlugin != nil && processBatchPlugin != nil {
+		errorLog.Fatalln("Plugin must not define both a Process and a ProcessBatch function")
+	}
+	if initPlugin != nil {
+		if err := initPlugin(config.MapperPluginSettings); err != nil {
+			errorLog.Fatalf("Unable to initialize mapper plugin: %s", err)
 		}
 	}
 	return config
 }
 
+// closePlugins cancels the plugin context and lets the plugin release its
+// resources
+func closePlugins() {
+	cancelPluginCtx()
+	if closePlugin != nil {
+		if err := closePlugin(); err != nil {
+			errorLog.Printf("Error closing mapper plugin: %s", err)
+		}
+	}
+	if stdioPluginProcess != nil {
+		stdioPluginProcess.stop()
+	}
+}
+
+type pluginLogger struct{}
+
+func (pluginLogger) Infof(format string, v ...interface{}) {
+	infoLog.Printf("Plugin: "+format, v...)
+}
+
+func (pluginLogger) Warnf(format string, v ...interface{}) {
+	warnLog.Printf("Plugin: "+format, v...)
+}
+
+func (pluginLogger) Errorf(format string, v ...interface{}) {
+	errorLog.Printf("Plugin: "+format, v...)
+}
+
 func (config *configOptions) decodeAsTemplate() *configOptions {
 	env := map[string]string{}
 	for _, e := range os.Environ() {
@@ -2240,12 +4663,33 @@ func (config *configOptions) loadConfigFile() *configOptions {
 		if config.PostProcessors == 0 {
 			config.PostProcessors = tomlConfig.PostProcessors
 		}
+		if config.ProcessBatchSize == 0 {
+			config.ProcessBatchSize = tomlConfig.ProcessBatchSize
+		}
+		if config.ProcessBatchSeconds == 0 {
+			config.ProcessBatchSeconds = tomlConfig.ProcessBatchSeconds
+		}
+		if config.DeleteBatchSize == 0 {
+			config.DeleteBatchSize = tomlConfig.DeleteBatchSize
+		}
+		if config.DeleteBatchMillis == 0 {
+			config.DeleteBatchMillis = tomlConfig.DeleteBatchMillis
+		}
 		if config.DeleteStrategy == 0 {
 			config.DeleteStrategy = tomlConfig.DeleteStrategy
 		}
+		if config.RenameStrategy == 0 {
+			config.RenameStrategy = tomlConfig.RenameStrategy
+		}
 		if config.DeleteIndexPattern == "" {
 			config.DeleteIndexPattern = tomlConfig.DeleteIndexPattern
 		}
+		if config.DeleteMetaStore == "" {
+			config.DeleteMetaStore = tomlConfig.DeleteMetaStore
+		}
+		if config.DeleteMetaIndex == "" {
+			config.DeleteMetaIndex = tomlConfig.DeleteMetaIndex
+		}
 		if config.DroppedDatabases && !tomlConfig.DroppedDatabases {
 			config.DroppedDatabases = false
 		}
@@ -2288,6 +4732,12 @@ func (config *configOptions) loadConfigFile() *configOptions {
 		if !config.IndexAsUpdate && tomlConfig.IndexAsUpdate {
 			config.IndexAsUpdate = true
 		}
+		if !config.IndexPartialUpdates && tomlConfig.IndexPartialUpdates {
+			config.IndexPartialUpdates = true
+		}
+		if !config.ExpandedEvents && tomlConfig.ExpandedEvents {
+			config.ExpandedEvents = true
+		}
 		if !config.FileHighlighting && tomlConfig.FileHighlighting {
 			config.FileHighlighting = true
 		}
@@ -2381,6 +4831,21 @@ func (config *configOptions) loadConfigFile() *configOptions {
 		if config.MapperPluginPath == "" {
 			config.MapperPluginPath = tomlConfig.MapperPluginPath
 		}
+		if config.MapperPluginCommand == "" {
+			config.MapperPluginCommand = tomlConfig.MapperPluginCommand
+		}
+		if len(config.MapperPluginArgs) == 0 {
+			config.MapperPluginArgs = tomlConfig.MapperPluginArgs
+		}
+		if config.MapperPluginTimeout == "" {
+			config.MapperPluginTimeout = tomlConfig.MapperPluginTimeout
+		}
+		if config.MapperPluginSettings == nil {
+			config.MapperPluginSettings = tomlConfig.MapperPluginSettings
+		}
+		if config.ScriptModuleDir == "" {
+			config.ScriptModuleDir = tomlConfig.ScriptModuleDir
+		}
 		if config.EnablePatches {
 			if len(config.PatchNamespaces) == 0 {
 				config.PatchNamespaces = tomlConfig.PatchNamespaces
@@ -2437,10 +4902,18 @@ func (config *configOptions) loadConfigFile() *configOptions {
 		config.GtmSettings = tomlConfig.GtmSettings
 		config.Relate = tomlConfig.Relate
 		config.LogRotate = tomlConfig.LogRotate
+		config.Tombstone = tomlConfig.Tombstone
+		config.DropArchive = tomlConfig.DropArchive
 		tomlConfig.loadScripts()
 		tomlConfig.loadFilters()
+		tomlConfig.loadDeleteScripts()
+		tomlConfig.loadDDLScripts()
+		tomlConfig.loadCreateIndexes()
 		tomlConfig.loadPipelines()
 		tomlConfig.loadIndexTypes()
+		tomlConfig.loadAggregations()
+		tomlConfig.loadOperationPolicies()
+		tomlConfig.loadSoftDeletes()
 		tomlConfig.loadReplacements()
 	}
 	return config
@@ -2799,6 +5272,34 @@ func (config *configOptions) validate() {
 			errorLog.Fatalf("Unable to parse stats duration: %s", err)
 		}
 	}
+	if config.IndexPartialUpdates && !config.IndexAsUpdate {
+		errorLog.Fatalln("Partial updates require index-as-update to be enabled")
+	}
+	switch config.DropArchive.Mode {
+	case "", dropArchiveClose, dropArchiveClone:
+	default:
+		errorLog.Fatalf("Invalid drop-archive mode %s. Must be %s or %s",
+			config.DropArchive.Mode, dropArchiveClose, dropArchiveClone)
+	}
+	if config.DropArchive.Retention != "" {
+		retention, err := time.ParseDuration(config.DropArchive.Retention)
+		if err != nil {
+			errorLog.Fatalf("Unable to parse drop-archive retention: %s", err)
+		}
+		config.DropArchive.retention = retention
+	}
+	switch config.DeleteMetaStore {
+	case "", deleteMetaStoreMongo, deleteMetaStoreElastic:
+	default:
+		errorLog.Fatalf("Invalid delete-meta-store %s. Must be %s or %s",
+			config.DeleteMetaStore, deleteMetaStoreMongo, deleteMetaStoreElastic)
+	}
+	switch config.RenameStrategy {
+	case ignoreRenameStrategy, reindexRenameStrategy, aliasRenameStrategy:
+	default:
+		errorLog.Fatalf("Invalid rename-strategy %d. Must be %d, %d or %d", config.RenameStrategy,
+			ignoreRenameStrategy, reindexRenameStrategy, aliasRenameStrategy)
+	}
 }
 
 func (config *configOptions) setDefaults() *configOptions {
@@ -2867,6 +5368,12 @@ func (config *configOptions) setDefaults() *configOptions {
 	if config.DeleteIndexPattern == "" {
 		config.DeleteIndexPattern = "*"
 	}
+	if config.DeleteMetaStore == "" {
+		config.DeleteMetaStore = deleteMetaStoreMongo
+	}
+	if config.DeleteMetaIndex == "" {
+		config.DeleteMetaIndex = "monstache-meta"
+	}
 	if config.FileDownloaders == 0 && config.IndexFiles {
 		config.FileDownloaders = fileDownloadersDefault
 	}
@@ -2876,9 +5383,32 @@ func (config *configOptions) setDefaults() *configOptions {
 	if config.RelateBuffer == 0 {
 		config.RelateBuffer = relateBufferDefault
 	}
-	if config.PostProcessors == 0 && processPlugin != nil {
+	if config.PostProcessors == 0 && hasProcessPlugin() {
 		config.PostProcessors = postProcessorsDefault
 	}
+	if config.ProcessBatchSize == 0 {
+		config.ProcessBatchSize = processBatchSizeDefault
+	}
+	if config.ProcessBatchSeconds == 0 {
+		config.ProcessBatchSeconds = processBatchSecondsDefault
+	}
+	if config.DeleteBatchSize == 0 {
+		config.DeleteBatchSize = deleteBatchSizeDefault
+	} else if config.DeleteBatchSize > deleteBatchSizeMax {
+		config.DeleteBatchSize = deleteBatchSizeMax
+	}
+	if config.DeleteBatchMillis == 0 {
+		config.DeleteBatchMillis = deleteBatchMillisDefault
+	}
+	if config.Tombstone.DeletedField == "" {
+		config.Tombstone.DeletedField = "_deleted"
+	}
+	if config.Tombstone.DeletedAtField == "" {
+		config.Tombstone.DeletedAtField = "_deletedAt"
+	}
+	if config.DropArchive.Suffix == "" {
+		config.DropArchive.Suffix = "20060102150405"
+	}
 	if config.OplogTsFieldName == "" {
 		config.OplogTsFieldName = "oplog_ts"
 	}
@@ -3055,19 +5585,41 @@ func elasticAPIKeyRoundTripper(apiKey string, wrapped http.RoundTripper) http.Ro
 
 func (ic *indexClient) doDrop(op *gtm.Op) (err error) {
 	if db, drop := op.IsDropDatabase(); drop {
+		if !allowsDropDatabase(db) {
+			infoLog.Printf("Ignoring drop of database %s excluded by operation policy", db)
+			return
+		}
+		if e := ic.dropScriptUpdates("db", db); e != nil {
+			errorLog.Printf("Unable to delete script updates for db: %s", e)
+		}
 		if ic.config.DroppedDatabases {
 			if err = ic.deleteIndexes(db); err == nil {
 				if e := ic.dropDBMeta(db); e != nil {
 					errorLog.Printf("Unable to delete metadata for db: %s", e)
 				}
+				if e := ic.dropDerived(op, bson.M{"db": db}); e != nil {
+					errorLog.Printf("Unable to delete derived documents for db: %s", e)
+				}
 			}
 		}
+	} else if from, to, rename := renameOf(op); rename {
+		err = ic.doRename(from, to)
 	} else if col, drop := op.IsDropCollection(); drop {
+		if !allowsOperation(op.GetDatabase()+"."+col, "drop") {
+			infoLog.Printf("Ignoring drop of collection %s excluded by operation policy", op.GetDatabase()+"."+col)
+			return
+		}
+		if e := ic.dropScriptUpdates("namespace", op.GetDatabase()+"."+col); e != nil {
+			errorLog.Printf("Unable to delete script updates for collection: %s", e)
+		}
 		if ic.config.DroppedCollections {
 			if err = ic.deleteIndex(op.GetDatabase() + "." + col); err == nil {
 				if e := ic.dropCollectionMeta(op.GetDatabase() + "." + col); e != nil {
 					errorLog.Printf("Unable to delete metadata for collection: %s", e)
 				}
+				if e := ic.dropDerived(op, bson.M{"namespace": op.GetDatabase() + "." + col}); e != nil {
+					errorLog.Printf("Unable to delete derived documents for collection: %s", e)
+				}
 			}
 		}
 	}
@@ -3160,8 +5712,13 @@ func (ic *indexClient) addPatch(op *gtm.Op, objectID string,
 func (ic *indexClient) doIndexing(op *gtm.Op) (err error) {
 	meta := parseIndexMeta(op)
 	if meta.Skip {
+		if len(meta.Documents) > 0 {
+			err = ic.indexDerived(op, meta)
+		}
 		return
 	}
+	// only documents which survived filtering and mapping run script updates
+	ic.runScriptUpdates(op)
 	ic.prepareDataForIndexing(op)
 	objectID, indexType := opIDToString(op), ic.mapIndex(op)
 	if objectID == "" {
@@ -3169,6 +5726,9 @@ func (ic *indexClient) doIndexing(op *gtm.Op) (err error) {
 	} else if len(objectID) > 512 {
 		return fmt.Errorf("Unable to index document with _id %s: _id length exceeds max of 512 bytes", objectID)
 	}
+	if indexType.template != nil && meta.Index == "" {
+		ic.routeTemplateIndex(op, objectID, indexType, meta)
+	}
 	if ic.config.EnablePatches {
 		if patchNamespaces[op.Namespace] {
 			if e := ic.addPatch(op, objectID, indexType, meta); e != nil {
@@ -3185,8 +5745,22 @@ func (ic *indexClient) doIndexing(op *gtm.Op) (err error) {
 		req.UseEasyJSON(ic.config.EnableEasyJSON)
 		req.Id(objectID)
 		req.Index(indexType.Index)
-		req.Doc(op.Data)
-		req.DocAsUpsert(true)
+		if partial, removed, ok := ic.partialUpdate(op); ok {
+			if len(removed) > 0 {
+				script := elastic.NewScript(partialUpdateScript).Params(map[string]interface{}{
+					"doc":     partial,
+					"removed": removed,
+				})
+				req.Script(script)
+			} else {
+				req.Doc(partial)
+			}
+			// index the full document if it is missing
+			req.Upsert(op.Data)
+		} else {
+			req.Doc(op.Data)
+			req.DocAsUpsert(true)
+		}
 		if meta.ID != "" {
 			req.Id(meta.ID)
 		}
@@ -3244,20 +5818,19 @@ func (ic *indexClient) doIndexing(op *gtm.Op) (err error) {
 		}
 	}
 
-	if meta.shouldSave(ic.config) {
+	if meta.shouldSave(ic.config) || ic.savesTemplateMeta(indexType) {
 		if e := ic.setIndexMeta(op.Namespace, objectID, meta); e != nil {
 			errorLog.Printf("Unable to save routing info: %s", e)
 		}
 	}
 
+	if e := ic.indexDerived(op, meta); e != nil {
+		errorLog.Printf("Unable to index derived documents of %s: %s", objectID, e)
+	}
+
 	if tmNamespaces[op.Namespace] {
 		if op.IsSourceOplog() || ic.config.TimeMachineDirectReads {
-			t := time.Now().UTC()
-			tmIndex := func(idx string) string {
-				pre, suf := ic.config.TimeMachineIndexPrefix, ic.config.TimeMachineIndexSuffix
-				tmFormat := strings.Join([]string{pre, idx, t.Format(suf)}, ".")
-				return strings.ToLower(tmFormat)
-			}
+			tmIndex := ic.timeMachineIndex
 			data := make(map[string]interface{})
 			for k, v := range op.Data {
 				data[k] = v
@@ -3292,7 +5865,604 @@ func (ic *indexClient) doIndexing(op *gtm.Op) (err error) {
 	return
 }
 
+func (ic *indexClient) timeMachineIndex(idx string) string {
+	t := time.Now().UTC()
+	pre, suf := ic.config.TimeMachineIndexPrefix, ic.config.TimeMachineIndexSuffix
+	tmFormat := strings.Join([]string{pre, idx, t.Format(suf)}, ".")
+	return strings.ToLower(tmFormat)
+}
+
+// routeTemplateIndex sets the index resolved from a mapping index template.
+// The index is saved with the document metadata under every delete strategy
+// so that updates and deletes can find the document.  If the document moved
+// to another index the old copy is deleted.
+// If the document no longer has the time field the saved index is kept.
+func (ic *indexClient) routeTemplateIndex(op *gtm.Op, objectID string, indexType *indexMapping, meta *indexingMeta) {
+	meta.Index = indexType.Index
+	if !ic.savesTemplateMeta(indexType) || (op.IsInsert() && op.IsSourceOplog()) {
+		return
+	}
+	prev, found := ic.readIndexMeta(op.Namespace, objectID)
+	if !found || prev.Index == "" {
+		return
+	}
+	if !indexType.fromDocument {
+		meta.Index = prev.Index
+	} else if prev.Index != meta.Index {
+		req := elastic.NewBulkDeleteRequest()
+		req.UseEasyJSON(ic.config.EnableEasyJSON)
+		req.Index(prev.Index)
+		req.Id(objectID)
+		if prev.Routing != "" {
+			req.Routing(prev.Routing)
+		}
+		if !ic.config.IndexAsUpdate {
+			req.Version(tsVersion(op))
+			req.VersionType("external")
+		}
+		ic.bulk.Add(req)
+	}
+}
+
+// indexDerived indexes the additional documents returned by a mapping and
+// deletes those that the mapping no longer returns for the document
+func (ic *indexClient) indexDerived(op *gtm.Op, meta *indexingMeta) error {
+	objectID := opIDToString(op)
+	if len(meta.Documents) == 0 && !ic.hasDerived(op.Namespace) {
+		return nil
+	}
+	if objectID == "" {
+		return errors.New("Unable to index derived documents due to empty _id value")
+	}
+	indexType := ic.mapIndex(op)
+	refs := make([]derivedRef, 0, len(meta.Documents))
+	for _, d := range meta.Documents {
+		ref := derivedRef{
+			Index:   strings.ToLower(d.Index),
+			ID:      d.ID,
+			Routing: d.Routing,
+		}
+		if ref.Index == "" {
+			ref.Index = indexType.Index
+		}
+		doc := d.Document
+		if doc == nil {
+			doc = make(map[string]interface{})
+		}
+		delete(doc, "_id")
+		delete(doc, "_meta_monstache")
+		if ic.config.PruneInvalidJSON {
+			doc = fixPruneInvalidJSON(d.ID, doc)
+		}
+		req := elastic.NewBulkIndexRequest()
+		req.UseEasyJSON(ic.config.EnableEasyJSON)
+		req.Index(ref.Index)
+		req.Id(ref.ID)
+		req.Doc(monstachemap.ConvertMapForJSON(doc))
+		if ref.Routing != "" {
+			req.Routing(ref.Routing)
+		}
+		if d.Pipeline != "" {
+			req.Pipeline(d.Pipeline)
+		}
+		if !ic.config.IndexAsUpdate && meta.Version != 0 {
+			req.Version(meta.Version)
+			req.VersionType(meta.VersionType)
+		}
+		if _, err := req.Source(); err != nil {
+			return err
+		}
+		ic.bulk.Add(req)
+		refs = append(refs, ref)
+	}
+	return ic.trackDerived(op, objectID, refs)
+}
+
+// partialUpdateScript merges the changed fields into the indexed document
+// and removes the unset fields
+const partialUpdateScript = `void merge(Map dst, Map src) {
+  for (e in src.entrySet()) {
+    def cur = dst.get(e.getKey());
+    if (cur instanceof Map && e.getValue() instanceof Map) {
+      merge(cur, e.getValue());
+    } else {
+      dst.put(e.getKey(), e.getValue());
+    }
+  }
+}
+merge(ctx._source, params.doc);
+for (String path : params.removed) {
+  String[] parts = path.splitOnToken('.');
+  def o = ctx._source;
+  for (int i = 0; i < parts.length - 1 && o instanceof Map; i++) {
+    o = o.get(parts[i]);
+  }
+  if (o instanceof Map) {
+    o.remove(parts[parts.length - 1]);
+  }
+}`
+
+func toStringSlice(v interface{}) (s []string) {
+	switch vs := v.(type) {
+	case []string:
+		s = vs
+	case []interface{}:
+		for _, e := range vs {
+			s = append(s, fmt.Sprintf("%v", e))
+		}
+	case primitive.A:
+		for _, e := range vs {
+			s = append(s, fmt.Sprintf("%v", e))
+		}
+	}
+	return
+}
+
+func toMap(v interface{}) map[string]interface{} {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m
+	case primitive.M:
+		return m
+	case primitive.D:
+		return m.Map()
+	}
+	return nil
+}
+
+func setPath(doc map[string]interface{}, path string, value interface{}) {
+	fields := strings.Split(path, ".")
+	cur := doc
+	for _, field := range fields[:len(fields)-1] {
+		next, ok := cur[field].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			cur[field] = next
+		}
+		cur = next
+	}
+	cur[fields[len(fields)-1]] = value
+}
+
+// arrayPathPrefix returns the part of a path before the first array index
+func arrayPathPrefix(path string) (prefix string, ok bool) {
+	fields := strings.Split(path, ".")
+	for i, field := range fields {
+		if _, err := strconv.Atoi(field); err == nil {
+			if i == 0 {
+				i = 1
+			}
+			return strings.Join(fields[:i], "."), true
+		}
+	}
+	return path, false
+}
+
+// partialUpdate builds a partial document and the list of removed fields
+// from the update description of a change event.  Fields inside arrays are
+// sent whole using the value from the full document.  It is not used when
+// documents are mapped or materialized since the changed fields may not
+// match the indexed document.
+func (ic *indexClient) partialUpdate(op *gtm.Op) (doc map[string]interface{}, removed []string, ok bool) {
+	if !ic.config.IndexPartialUpdates || !op.IsUpdate() || !op.IsSourceOplog() || op.UpdateDescription == nil {
+		return
+	}
+	if mapperPlugin != nil || mapEnvs[""] != nil || mapEnvs[op.Namespace] != nil || aggregations[op.Namespace] != nil {
+		return
+	}
+	doc = make(map[string]interface{})
+	setFromDocument := func(path string) bool {
+		v, err := extractData(path, op.Data)
+		if err != nil {
+			return false
+		}
+		setPath(doc, path, v)
+		return true
+	}
+	for path, v := range toMap(op.UpdateDescription["updatedFields"]) {
+		if prefix, inArray := arrayPathPrefix(path); inArray {
+			if !setFromDocument(prefix) {
+				return nil, nil, false
+			}
+		} else {
+			setPath(doc, path, v)
+		}
+	}
+	for _, path := range toStringSlice(op.UpdateDescription["removedFields"]) {
+		if prefix, inArray := arrayPathPrefix(path); inArray {
+			if !setFromDocument(prefix) {
+				return nil, nil, false
+			}
+		} else {
+			removed = append(removed, path)
+		}
+	}
+	if truncated, found := op.UpdateDescription["truncatedArrays"]; found {
+		var arrays []interface{}
+		switch ta := truncated.(type) {
+		case []interface{}:
+			arrays = ta
+		case primitive.A:
+			arrays = ta
+		}
+		for _, a := range arrays {
+			if field, found := toMap(a)["field"].(string); found {
+				if !setFromDocument(field) {
+					return nil, nil, false
+				}
+			}
+		}
+	}
+	if ic.config.IndexOplogTime {
+		doc[ic.config.OplogTsFieldName] = op.Data[ic.config.OplogTsFieldName]
+		doc[ic.config.OplogDateFieldName] = op.Data[ic.config.OplogDateFieldName]
+	}
+	if ic.config.PruneInvalidJSON {
+		doc = fixPruneInvalidJSON(opIDToString(op), doc)
+	}
+	return monstachemap.ConvertMapForJSON(doc), removed, true
+}
+
+var templateFieldRegex = regexp.MustCompile(`\{([^{}]+)\}`)
+
+func (su *scriptUpdate) validate() error {
+	if su.Index == "" || su.ID == "" || su.Script == "" {
+		return errors.New("index, id and script are required")
+	}
+	for _, o := range su.Operations {
+		if o != "insert" && o != "update" && o != "delete" {
+			return fmt.Errorf("invalid operation %q: must be insert, update or delete", o)
+		}
+	}
+	return nil
+}
+
+func (su *scriptUpdate) appliesTo(operation string) bool {
+	if len(su.Operations) == 0 {
+		return true
+	}
+	for _, o := range su.Operations {
+		if o == operation {
+			return true
+		}
+	}
+	return false
+}
+
+func opOperationName(op *gtm.Op) string {
+	if op.IsDelete() {
+		return "delete"
+	} else if op.IsUpdate() {
+		return "update"
+	}
+	return "insert"
+}
+
+func templateField(field string, op *gtm.Op) (interface{}, error) {
+	if field == "_id" {
+		return op.Id, nil
+	}
+	if op.Data == nil {
+		return nil, fmt.Errorf("field %s is not available", field)
+	}
+	return extractData(field, op.Data)
+}
+
+// resolveTemplateString replaces each {field} in s with the field value
+func resolveTemplateString(s string, op *gtm.Op) (result string, err error) {
+	result = templateFieldRegex.ReplaceAllStringFunc(s, func(m string) string {
+		if err != nil {
+			return ""
+		}
+		var v interface{}
+		if v, err = templateField(m[1:len(m)-1], op); err != nil {
+			return ""
+		}
+		return opIDToString(&gtm.Op{Id: v})
+	})
+	return
+}
+
+// resolveTemplateValue resolves the templates in params.  A string which is
+// only a {field} is replaced by the field value keeping its type.
+func resolveTemplateValue(v interface{}, op *gtm.Op) (interface{}, error) {
+	switch tv := v.(type) {
+	case string:
+		if m := templateFieldRegex.FindStringSubmatch(tv); m != nil && m[0] == tv {
+			return templateField(m[1], op)
+		}
+		return resolveTemplateString(tv, op)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(tv))
+		for k, e := range tv {
+			r, err := resolveTemplateValue(e, op)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, 0, len(tv))
+		for _, e := range tv {
+			r, err := resolveTemplateValue(e, op)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, r)
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+func (su *scriptUpdate) resolve(entry int, op *gtm.Op) (t *scriptUpdateTarget, err error) {
+	t = &scriptUpdateTarget{Entry: entry, Index: strings.ToLower(su.Index)}
+	if t.ID, err = resolveTemplateString(su.ID, op); err != nil {
+		return nil, err
+	}
+	if t.Routing, err = resolveTemplateString(su.Routing, op); err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if su.Params != nil {
+		if v, err = resolveTemplateValue(su.Params, op); err != nil {
+			return nil, err
+		}
+		t.Params = v.(map[string]interface{})
+	}
+	if su.Upsert != nil {
+		if v, err = resolveTemplateValue(su.Upsert, op); err != nil {
+			return nil, err
+		}
+		t.Upsert = v.(map[string]interface{})
+	}
+	return
+}
+
+func (ic *indexClient) addScriptUpdate(su *scriptUpdate, t *scriptUpdateTarget) {
+	script := elastic.NewScript(su.Script)
+	if t.Params != nil {
+		script.Params(monstachemap.ConvertMapForJSON(t.Params))
+	}
+	req := elastic.NewBulkUpdateRequest()
+	req.UseEasyJSON(ic.config.EnableEasyJSON)
+	req.Index(t.Index)
+	req.Id(t.ID)
+	req.Script(script)
+	if t.Routing != "" {
+		req.Routing(t.Routing)
+	}
+	if t.Upsert != nil {
+		req.Upsert(monstachemap.ConvertMapForJSON(t.Upsert))
+		req.ScriptedUpsert(su.ScriptedUpsert)
+	}
+	if su.RetryOnConflict != 0 {
+		req.RetryOnConflict(su.RetryOnConflict)
+	}
+	ic.bulk.Add(req)
+}
+
+func (ic *indexClient) scriptUpdateCollection() *mongo.Collection {
+	return ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("scriptupdates")
+}
+
+// runScriptUpdates applies the script updates of the mapping for op.  The
+// targets of delete script updates are saved on insert and update because
+// the document is no longer available when it is deleted.  Direct reads are
+// ignored since they would apply the updates again on every resync.
+func (ic *indexClient) runScriptUpdates(op *gtm.Op) {
+	m := mapIndexTypes[op.Namespace]
+	if m == nil || len(m.ScriptUpdates) == 0 || !op.IsSourceOplog() {
+		return
+	}
+	objectID := opIDToString(op)
+	metaID := fmt.Sprintf("%s.%s", op.Namespace, objectID)
+	if op.IsDelete() {
+		if ic.mongo == nil {
+			return
+		}
+		targets, err := ic.takeScriptUpdateTargets(metaID)
+		if err != nil {
+			errorLog.Printf("Unable to find script updates for deleted document %s: %s", objectID, err)
+			return
+		}
+		for _, t := range targets {
+			if t.Entry < len(m.ScriptUpdates) && m.ScriptUpdates[t.Entry].appliesTo("delete") {
+				ic.addScriptUpdate(m.ScriptUpdates[t.Entry], t)
+			}
+		}
+		return
+	}
+	operation := opOperationName(op)
+	var targets []*scriptUpdateTarget
+	hasDelete := false
+	for i, su := range m.ScriptUpdates {
+		runNow, onDelete := su.appliesTo(operation), su.appliesTo("delete")
+		if !runNow && !onDelete {
+			continue
+		}
+		hasDelete = hasDelete || onDelete
+		t, err := su.resolve(i, op)
+		if err != nil {
+			errorLog.Printf("Unable to resolve script update for document %s in namespace %s: %s", objectID, op.Namespace, err)
+			continue
+		}
+		if runNow {
+			ic.addScriptUpdate(su, t)
+		}
+		if onDelete {
+			targets = append(targets, t)
+		}
+	}
+	if !hasDelete || ic.mongo == nil {
+		return
+	}
+	ic.queueScriptUpdateTargets(metaID, bson.M{
+		"db":        op.GetDatabase(),
+		"namespace": op.Namespace,
+		"targets":   targets,
+	})
+}
+
+// queueScriptUpdateTargets remembers the delete targets of a document until
+// the next flush saves them with a single bulk write
+func (ic *indexClient) queueScriptUpdateTargets(metaID string, doc bson.M) {
+	ic.scriptUpdateMutex.Lock()
+	defer ic.scriptUpdateMutex.Unlock()
+	if ic.scriptUpdateDocs == nil {
+		ic.scriptUpdateDocs = make(map[string]bson.M)
+	}
+	ic.scriptUpdateDocs[metaID] = doc
+}
+
+// takeScriptUpdateTargets removes and returns the delete targets of a
+// document.  Targets still queued are newer than the saved ones.
+func (ic *indexClient) takeScriptUpdateTargets(metaID string) (targets []*scriptUpdateTarget, err error) {
+	ic.scriptUpdateFlush.Lock()
+	defer ic.scriptUpdateFlush.Unlock()
+	ic.scriptUpdateMutex.Lock()
+	queued, isQueued := ic.scriptUpdateDocs[metaID]
+	delete(ic.scriptUpdateDocs, metaID)
+	ic.scriptUpdateMutex.Unlock()
+	var doc struct {
+		Targets []*scriptUpdateTarget `bson:"targets"`
+	}
+	err = ic.scriptUpdateCollection().FindOneAndDelete(context.Background(), bson.M{"_id": metaID}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		err = nil
+	}
+	if isQueued {
+		return queued["targets"].([]*scriptUpdateTarget), nil
+	}
+	return doc.Targets, err
+}
+
+// flushScriptUpdateTargets saves the queued delete targets.  Deletes wait for
+// a flush in progress so that they see the targets it writes.
+func (ic *indexClient) flushScriptUpdateTargets() {
+	ic.scriptUpdateFlush.Lock()
+	defer ic.scriptUpdateFlush.Unlock()
+	ic.scriptUpdateMutex.Lock()
+	docs := ic.scriptUpdateDocs
+	ic.scriptUpdateDocs = nil
+	ic.scriptUpdateMutex.Unlock()
+	if len(docs) == 0 {
+		return
+	}
+	models := make([]mongo.WriteModel, 0, len(docs))
+	for metaID, doc := range docs {
+		model := mongo.NewReplaceOneModel()
+		model.SetFilter(bson.M{"_id": metaID})
+		model.SetReplacement(doc)
+		model.SetUpsert(true)
+		models = append(models, model)
+	}
+	opts := options.BulkWrite().SetOrdered(false)
+	if _, err := ic.scriptUpdateCollection().BulkWrite(context.Background(), models, opts); err != nil {
+		errorLog.Printf("Unable to save script updates: %s", err)
+	}
+}
+
+// dropScriptUpdates forgets the delete targets of documents in a dropped
+// database or collection
+func (ic *indexClient) dropScriptUpdates(field, value string) (err error) {
+	if ic.mongo == nil {
+		return
+	}
+	ic.scriptUpdateFlush.Lock()
+	defer ic.scriptUpdateFlush.Unlock()
+	ic.scriptUpdateMutex.Lock()
+	for metaID, doc := range ic.scriptUpdateDocs {
+		if doc[field] == value {
+			delete(ic.scriptUpdateDocs, metaID)
+		}
+	}
+	ic.scriptUpdateMutex.Unlock()
+	_, err = ic.scriptUpdateCollection().DeleteMany(context.Background(), bson.M{field: value})
+	return
+}
+
+// startScriptUpdates periodically saves the delete targets of script updates
+// until the workers are stopped
+func (ic *indexClient) startScriptUpdates() {
+	if ic.mongo == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ic.stopScriptUpdates = cancel
+	ic.scriptUpdateWg.Add(1)
+	go func() {
+		defer ic.scriptUpdateWg.Done()
+		ticker := time.NewTicker(scriptUpdateFlushDuration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ic.flushScriptUpdateTargets()
+			case <-ctx.Done():
+				ic.flushScriptUpdateTargets()
+				return
+			}
+		}
+	}()
+}
+
+// pipeline returns the aggregation stages to run for the document
+func (a *aggregation) pipeline(id interface{}) []interface{} {
+	stages := make([]interface{}, 0, len(a.stages)+1)
+	stages = append(stages, bson.M{"$match": bson.M{"_id": id}})
+	return append(stages, a.stages...)
+}
+
+// materialize replaces the document with the result of the aggregation
+// configured for the namespace.  The document is removed when the
+// aggregation has no result.
+func (ic *indexClient) materialize(op *gtm.Op) (err error) {
+	a := aggregations[op.Namespace]
+	if a == nil || op.Data == nil || ic.mongo == nil {
+		return
+	}
+	ctx := context.Background()
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+	col := ic.mongo.Database(op.GetDatabase()).Collection(op.GetCollection())
+	ao := options.Aggregate()
+	ao.SetAllowDiskUse(a.AllowDiskUse)
+	cursor, err := col.Aggregate(ctx, a.pipeline(op.Id), ao)
+	if err != nil {
+		return fmt.Errorf("Unable to materialize document %s in namespace %s: %s", opIDToString(op), op.Namespace, err)
+	}
+	defer cursor.Close(ctx)
+	if !cursor.Next(ctx) {
+		op.Data = nil
+		return cursor.Err()
+	}
+	doc := make(map[string]interface{})
+	if err = cursor.Decode(&doc); err != nil {
+		return
+	}
+	doc["_id"] = op.Id
+	op.Data = doc
+	// the update description refers to the source document and not to the
+	// aggregation result so the materialized document is always indexed whole
+	op.UpdateDescription = nil
+	return
+}
+
 func (ic *indexClient) doIndex(op *gtm.Op) (err error) {
+	if err = ic.materialize(op); err != nil {
+		return
+	}
+	if op.Data == nil {
+		if op.IsUpdate() {
+			ic.doDelete(op)
+		}
+		return
+	}
 	if err = ic.mapData(op); err == nil {
 		if op.Data != nil {
 			err = ic.doIndexing(op)
@@ -3303,7 +6473,11 @@ func (ic *indexClient) doIndex(op *gtm.Op) (err error) {
 	return
 }
 
-func (ic *indexClient) runProcessor(op *gtm.Op) (err error) {
+func hasProcessPlugin() bool {
+	return processPlugin != nil || processBatchPlugin != nil
+}
+
+func (ic *indexClient) newProcessInput(op *gtm.Op) *monstachemap.ProcessPluginInput {
 	input := &monstachemap.ProcessPluginInput{
 		ElasticClient:        ic.client,
 		ElasticBulkProcessor: ic.bulk,
@@ -3321,10 +6495,50 @@ func (ic *indexClient) runProcessor(op *gtm.Op) (err error) {
 	input.Operation = op.Operation
 	input.MongoClient = ic.mongo
 	input.UpdateDescription = op.UpdateDescription
-	err = processPlugin(input)
+	input.Context = pluginCtx
+	input.Logger = pluginLog
+	return input
+}
+
+func (ic *indexClient) runProcessor(op *gtm.Op) (err error) {
+	err = processPlugin(ic.newProcessInput(op))
 	return
 }
 
+// runBatchProcessor groups ops for the ProcessBatch plugin function.  Like
+// the bulk processor a batch is flushed when it reaches the configured size,
+// when the flush interval elapses and when the processor is closed.
+func (ic *indexClient) runBatchProcessor() {
+	size := ic.config.ProcessBatchSize
+	ticker := time.NewTicker(time.Duration(ic.config.ProcessBatchSeconds) * time.Second)
+	defer ticker.Stop()
+	var batch []*monstachemap.ProcessPluginInput
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := processBatchPlugin(batch); err != nil {
+			ic.processErr(err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case op, open := <-ic.processC:
+			if !open {
+				flush()
+				return
+			}
+			batch = append(batch, ic.newProcessInput(op))
+			if len(batch) >= size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
 func (ic *indexClient) routeProcess(op *gtm.Op) (err error) {
 	rop := &gtm.Op{
 		Id:                op.Id,
@@ -3406,6 +6620,9 @@ func (ic *indexClient) routeDeleteRelate(op *gtm.Op) (err error) {
 }
 
 func (ic *indexClient) routeDelete(op *gtm.Op) (err error) {
+	if !allowsOperation(op.Namespace, "delete") {
+		return
+	}
 	if len(ic.config.Relate) > 0 {
 		err = ic.routeDeleteRelate(op)
 		if ic.skipDelete(op) {
@@ -3462,6 +6679,23 @@ func (ic *indexClient) routeDataRelate(op *gtm.Op) (skip bool, err error) {
 }
 
 func (ic *indexClient) routeData(op *gtm.Op) (err error) {
+	// soft deletes become deletes unless a policy excludes deletes, in
+	// which case the update is indexed as is
+	if softDeleted(op) && allowsOperation(op.Namespace, "delete") {
+		if op.IsSourceDirect() {
+			return
+		}
+		return ic.routeDelete(&gtm.Op{
+			Id:        op.Id,
+			Operation: "d",
+			Namespace: op.Namespace,
+			Source:    op.Source,
+			Timestamp: op.Timestamp,
+		})
+	}
+	if ic.hasPendingDelete(op) {
+		ic.flushDeletes()
+	}
 	skip := false
 	if op.IsSourceOplog() && len(ic.config.Relate) > 0 {
 		skip, err = ic.routeDataRelate(op)
@@ -3476,15 +6710,82 @@ func (ic *indexClient) routeData(op *gtm.Op) (err error) {
 	return
 }
 
+// matchFieldPath returns true if field is matched by pattern or lies beneath
+// a path matched by pattern.  Each dot separated segment of the pattern is
+// matched against the corresponding segment of field with path.Match.
+func matchFieldPath(pattern, field string) bool {
+	ps, fs := strings.Split(pattern, "."), strings.Split(field, ".")
+	if len(ps) > len(fs) {
+		return false
+	}
+	for i, p := range ps {
+		if ok, _ := path.Match(p, fs[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ignoreUpdate returns true if op is an update whose changed fields are all
+// covered by the ignore-update-fields of the namespace mapping
+func ignoreUpdate(op *gtm.Op) bool {
+	if !op.IsUpdate() || op.UpdateDescription == nil {
+		return false
+	}
+	m := mapIndexTypes[op.Namespace]
+	if m == nil || len(m.IgnoreUpdates) == 0 {
+		return false
+	}
+	desc := op.UpdateDescription
+	fields := toStringSlice(desc["removedFields"])
+	for f := range toMap(desc["updatedFields"]) {
+		fields = append(fields, f)
+	}
+	var truncated []interface{}
+	switch ta := desc["truncatedArrays"].(type) {
+	case []interface{}:
+		truncated = ta
+	case primitive.A:
+		truncated = ta
+	}
+	for _, t := range truncated {
+		if f, ok := toMap(t)["field"].(string); ok {
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) == 0 {
+		return false
+	}
+	for _, f := range fields {
+		ignored := false
+		for _, p := range m.IgnoreUpdates {
+			if matchFieldPath(p, f) {
+				ignored = true
+				break
+			}
+		}
+		if !ignored {
+			return false
+		}
+	}
+	return true
+}
+
 func (ic *indexClient) routeOp(op *gtm.Op) (err error) {
-	if processPlugin != nil {
+	if ignoreUpdate(op) {
+		counters.add("ignoredUpdates."+op.Namespace, 1)
+		return
+	}
+	if hasProcessPlugin() && allowsOp(op) {
 		err = ic.routeProcess(op)
 	}
-	if op.IsDrop() {
+	if _, _, rename := renameOf(op); rename || op.IsDrop() {
 		err = ic.routeDrop(op)
+	} else if ddl, ok := ddlOf(op); ok {
+		err = ic.routeDDL(op, ddl)
 	} else if op.IsDelete() {
 		err = ic.routeDelete(op)
-	} else if op.Data != nil {
+	} else if op.Data != nil && allowsOperation(op.Namespace, opOperationName(op)) {
 		err = ic.routeData(op)
 	}
 	return
@@ -3502,11 +6803,27 @@ func (ic *indexClient) processErr(err error) {
 	} else {
 		errorLog.Println(err)
 	}
-	if config.FailFast {
+	if isFatal(err) {
+		ic.stopOnFatal()
+	} else if config.FailFast {
 		os.Exit(exitStatus)
 	}
 }
 
+// stopOnFatal starts a clean shutdown after a fatal error.  Events after the
+// failure are no longer routed and the resume position is no longer saved so
+// that the failed event is read again on the next start
+func (ic *indexClient) stopOnFatal() {
+	ic.fatalOnce.Do(func() {
+		ic.failed.Store(true)
+		go func() {
+			ic.onExternalShutdown()
+			ic.stopAllWorkers()
+			ic.doneC <- 10
+		}()
+	})
+}
+
 func (ic *indexClient) doIndexStats() (err error) {
 	var hostname string
 	doc := make(map[string]interface{})
@@ -3517,7 +6834,7 @@ func (ic *indexClient) doIndexStats() (err error) {
 		doc["Host"] = hostname
 	}
 	doc["Pid"] = os.Getpid()
-	doc["Stats"] = ic.bulk.Stats()
+	doc["Stats"] = statsSnapshot(ic.bulk)
 	index := strings.ToLower(t.Format(ic.config.StatsIndexFormat))
 	req := elastic.NewBulkIndexRequest().Index(index)
 	req.UseEasyJSON(ic.config.EnableEasyJSON)
@@ -3526,8 +6843,47 @@ func (ic *indexClient) doIndexStats() (err error) {
 	return
 }
 
-func (ic *indexClient) dropDBMeta(db string) (err error) {
+// metaInElastic returns true if document metadata for stateful deletes is
+// kept in an Elasticsearch index rather than the MongoDB meta collection
+func (ic *indexClient) metaInElastic() bool {
+	return ic.config.DeleteMetaStore == deleteMetaStoreElastic
+}
+
+// savesTemplateMeta returns true if the index of documents in a templated
+// index is saved whatever the delete strategy so that updates and deletes
+// find the document again.  Templates using only the _id never move.
+func (ic *indexClient) savesTemplateMeta(indexType *indexMapping) bool {
+	if indexType.template == nil || indexType.template.fromID() {
+		return false
+	}
+	return ic.mongo != nil || ic.metaInElastic()
+}
+
+// keepsMeta returns true if document metadata may have been saved
+func (ic *indexClient) keepsMeta() bool {
 	if ic.config.DeleteStrategy == statefulDeleteStrategy {
+		return true
+	}
+	for _, m := range mapIndexTypes {
+		if m.template != nil && !m.template.fromID() {
+			return true
+		}
+	}
+	return false
+}
+
+func (ic *indexClient) dropElasticMeta(field, value string) (err error) {
+	delete := ic.client.DeleteByQuery(ic.config.DeleteMetaIndex)
+	delete.ProceedOnVersionConflict()
+	delete.Query(elastic.NewTermQuery(field, value))
+	_, err = delete.Do(context.Background())
+	return
+}
+
+func (ic *indexClient) dropDBMeta(db string) (err error) {
+	if ic.keepsMeta() && ic.metaInElastic() {
+		err = ic.dropElasticMeta("db", db)
+	} else if ic.keepsMeta() {
 		col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("meta")
 		q := bson.M{"db": db}
 		_, err = col.DeleteMany(context.Background(), q)
@@ -3535,8 +6891,190 @@ func (ic *indexClient) dropDBMeta(db string) (err error) {
 	return
 }
 
+// derivedRef locates a derived document in Elasticsearch
+type derivedRef struct {
+	Index   string `bson:"index"`
+	ID      string `bson:"id"`
+	Routing string `bson:"routing,omitempty"`
+}
+
+func (ic *indexClient) derivedCollection() *mongo.Collection {
+	return ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("derived")
+}
+
+// loadDerived remembers the namespaces with derived documents so that only
+// writes and deletes in those namespaces need to look them up.  It runs at
+// startup and again when a clustered process resumes work since the active
+// process may have changed the derived documents in the meantime
+func (ic *indexClient) loadDerived() {
+	if ic.mongo == nil {
+		return
+	}
+	nss, err := ic.derivedCollection().Distinct(context.Background(), "namespace", bson.M{})
+	if err != nil {
+		errorLog.Printf("Unable to load namespaces with derived documents: %s", err)
+		return
+	}
+	ic.derivedNs.Range(func(k, v interface{}) bool {
+		ic.derivedNs.Delete(k)
+		return true
+	})
+	ic.derivedCache.Purge()
+	for _, ns := range nss {
+		if s, ok := ns.(string); ok {
+			ic.derivedNs.Store(s, true)
+		}
+	}
+}
+
+func (ic *indexClient) hasDerived(namespace string) bool {
+	_, ok := ic.derivedNs.Load(namespace)
+	return ok
+}
+
+// getDerived returns the derived documents of a document.  Results are kept
+// in a bounded cache which trackDerived and deleteDerived keep current
+func (ic *indexClient) getDerived(namespace, id string) (refs []derivedRef, err error) {
+	metaID := fmt.Sprintf("%s.%s", namespace, id)
+	if cached, ok := ic.derivedCache.Get(metaID); ok {
+		return cached.([]derivedRef), nil
+	}
+	var doc struct {
+		Docs []derivedRef `bson:"docs"`
+	}
+	err = ic.derivedCollection().FindOne(context.Background(), bson.M{"_id": metaID}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		err = nil
+	}
+	if err == nil {
+		refs = doc.Docs
+		ic.derivedCache.Add(metaID, refs)
+	}
+	return
+}
+
+func (ic *indexClient) deleteDerivedRefs(op *gtm.Op, refs []derivedRef) {
+	for _, ref := range refs {
+		req := elastic.NewBulkDeleteRequest()
+		req.UseEasyJSON(ic.config.EnableEasyJSON)
+		req.Index(ref.Index)
+		req.Id(ref.ID)
+		if ref.Routing != "" {
+			req.Routing(ref.Routing)
+		}
+		if !ic.config.IndexAsUpdate {
+			req.Version(tsVersion(op))
+			req.VersionType("external")
+		}
+		ic.bulk.Add(req)
+	}
+}
+
+// trackDerived saves the derived documents of a document and deletes the
+// ones previously derived from it which are no longer present
+func (ic *indexClient) trackDerived(op *gtm.Op, id string, refs []derivedRef) error {
+	if ic.mongo == nil {
+		return nil
+	}
+	prev, err := ic.getDerived(op.Namespace, id)
+	if err != nil {
+		return err
+	}
+	current := make(map[derivedRef]bool)
+	for _, ref := range refs {
+		current[ref] = true
+	}
+	var stale []derivedRef
+	for _, ref := range prev {
+		if !current[ref] {
+			stale = append(stale, ref)
+		}
+	}
+	ic.deleteDerivedRefs(op, stale)
+	col := ic.derivedCollection()
+	metaID := fmt.Sprintf("%s.%s", op.Namespace, id)
+	if len(refs) == 0 {
+		if len(prev) > 0 {
+			_, err = col.DeleteOne(context.Background(), bson.M{"_id": metaID})
+		}
+		if err == nil {
+			ic.derivedCache.Add(metaID, []derivedRef(nil))
+		}
+		return err
+	}
+	ic.derivedNs.Store(op.Namespace, true)
+	opts := options.Update()
+	opts.SetUpsert(true)
+	_, err = col.UpdateOne(context.Background(), bson.M{
+		"_id": metaID,
+	}, bson.M{
+		"$set": bson.M{
+			"docs":      refs,
+			"db":        op.GetDatabase(),
+			"namespace": op.Namespace,
+		},
+	}, opts)
+	if err == nil {
+		ic.derivedCache.Add(metaID, refs)
+	}
+	return err
+}
+
+// deleteDerived deletes the documents derived from a deleted document
+func (ic *indexClient) deleteDerived(op *gtm.Op, id string) {
+	if ic.mongo == nil || !ic.hasDerived(op.Namespace) {
+		return
+	}
+	refs, err := ic.getDerived(op.Namespace, id)
+	if err != nil {
+		errorLog.Printf("Unable to find derived documents of %s: %s", id, err)
+		return
+	}
+	if len(refs) == 0 {
+		return
+	}
+	metaID := fmt.Sprintf("%s.%s", op.Namespace, id)
+	ic.derivedCache.Add(metaID, []derivedRef(nil))
+	ic.deleteDerivedRefs(op, refs)
+	if _, err = ic.derivedCollection().DeleteOne(context.Background(), bson.M{"_id": metaID}); err != nil {
+		errorLog.Printf("Unable to remove derived documents of %s: %s", id, err)
+	}
+}
+
+// dropDerived deletes the documents derived from a dropped database or
+// collection
+func (ic *indexClient) dropDerived(op *gtm.Op, q bson.M) (err error) {
+	if ic.mongo == nil {
+		return
+	}
+	col := ic.derivedCollection()
+	ctx := context.Background()
+	cursor, err := col.Find(ctx, q)
+	if err != nil {
+		return
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc struct {
+			Docs []derivedRef `bson:"docs"`
+		}
+		if err = cursor.Decode(&doc); err != nil {
+			return
+		}
+		ic.deleteDerivedRefs(op, doc.Docs)
+	}
+	if err = cursor.Err(); err != nil {
+		return
+	}
+	_, err = col.DeleteMany(ctx, q)
+	ic.derivedCache.Purge()
+	return
+}
+
 func (ic *indexClient) dropCollectionMeta(namespace string) (err error) {
-	if ic.config.DeleteStrategy == statefulDeleteStrategy {
+	if ic.keepsMeta() && ic.metaInElastic() {
+		err = ic.dropElasticMeta("namespace", namespace)
+	} else if ic.keepsMeta() {
 		col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("meta")
 		q := bson.M{"namespace": namespace}
 		_, err = col.DeleteMany(context.Background(), q)
@@ -3591,6 +7129,73 @@ func (meta *indexingMeta) load(metaAttrs map[string]interface{}) {
 			errorLog.Printf("Error applying retryOnConflict metadata: %s", err)
 		}
 	}
+	if v, ok = metaAttrs["documents"]; ok {
+		if docs, err := parseDerivedDocuments(v); err == nil {
+			meta.Documents = docs
+		} else {
+			errorLog.Printf("Error applying documents metadata: %s", err)
+		}
+	}
+}
+
+func parseDerivedDocument(v interface{}) (*monstachemap.DerivedDocument, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected an object for each derived document but got %T", v)
+	}
+	d := &monstachemap.DerivedDocument{}
+	if id, ok := m["id"]; ok {
+		d.ID = opIDToString(&gtm.Op{Id: id})
+	}
+	if d.ID == "" {
+		return nil, errors.New("Derived documents must have an id")
+	}
+	if doc, ok := m["document"].(map[string]interface{}); ok {
+		d.Document = doc
+	} else {
+		return nil, fmt.Errorf("Derived document %s must have a document object", d.ID)
+	}
+	if v, ok := m["index"]; ok {
+		d.Index = fmt.Sprintf("%v", v)
+	}
+	if v, ok := m["routing"]; ok {
+		d.Routing = fmt.Sprintf("%v", v)
+	}
+	if v, ok := m["pipeline"]; ok {
+		d.Pipeline = fmt.Sprintf("%v", v)
+	}
+	return d, nil
+}
+
+func parseDerivedDocuments(v interface{}) (docs []*monstachemap.DerivedDocument, err error) {
+	switch vs := v.(type) {
+	case []*monstachemap.DerivedDocument:
+		for _, d := range vs {
+			if d == nil || d.ID == "" {
+				return nil, errors.New("Derived documents must have an id")
+			}
+		}
+		docs = vs
+	case []map[string]interface{}:
+		for _, m := range vs {
+			var d *monstachemap.DerivedDocument
+			if d, err = parseDerivedDocument(m); err != nil {
+				return nil, err
+			}
+			docs = append(docs, d)
+		}
+	case []interface{}:
+		for _, m := range vs {
+			var d *monstachemap.DerivedDocument
+			if d, err = parseDerivedDocument(m); err != nil {
+				return nil, err
+			}
+			docs = append(docs, d)
+		}
+	default:
+		err = fmt.Errorf("Expected an array of derived documents but got %T", v)
+	}
+	return
 }
 
 func (meta *indexingMeta) shouldSave(config *configOptions) bool {
@@ -3606,7 +7211,6 @@ func (meta *indexingMeta) shouldSave(config *configOptions) bool {
 
 func (ic *indexClient) setIndexMeta(namespace, id string, meta *indexingMeta) error {
 	config := ic.config
-	col := ic.mongo.Database(config.ConfigDatabaseName).Collection("meta")
 	metaID := fmt.Sprintf("%s.%s", namespace, id)
 	doc := map[string]interface{}{
 		"id":        meta.ID,
@@ -3618,6 +7222,18 @@ func (ic *indexClient) setIndexMeta(namespace, id string, meta *indexingMeta) er
 		"db":        strings.SplitN(namespace, ".", 2)[0],
 		"namespace": namespace,
 	}
+	if ic.metaInElastic() {
+		// queued with the document itself so no extra round trip is made
+		req := elastic.NewBulkIndexRequest()
+		req.UseEasyJSON(config.EnableEasyJSON)
+		req.Index(config.DeleteMetaIndex)
+		req.Id(metaID)
+		req.Doc(doc)
+		ic.queueMeta(metaID, doc)
+		ic.bulk.Add(metaRequest{req, metaID})
+		return nil
+	}
+	col := ic.mongo.Database(config.ConfigDatabaseName).Collection("meta")
 	opts := options.Update()
 	opts.SetUpsert(true)
 	_, err := col.UpdateOne(context.Background(), bson.M{
@@ -3628,43 +7244,152 @@ func (ic *indexClient) setIndexMeta(namespace, id string, meta *indexingMeta) er
 	return err
 }
 
+// pendingMeta is document metadata queued in the bulk processor which may
+// not have been written to the delete meta index yet
+type pendingMeta struct {
+	requests int
+	doc      map[string]interface{} // nil when the metadata is being deleted
+}
+
+// metaRequest is a bulk request which writes or removes the metadata of
+// metaID in the delete meta index
+type metaRequest struct {
+	elastic.BulkableRequest
+	metaID string
+}
+
+// queueMeta remembers the latest metadata queued for a document until the
+// bulk requests for it have been written.  A nil doc queues its removal.
+func (ic *indexClient) queueMeta(metaID string, doc map[string]interface{}) {
+	ic.metaMutex.Lock()
+	defer ic.metaMutex.Unlock()
+	if ic.metaPending == nil {
+		ic.metaPending = make(map[string]*pendingMeta)
+	}
+	pm := ic.metaPending[metaID]
+	if pm == nil {
+		pm = &pendingMeta{}
+		ic.metaPending[metaID] = pm
+	}
+	pm.requests++
+	pm.doc = doc
+}
+
+// metaWritten forgets the pending metadata of a committed bulk request.
+// Entries are cleared whether or not the request succeeded, since a failed
+// request is not retried and would otherwise stay pending forever.
+func (ic *indexClient) metaWritten(requests []elastic.BulkableRequest) {
+	ic.metaMutex.Lock()
+	defer ic.metaMutex.Unlock()
+	for _, req := range requests {
+		mr, ok := req.(metaRequest)
+		if !ok {
+			continue
+		}
+		if pm := ic.metaPending[mr.metaID]; pm != nil {
+			if pm.requests--; pm.requests <= 0 {
+				delete(ic.metaPending, mr.metaID)
+			}
+		}
+	}
+}
+
+func (ic *indexClient) queuedMeta(metaID string) (doc map[string]interface{}, queued bool) {
+	ic.metaMutex.Lock()
+	defer ic.metaMutex.Unlock()
+	if pm := ic.metaPending[metaID]; pm != nil {
+		return pm.doc, true
+	}
+	return nil, false
+}
+
+// readElasticMeta reads document metadata from the delete meta index.
+// Metadata which is still queued in the bulk processor is read from memory
+// so that no flush is needed.
+func (ic *indexClient) readElasticMeta(metaID string) (doc map[string]interface{}, err error) {
+	if doc, queued := ic.queuedMeta(metaID); queued {
+		if doc == nil {
+			return nil, fmt.Errorf("Metadata %s is being deleted", metaID)
+		}
+		return doc, nil
+	}
+	res, err := ic.client.Get().Index(ic.config.DeleteMetaIndex).Id(metaID).Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(res.Source, &doc)
+	return
+}
+
+func (ic *indexClient) readIndexMeta(namespace, id string) (meta *indexingMeta, found bool) {
+	meta = &indexingMeta{}
+	config := ic.config
+	metaID := fmt.Sprintf("%s.%s", namespace, id)
+	doc := make(map[string]interface{})
+	var err error
+	if ic.metaInElastic() {
+		doc, err = ic.readElasticMeta(metaID)
+	} else {
+		col := ic.mongo.Database(config.ConfigDatabaseName).Collection("meta")
+		result := col.FindOne(context.Background(), bson.M{
+			"_id": metaID,
+		})
+		if err = result.Err(); err == nil {
+			err = result.Decode(&doc)
+		}
+	}
+	if err == nil {
+		found = true
+		if doc["id"] != nil {
+			meta.ID = doc["id"].(string)
+		}
+		if doc["routing"] != nil {
+			meta.Routing = doc["routing"].(string)
+		}
+		if doc["index"] != nil {
+			meta.Index = strings.ToLower(doc["index"].(string))
+		}
+		if doc["type"] != nil {
+			meta.Type = doc["type"].(string)
+		}
+		if doc["parent"] != nil {
+			meta.Parent = doc["parent"].(string)
+		}
+		if doc["pipeline"] != nil {
+			meta.Pipeline = doc["pipeline"].(string)
+		}
+	}
+	return
+}
+
 func (ic *indexClient) getIndexMeta(namespace, id string) (meta *indexingMeta) {
-	meta = &indexingMeta{}
-	config := ic.config
-	col := ic.mongo.Database(config.ConfigDatabaseName).Collection("meta")
+	meta, found := ic.readIndexMeta(namespace, id)
+	if found {
+		ic.deleteIndexMeta(namespace, id)
+	}
+	return
+}
+
+// deleteIndexMeta removes the saved metadata of a deleted document
+func (ic *indexClient) deleteIndexMeta(namespace, id string) {
 	metaID := fmt.Sprintf("%s.%s", namespace, id)
-	result := col.FindOne(context.Background(), bson.M{
-		"_id": metaID,
-	})
-	if err := result.Err(); err == nil {
-		doc := make(map[string]interface{})
-		if err = result.Decode(&doc); err == nil {
-			if doc["id"] != nil {
-				meta.ID = doc["id"].(string)
-			}
-			if doc["routing"] != nil {
-				meta.Routing = doc["routing"].(string)
-			}
-			if doc["index"] != nil {
-				meta.Index = strings.ToLower(doc["index"].(string))
-			}
-			if doc["type"] != nil {
-				meta.Type = doc["type"].(string)
-			}
-			if doc["parent"] != nil {
-				meta.Parent = doc["parent"].(string)
-			}
-			if doc["pipeline"] != nil {
-				meta.Pipeline = doc["pipeline"].(string)
-			}
-			col.DeleteOne(context.Background(), bson.M{"_id": metaID})
+	if ic.metaInElastic() {
+		req := elastic.NewBulkDeleteRequest()
+		req.UseEasyJSON(ic.config.EnableEasyJSON)
+		req.Index(ic.config.DeleteMetaIndex)
+		req.Id(metaID)
+		ic.queueMeta(metaID, nil)
+		ic.bulk.Add(metaRequest{req, metaID})
+	} else if ic.mongo != nil {
+		col := ic.mongo.Database(ic.config.ConfigDatabaseName).Collection("meta")
+		if _, err := col.DeleteOne(context.Background(), bson.M{"_id": metaID}); err != nil {
+			errorLog.Printf("Unable to remove routing info of %s: %s", metaID, err)
 		}
 	}
-	return
 }
 
 func loadBuiltinFunctions(client *mongo.Client, config *configOptions) {
-	scriptEnvMaps := []map[string]*executionEnv{mapEnvs, filterEnvs}
+	scriptEnvMaps := []map[string]*executionEnv{mapEnvs, filterEnvs, deleteEnvs, ddlEnvs}
 	loadBuiltinFunctionsForEnvs(scriptEnvMaps, client, config)
 }
 
@@ -3673,12 +7398,14 @@ func loadBuiltinFunctionsForEnvs(envMaps []map[string]*executionEnv, client *mon
 		for ns, env := range envMap {
 			var fa *findConf
 			fa = &findConf{
-				client: client,
-				name:   "findId",
-				vm:     env.VM,
-				ns:     ns,
-				byID:   true,
-			}
+				client:  client,
+				name:    "findId",
+				vm:      env.VM,
+				ns:      ns,
+				timeout: env.timeout,
+				byID:    true,
+			}
+			env.setFindCache(fa)
 			if err := env.VM.Set(fa.name, makeFind(fa)); err != nil {
 				errorLog.Fatalln(err)
 			}
@@ -3686,21 +7413,25 @@ func loadBuiltinFunctionsForEnvs(envMaps []map[string]*executionEnv, client *mon
 				errorLog.Fatalln(err)
 			}
 			fa = &findConf{
-				client: client,
-				name:   "findOne",
-				vm:     env.VM,
-				ns:     ns,
+				client:  client,
+				name:    "findOne",
+				vm:      env.VM,
+				ns:      ns,
+				timeout: env.timeout,
 			}
+			env.setFindCache(fa)
 			if err := env.VM.Set(fa.name, makeFind(fa)); err != nil {
 				errorLog.Fatalln(err)
 			}
 			fa = &findConf{
-				client: client,
-				name:   "find",
-				vm:     env.VM,
-				ns:     ns,
-				multi:  true,
-			}
+				client:  client,
+				name:    "find",
+				vm:      env.VM,
+				ns:      ns,
+				timeout: env.timeout,
+				multi:   true,
+			}
+			env.setFindCache(fa)
 			if err := env.VM.Set(fa.name, makeFind(fa)); err != nil {
 				errorLog.Fatalln(err)
 			}
@@ -3709,10 +7440,12 @@ func loadBuiltinFunctionsForEnvs(envMaps []map[string]*executionEnv, client *mon
 				name:          "pipe",
 				vm:            env.VM,
 				ns:            ns,
+				timeout:       env.timeout,
 				multi:         true,
 				pipe:          true,
 				pipeAllowDisk: config.PipeAllowDisk,
 			}
+			env.setFindCache(fa)
 			if err := env.VM.Set(fa.name, makeFind(fa)); err != nil {
 				errorLog.Fatalln(err)
 			}
@@ -3784,6 +7517,31 @@ func (fc *findCall) setLimit(topts map[string]interface{}) (err error) {
 	return
 }
 
+func (fc *findCall) setCache(topts map[string]interface{}) (err error) {
+	if ov, ok := topts["cache"]; ok {
+		if ovb, ok := ov.(bool); ok {
+			fc.useCache = ovb
+		} else {
+			err = errors.New("Invalid cache option value")
+			return
+		}
+	}
+	if ov, ok := topts["cacheTTL"]; ok {
+		if ovs, ok := ov.(string); ok {
+			if fc.cacheTTL, err = time.ParseDuration(ovs); err != nil {
+				err = fmt.Errorf("Invalid cacheTTL option value: %s", err)
+				return
+			}
+			if _, explicit := topts["cache"]; !explicit {
+				fc.useCache = true
+			}
+		} else {
+			err = errors.New("Invalid cacheTTL option value")
+		}
+	}
+	return
+}
+
 func (fc *findCall) setQuery(v otto.Value) (err error) {
 	var q interface{}
 	if q, err = v.Export(); err == nil {
@@ -3806,6 +7564,9 @@ func (fc *findCall) setOptions(v otto.Value) (err error) {
 			if err = fc.setSelect(topts); err != nil {
 				return
 			}
+			if err = fc.setCache(topts); err != nil {
+				return
+			}
 			if fc.isMulti() {
 				if err = fc.setSort(topts); err != nil {
 					return
@@ -3836,6 +7597,13 @@ func (fc *findCall) getCollection() *mongo.Collection {
 	return fc.client.Database(fc.db).Collection(fc.col)
 }
 
+func (fc *findCall) context() (context.Context, context.CancelFunc) {
+	if fc.config.timeout > 0 {
+		return context.WithTimeout(context.Background(), fc.config.timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
 func (fc *findCall) getVM() *otto.Otto {
 	return fc.config.vm
 }
@@ -3914,15 +7682,17 @@ func (fc *findCall) restoreIds(v interface{}) (r interface{}) {
 	return
 }
 
-func (fc *findCall) execute() (r otto.Value, err error) {
+func (fc *findCall) fetch() (result interface{}, err error) {
 	var cursor *mongo.Cursor
+	ctx, cancel := fc.context()
+	defer cancel()
 	col := fc.getCollection()
 	query := fc.query
 	if fc.isMulti() {
 		if fc.isPipe() {
 			ao := options.Aggregate()
 			ao.SetAllowDiskUse(fc.pipeAllowDisk())
-			cursor, err = col.Aggregate(context.Background(), query, ao)
+			cursor, err = col.Aggregate(ctx, query, ao)
 			if err != nil {
 				return
 			}
@@ -3937,20 +7707,20 @@ func (fc *findCall) execute() (r otto.Value, err error) {
 			if len(fc.sel) > 0 {
 				fo.SetProjection(fc.sel)
 			}
-			cursor, err = col.Find(context.Background(), query, fo)
+			cursor, err = col.Find(ctx, query, fo)
 			if err != nil {
 				return
 			}
 		}
 		var rdocs []map[string]interface{}
-		for cursor.Next(context.Background()) {
+		for cursor.Next(ctx) {
 			doc := make(map[string]interface{})
 			if err = cursor.Decode(&doc); err != nil {
 				return
 			}
 			rdocs = append(rdocs, convertMapJavascript(doc))
 		}
-		r, err = fc.getVM().ToValue(rdocs)
+		result = rdocs
 	} else {
 		fo := options.FindOne()
 		if fc.config.byID {
@@ -3959,31 +7729,105 @@ func (fc *findCall) execute() (r otto.Value, err error) {
 		if len(fc.sel) > 0 {
 			fo.SetProjection(fc.sel)
 		}
-		result := col.FindOne(context.Background(), query, fo)
-		if err = result.Err(); err == nil {
+		sr := col.FindOne(ctx, query, fo)
+		if err = sr.Err(); err == nil {
 			doc := make(map[string]interface{})
-			if err = result.Decode(&doc); err == nil {
-				rdoc := convertMapJavascript(doc)
-				r, err = fc.getVM().ToValue(rdoc)
+			if err = sr.Decode(&doc); err == nil {
+				result = convertMapJavascript(doc)
 			}
 		}
 	}
 	return
 }
 
+func (fc *findCall) cacheKey() (string, error) {
+	key := struct {
+		DB    string
+		Col   string
+		Query interface{}
+		Sel   map[string]int
+		Sort  map[string]int
+		Limit int
+	}{fc.db, fc.col, fc.query, fc.sel, fc.sort, fc.limit}
+	// canonical Extended JSON keeps BSON types apart so that an ObjectId
+	// and its hex string do not share a cache entry
+	b, err := bson.MarshalExtJSON(key, true, false)
+	return string(b), err
+}
+
+func (fc *findCall) countCache(result string) {
+	ns := fc.config.ns
+	if ns == "" {
+		ns = "global"
+	}
+	counters.add(fmt.Sprintf("lookupCache.%s.%s.%s", ns, fc.getFunctionName(), result), 1)
+}
+
+// copyFindResult copies a cached result so that scripts cannot modify the
+// cached documents
+func copyFindResult(result interface{}) interface{} {
+	switch r := result.(type) {
+	case map[string]interface{}:
+		return convertMapJavascript(r)
+	case []map[string]interface{}:
+		docs := make([]map[string]interface{}, 0, len(r))
+		for _, doc := range r {
+			docs = append(docs, convertMapJavascript(doc))
+		}
+		return docs
+	}
+	return result
+}
+
+func (fc *findCall) execute() (r otto.Value, err error) {
+	var result interface{}
+	var key string
+	cached := false
+	if fc.useCache {
+		if key, err = fc.cacheKey(); err != nil {
+			return
+		}
+		if result, cached = fc.config.cache.Get(key); cached {
+			fc.countCache("hits")
+		}
+	}
+	if !cached {
+		result, err = fc.fetch()
+		if fc.useCache && (err == nil || err == mongo.ErrNoDocuments) {
+			fc.config.cache.AddWithTTL(key, result, fc.cacheTTL)
+			fc.countCache("misses")
+		}
+	}
+	if err != nil {
+		return
+	}
+	if result == nil && !fc.isMulti() {
+		err = mongo.ErrNoDocuments
+		return
+	}
+	r, err = fc.getVM().ToValue(copyFindResult(result))
+	return
+}
+
 func makeFind(fa *findConf) func(otto.FunctionCall) otto.Value {
 	return func(call otto.FunctionCall) (r otto.Value) {
 		var err error
 		fc := &findCall{
-			config: fa,
-			client: fa.client,
-			sort:   make(map[string]int),
-			sel:    make(map[string]int),
+			config:   fa,
+			client:   fa.client,
+			sort:     make(map[string]int),
+			sel:      make(map[string]int),
+			useCache: fa.cacheEnabled,
+			cacheTTL: fa.cacheTTL,
 		}
 		fc.setDefaults()
 		args := call.ArgumentList
 		argLen := len(args)
 		r = otto.NullValue()
+		if fc.client == nil {
+			fc.logError(errors.New("MongoDB client is unavailable"))
+			return
+		}
 		if argLen >= 1 {
 			if argLen >= 2 {
 				if err = fc.setOptions(call.Argument(1)); err != nil {
@@ -4006,144 +7850,619 @@ func makeFind(fa *findConf) func(otto.FunctionCall) otto.Value {
 				fc.logError(err)
 			}
 		} else {
-			fc.logError(errors.New("At least one argument is required"))
+			fc.logError(errors.New("At least one argument is required"))
+		}
+		return
+	}
+}
+
+func (ic *indexClient) findDeletedSrcDoc(op *gtm.Op) map[string]interface{} {
+	objectID := opIDToString(op)
+	termQuery := elastic.NewTermQuery("_id", objectID)
+	search := ic.client.Search()
+	search.Size(1)
+	search.Index(ic.config.DeleteIndexPattern)
+	search.Query(termQuery)
+	searchResult, err := search.Do(context.Background())
+	if err != nil {
+		errorLog.Printf("Unable to find deleted document %s: %s", objectID, err)
+		return nil
+	}
+	if searchResult.Hits == nil {
+		errorLog.Printf("Unable to find deleted document %s", objectID)
+		return nil
+	}
+	if searchResult.TotalHits() == 0 {
+		errorLog.Printf("Found no hits for deleted document %s", objectID)
+		return nil
+	}
+	if searchResult.TotalHits() > 1 {
+		errorLog.Printf("Found multiple hits for deleted document %s", objectID)
+		return nil
+	}
+	hit := searchResult.Hits.Hits[0]
+	if hit.Source == nil {
+		errorLog.Printf("Source unavailable for deleted document %s", objectID)
+		return nil
+	}
+	var src map[string]interface{}
+	if err = json.Unmarshal(hit.Source, &src); err == nil {
+		src["_id"] = op.Id
+		return src
+	}
+	errorLog.Printf("Unable to unmarshal deleted document %s: %s", objectID, err)
+	return nil
+}
+
+func tsVersion(op *gtm.Op) int64 {
+	ts := op.Timestamp
+	t, i := int64(ts.T), int64(ts.I)
+	version := (t << 32) | i
+	if op.IsUpdate() {
+		version++
+	} else if op.IsDelete() {
+		version += 2
+	}
+	return version
+}
+
+func (ic *indexClient) deleteDataGolang(op *gtm.Op) (*monstachemap.DeletePluginOutput, error) {
+	input := &monstachemap.MapperPluginInput{
+		Document:    map[string]interface{}{"_id": op.Id},
+		Namespace:   op.Namespace,
+		Database:    op.GetDatabase(),
+		Collection:  op.GetCollection(),
+		Operation:   op.Operation,
+		MongoClient: ic.mongo,
+		Context:     pluginCtx,
+		Logger:      pluginLog,
+	}
+	return deletePlugin(input)
+}
+
+func (ic *indexClient) deleteDataJavascript(op *gtm.Op) (*monstachemap.DeletePluginOutput, error) {
+	env := deleteEnvs[op.Namespace]
+	if env == nil {
+		env = deleteEnvs[""]
+	}
+	if env == nil {
+		return nil, nil
+	}
+	arg := convertMapJavascript(map[string]interface{}{"_id": op.Id})
+	arg2 := op.Namespace
+	arg3 := scriptContext(op)
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	val, err := env.call(arg, arg2, arg3)
+	if err != nil {
+		if err = ic.onScriptError(env, op, err); err != nil {
+			return nil, err
+		} else if !env.errorPolicy.keepDocument() {
+			return &monstachemap.DeletePluginOutput{Skip: true}, nil
+		}
+		return nil, nil
+	}
+	if val.IsUndefined() || val.IsNull() {
+		return nil, nil
+	}
+	if val.IsBoolean() {
+		if keep, _ := val.ToBoolean(); !keep {
+			return &monstachemap.DeletePluginOutput{Skip: true}, nil
+		}
+		return nil, nil
+	}
+	if !val.IsObject() {
+		return nil, errors.New("Delete function must return an object, a boolean or nothing")
+	}
+	ex, err := val.Export()
+	if err != nil {
+		return nil, err
+	}
+	attrs, ok := ex.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Delete function must return an object, a boolean or nothing")
+	}
+	out := &monstachemap.DeletePluginOutput{}
+	if v, ok := attrs["index"]; ok {
+		out.Index = fmt.Sprintf("%v", v)
+	}
+	if v, ok := attrs["id"]; ok {
+		out.ID = opIDToString(&gtm.Op{Id: v})
+	}
+	if v, ok := attrs["routing"]; ok {
+		out.Routing = fmt.Sprintf("%v", v)
+	}
+	if v, ok := attrs["parent"]; ok {
+		out.Parent = fmt.Sprintf("%v", v)
+	}
+	if v, ok := attrs["skip"].(bool); ok {
+		out.Skip = v
+	}
+	return out, nil
+}
+
+// deleteData lets a plugin or script override where a document is deleted
+func (ic *indexClient) deleteData(op *gtm.Op) (*monstachemap.DeletePluginOutput, error) {
+	if deletePlugin != nil {
+		return ic.deleteDataGolang(op)
+	}
+	return ic.deleteDataJavascript(op)
+}
+
+// deleteTarget locates the Elasticsearch document of a MongoDB delete
+type deleteTarget struct {
+	id      string
+	index   string
+	routing string
+	parent  string
+}
+
+func (ic *indexClient) doDelete(op *gtm.Op) {
+	if op.IsDelete() {
+		ic.runScriptUpdates(op)
+	}
+	if ic.config.DeleteStrategy == ignoreDeleteStrategy {
+		return
+	}
+	objectID, indexType, meta := opIDToString(op), ic.mapIndex(op), &indexingMeta{}
+	if objectID == "" {
+		errorLog.Println("Unable to delete document due to empty _id value")
+		return
+	}
+	override, err := ic.deleteData(op)
+	if isFatal(err) {
+		ic.processErr(err)
+		return
+	} else if err != nil {
+		errorLog.Printf("Unable to apply delete hook for document %s: %s", objectID, err)
+		override = nil
+	}
+	if override != nil && override.Skip {
+		return
+	}
+	ic.deleteDerived(op, objectID)
+	target := &deleteTarget{id: objectID}
+	if override != nil {
+		if override.ID != "" {
+			target.id = override.ID
+		}
+		if override.Index != "" {
+			// the hook knows where the document lives so no lookup is needed
+			// but any metadata saved for the document must still be removed
+			if ic.config.DeleteStrategy == statefulDeleteStrategy || ic.savesTemplateMeta(indexType) {
+				ic.deleteIndexMeta(op.Namespace, objectID)
+			}
+			target.index = strings.ToLower(override.Index)
+			ic.addDelete(op, target, override)
+			return
+		}
+	}
+	// documents in templated indexes are found using their saved metadata
+	// and otherwise by searching for them unless the index can be computed
+	// from the _id
+	templated := indexType.template != nil
+	if templated && ic.config.DeleteStrategy != statefulDeleteStrategy {
+		if indexType.template.fromID() {
+			target.index = indexType.Index
+			ic.addDelete(op, target, override)
+			return
+		}
+		if ic.savesTemplateMeta(indexType) {
+			if tmeta := ic.getIndexMeta(op.Namespace, objectID); tmeta.Index != "" {
+				target.index = tmeta.Index
+				target.routing = tmeta.Routing
+				target.parent = tmeta.Parent
+				ic.addDelete(op, target, override)
+				return
+			}
+		}
+	}
+	if ic.config.DeleteStrategy == statefulDeleteStrategy {
+		if routingNamespaces[""] || routingNamespaces[op.Namespace] || templated {
+			meta = ic.getIndexMeta(op.Namespace, objectID)
+		}
+		target.index = indexType.Index
+		if meta.Index != "" {
+			target.index = meta.Index
+		}
+		target.routing = meta.Routing
+		target.parent = meta.Parent
+	} else if ic.config.DeleteStrategy == statelessDeleteStrategy ||
+		ic.config.DeleteStrategy == tombstoneDeleteStrategy {
+		if routingNamespaces[""] || routingNamespaces[op.Namespace] || templated {
+			ic.queueDelete(&pendingDelete{op: op, target: target, override: override})
+			return
+		} else {
+			target.index = indexType.Index
+		}
+	} else {
+		return
+	}
+	ic.addDelete(op, target, override)
+}
+
+// pendingDelete is a delete whose target index and routing must be found
+// by searching the delete index pattern or whose document must be archived.
+// Targets without an index need to be looked up.
+type pendingDelete struct {
+	op       *gtm.Op
+	target   *deleteTarget
+	override *monstachemap.DeletePluginOutput
+	flushed  chan bool
+}
+
+func pendingDeleteKey(op *gtm.Op) string {
+	return fmt.Sprintf("%s.%s", op.Namespace, opIDToString(op))
+}
+
+// queueDelete hands a delete to the delete lookup to be resolved in a batch.
+// The document is remembered as pending until the batch is resolved so that
+// writes to it are not overtaken by the delete.
+func (ic *indexClient) queueDelete(pd *pendingDelete) {
+	if ic.deleteC == nil {
+		ic.lookupDeletes([]*pendingDelete{pd})
+		return
+	}
+	key := pendingDeleteKey(pd.op)
+	ic.deleteMutex.Lock()
+	ic.deletesPending[key]++
+	ic.deleteMutex.Unlock()
+	ic.deleteC <- pd
+}
+
+func (ic *indexClient) deletesDone(batch []*pendingDelete) {
+	ic.deleteMutex.Lock()
+	defer ic.deleteMutex.Unlock()
+	for _, pd := range batch {
+		key := pendingDeleteKey(pd.op)
+		if n := ic.deletesPending[key]; n > 1 {
+			ic.deletesPending[key] = n - 1
+		} else if n == 1 {
+			delete(ic.deletesPending, key)
+		}
+	}
+}
+
+func (ic *indexClient) hasPendingDelete(op *gtm.Op) bool {
+	ic.deleteMutex.Lock()
+	defer ic.deleteMutex.Unlock()
+	return ic.deletesPending[pendingDeleteKey(op)] > 0
+}
+
+// flushDeletes resolves the pending deletes queued so far and waits until
+// their requests have been added to the bulk processor.  It is called
+// before a document with a pending delete is indexed again so that the
+// delete cannot remove the newer document.
+func (ic *indexClient) flushDeletes() {
+	done := make(chan bool)
+	ic.deleteC <- &pendingDelete{flushed: done}
+	<-done
+}
+
+// apply overrides the routing and parent of the target with those returned
+// by a delete hook
+func (target *deleteTarget) apply(override *monstachemap.DeletePluginOutput) {
+	if override == nil {
+		return
+	}
+	if override.Routing != "" {
+		target.routing = override.Routing
+	}
+	if override.Parent != "" {
+		target.parent = override.Parent
+	}
+}
+
+// archivesDeletes returns true if deleted documents are moved into an
+// archive index by the tombstone delete strategy
+func (ic *indexClient) archivesDeletes() bool {
+	return ic.config.DeleteStrategy == tombstoneDeleteStrategy && ic.config.Tombstone.ArchiveIndex != ""
+}
+
+// runDeleteLookup groups pending deletes so that their targets are found
+// with a single search per batch.  A batch is resolved when it is full,
+// when the batch window elapses or when a flush is requested.
+func (ic *indexClient) runDeleteLookup() {
+	size := ic.config.DeleteBatchSize
+	ticker := time.NewTicker(time.Duration(ic.config.DeleteBatchMillis) * time.Millisecond)
+	defer ticker.Stop()
+	var batch []*pendingDelete
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ic.lookupDeletes(batch)
+		ic.deletesDone(batch)
+		batch = nil
+	}
+	for {
+		select {
+		case pd, open := <-ic.deleteC:
+			if !open {
+				flush()
+				return
+			}
+			if pd.flushed != nil {
+				flush()
+				close(pd.flushed)
+				continue
+			}
+			batch = append(batch, pd)
+			if len(batch) >= size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// lookupDeletes finds the targets of a batch of deletes using a terms query
+// on _id and queues the deletes.  Deletes whose id is not found exactly once
+// are logged and dropped.  When delete protection is disabled the documents
+// are removed with a single delete by query instead.  Documents to archive
+// are archived together once their targets are known.
+func (ic *indexClient) lookupDeletes(batch []*pendingDelete) {
+	var lookups, archives []*pendingDelete
+	for _, pd := range batch {
+		if pd.target.index == "" {
+			lookups = append(lookups, pd)
+		} else {
+			archives = append(archives, pd)
+		}
+	}
+	defer func() {
+		ic.archiveDeletes(archives)
+	}()
+	if len(lookups) == 0 {
+		return
+	}
+	batch = lookups
+	var ids []interface{}
+	seen := make(map[string]bool)
+	for _, pd := range batch {
+		if !seen[pd.target.id] {
+			seen[pd.target.id] = true
+			ids = append(ids, pd.target.id)
+		}
+	}
+	termsQuery := elastic.NewTermsQuery("_id", ids...)
+	if ic.config.DisableDeleteProtection && ic.config.DeleteStrategy == statelessDeleteStrategy {
+		delete := ic.client.DeleteByQuery()
+		delete.Index(ic.config.DeleteIndexPattern)
+		delete.ProceedOnVersionConflict()
+		delete.Query(termsQuery)
+		deleteResult, err := delete.Do(context.Background())
+		if err != nil {
+			ic.processErr(err)
+		} else if len(deleteResult.Failures) > 0 {
+			errorLog.Printf(
+				"There were failures deleting %d documents using index pattern %s: %+v",
+				len(ids), ic.config.DeleteIndexPattern, deleteResult.Failures)
+		}
+		return
+	}
+	search := ic.client.Search()
+	search.FetchSource(false)
+	// room for duplicates so that ids which are not unique are detected
+	search.Size(len(ids) * 2)
+	search.Index(ic.config.DeleteIndexPattern)
+	search.Query(termsQuery)
+	searchResult, err := search.Do(context.Background())
+	if err != nil {
+		errorLog.Printf("Unable to delete %d documents: %s", len(ids), err)
+		return
+	}
+	hits := make(map[string][]*elastic.SearchHit)
+	if searchResult.Hits != nil {
+		for _, hit := range searchResult.Hits.Hits {
+			hits[hit.Id] = append(hits[hit.Id], hit)
+		}
+	}
+	for _, pd := range batch {
+		found := hits[pd.target.id]
+		if len(found) != 1 {
+			errorLog.Printf(
+				"Failed to find unique document %s for deletion using index pattern %s",
+				pd.target.id, ic.config.DeleteIndexPattern,
+			)
+			continue
+		}
+		hit := found[0]
+		pd.target.index = hit.Index
+		pd.target.routing = hit.Routing
+		pd.target.parent = hit.Parent
+		if ic.archivesDeletes() {
+			pd.target.apply(pd.override)
+			archives = append(archives, pd)
+		} else {
+			ic.addDelete(pd.op, pd.target, pd.override)
 		}
-		return
 	}
 }
 
-func (ic *indexClient) findDeletedSrcDoc(op *gtm.Op) map[string]interface{} {
-	objectID := opIDToString(op)
-	termQuery := elastic.NewTermQuery("_id", objectID)
-	search := ic.client.Search()
-	search.Size(1)
-	search.Index(ic.config.DeleteIndexPattern)
-	search.Query(termQuery)
-	searchResult, err := search.Do(context.Background())
-	if err != nil {
-		errorLog.Printf("Unable to find deleted document %s: %s", objectID, err)
-		return nil
+func (ic *indexClient) addDelete(op *gtm.Op, target *deleteTarget, override *monstachemap.DeletePluginOutput) {
+	target.apply(override)
+	if ic.archivesDeletes() {
+		// archived in batches so that the documents are read with a
+		// single flush and multi get
+		ic.queueDelete(&pendingDelete{op: op, target: target})
+		return
 	}
-	if searchResult.Hits == nil {
-		errorLog.Printf("Unable to find deleted document %s", objectID)
-		return nil
+	if ic.config.DeleteStrategy == tombstoneDeleteStrategy {
+		ic.addTombstone(op, target)
+		return
 	}
-	if searchResult.TotalHits() == 0 {
-		errorLog.Printf("Found no hits for deleted document %s", objectID)
-		return nil
+	req := elastic.NewBulkDeleteRequest()
+	req.UseEasyJSON(ic.config.EnableEasyJSON)
+	req.Id(target.id)
+	req.Index(target.index)
+	if !ic.config.IndexAsUpdate {
+		req.Version(tsVersion(op))
+		req.VersionType("external")
 	}
-	if searchResult.TotalHits() > 1 {
-		errorLog.Printf("Found multiple hits for deleted document %s", objectID)
-		return nil
+	if target.routing != "" {
+		req.Routing(target.routing)
 	}
-	hit := searchResult.Hits.Hits[0]
-	if hit.Source == nil {
-		errorLog.Printf("Source unavailable for deleted document %s", objectID)
-		return nil
+	if target.parent != "" {
+		req.Parent(target.parent)
 	}
-	var src map[string]interface{}
-	if err = json.Unmarshal(hit.Source, &src); err == nil {
-		src["_id"] = op.Id
-		return src
+	ic.bulk.Add(req)
+}
+
+// tombstoneFields returns the fields set on documents deleted with the
+// tombstone delete strategy
+func (ic *indexClient) tombstoneFields(op *gtm.Op) map[string]interface{} {
+	t := time.Now().UTC()
+	if op.Timestamp.T > 0 {
+		t = time.Unix(int64(op.Timestamp.T), 0).UTC()
+	}
+	return map[string]interface{}{
+		ic.config.Tombstone.DeletedField:   true,
+		ic.config.Tombstone.DeletedAtField: t.Format(time.RFC3339),
 	}
-	errorLog.Printf("Unable to unmarshal deleted document %s: %s", objectID, err)
-	return nil
 }
 
-func tsVersion(op *gtm.Op) int64 {
-	ts := op.Timestamp
-	t, i := int64(ts.T), int64(ts.I)
-	version := (t << 32) | i
-	if op.IsUpdate() {
-		version++
-	} else if op.IsDelete() {
-		version += 2
+// addTimeMachineTombstone records the deletion of a document in the time
+// machine index of its namespace
+func (ic *indexClient) addTimeMachineTombstone(op *gtm.Op, target *deleteTarget, fields map[string]interface{}) {
+	if !tmNamespaces[op.Namespace] || !op.IsSourceOplog() {
+		return
 	}
-	return version
+	data := map[string]interface{}{"_source_id": target.id}
+	for k, v := range fields {
+		data[k] = v
+	}
+	req := elastic.NewBulkIndexRequest()
+	req.UseEasyJSON(ic.config.EnableEasyJSON)
+	req.Index(ic.timeMachineIndex(target.index))
+	req.Routing(target.id)
+	req.Doc(data)
+	ic.bulk.Add(req)
 }
 
-func (ic *indexClient) doDelete(op *gtm.Op) {
-	req := elastic.NewBulkDeleteRequest()
+// tombstoneRequest is a tombstone update.  The update does not upsert so
+// a target that is already gone fails with document_missing_exception,
+// which is expected and not reported as a bulk failure.
+type tombstoneRequest struct {
+	*elastic.BulkUpdateRequest
+}
+
+// missingTombstones returns the failed items of a bulk response whose
+// tombstone target no longer exists
+func missingTombstones(requests []elastic.BulkableRequest, response *elastic.BulkResponse) map[*elastic.BulkResponseItem]bool {
+	missing := make(map[*elastic.BulkResponseItem]bool)
+	for i, items := range response.Items {
+		if i >= len(requests) {
+			break
+		}
+		if _, ok := requests[i].(tombstoneRequest); !ok {
+			continue
+		}
+		for _, item := range items {
+			if item.Status == http.StatusNotFound && item.Error != nil && item.Error.Type == "document_missing_exception" {
+				missing[item] = true
+			}
+		}
+	}
+	return missing
+}
+
+// addTombstone marks the target document as deleted instead of removing it
+func (ic *indexClient) addTombstone(op *gtm.Op, target *deleteTarget) {
+	fields := ic.tombstoneFields(op)
+	ic.addTimeMachineTombstone(op, target, fields)
+	req := elastic.NewBulkUpdateRequest()
 	req.UseEasyJSON(ic.config.EnableEasyJSON)
-	if ic.config.DeleteStrategy == ignoreDeleteStrategy {
+	req.Id(target.id)
+	req.Index(target.index)
+	req.Doc(fields)
+	// the update API does not support external versions so concurrent
+	// writes to the document are retried instead
+	req.RetryOnConflict(tombstoneRetryOnConflict)
+	if target.routing != "" {
+		req.Routing(target.routing)
+	}
+	if target.parent != "" {
+		req.Parent(target.parent)
+	}
+	ic.bulk.Add(tombstoneRequest{req})
+}
+
+// archiveDeletes moves the documents of a batch of tombstone deletes into
+// the archive index.  Pending requests are flushed once for the batch so
+// that the latest sources are read with a single multi get.  The flush is
+// synchronous and holds the delete worker until every queued bulk request
+// has been sent, so its cost is paid once per delete batch, bounded by
+// delete-batch-size and delete-batch-millis, rather than once per document.
+func (ic *indexClient) archiveDeletes(batch []*pendingDelete) {
+	if len(batch) == 0 {
 		return
 	}
-	objectID, indexType, meta := opIDToString(op), ic.mapIndex(op), &indexingMeta{}
-	if objectID == "" {
-		errorLog.Println("Unable to delete document due to empty _id value")
-		return
+	if err := ic.bulk.Flush(); err != nil {
+		errorLog.Printf("Unable to flush before archiving %d documents: %s", len(batch), err)
 	}
-	req.Id(objectID)
-	if !ic.config.IndexAsUpdate {
-		req.Version(tsVersion(op))
-		req.VersionType("external")
+	mget := ic.client.Mget()
+	for _, pd := range batch {
+		item := elastic.NewMultiGetItem().Index(pd.target.index).Id(pd.target.id)
+		if pd.target.routing != "" {
+			item.Routing(pd.target.routing)
+		}
+		mget.Add(item)
 	}
-	if ic.config.DeleteStrategy == statefulDeleteStrategy {
-		if routingNamespaces[""] || routingNamespaces[op.Namespace] {
-			meta = ic.getIndexMeta(op.Namespace, objectID)
+	res, err := mget.Do(context.Background())
+	if err != nil {
+		errorLog.Printf("Unable to archive %d documents: %s", len(batch), err)
+		return
+	}
+	for i, pd := range batch {
+		if i >= len(res.Docs) {
+			break
 		}
-		req.Index(indexType.Index)
-		if meta.Index != "" {
-			req.Index(meta.Index)
+		op, target, got := pd.op, pd.target, res.Docs[i]
+		if !got.Found {
+			errorLog.Printf("Unable to archive document %s: not found in index %s", target.id, target.index)
+			continue
 		}
-		if meta.Routing != "" {
-			req.Routing(meta.Routing)
+		var doc map[string]interface{}
+		if err = json.Unmarshal(got.Source, &doc); err != nil {
+			errorLog.Printf("Unable to archive document %s: %s", target.id, err)
+			continue
 		}
-		if meta.Parent != "" {
-			req.Parent(meta.Parent)
+		fields := ic.tombstoneFields(op)
+		ic.addTimeMachineTombstone(op, target, fields)
+		for k, v := range fields {
+			doc[k] = v
 		}
-	} else if ic.config.DeleteStrategy == statelessDeleteStrategy {
-		if routingNamespaces[""] || routingNamespaces[op.Namespace] {
-			termQuery := elastic.NewTermQuery("_id", objectID)
-			if ic.config.DisableDeleteProtection {
-				delete := ic.client.DeleteByQuery()
-				delete.Index(ic.config.DeleteIndexPattern)
-				delete.ProceedOnVersionConflict()
-				delete.Query(termQuery)
-				deleteResult, err := delete.Do(context.Background())
-				if err != nil {
-					ic.processErr(err)
-				} else if len(deleteResult.Failures) > 0 {
-					errorLog.Printf(
-						"There were failures deleting document %s using index pattern %s: %+v",
-						objectID, ic.config.DeleteIndexPattern, deleteResult.Failures)
-				}
-				return
-			}
-			search := ic.client.Search()
-			search.FetchSource(false)
-			search.Size(1)
-			search.Index(ic.config.DeleteIndexPattern)
-			search.Query(termQuery)
-			searchResult, err := search.Do(context.Background())
-			if err != nil {
-				errorLog.Printf("Unable to delete document %s: %s",
-					objectID, err)
-				return
-			}
-			if searchResult.Hits != nil && searchResult.TotalHits() == 1 {
-				hit := searchResult.Hits.Hits[0]
-				req.Index(hit.Index)
-				if hit.Routing != "" {
-					req.Routing(hit.Routing)
-				}
-				if hit.Parent != "" {
-					req.Parent(hit.Parent)
-				}
-			} else {
-				errorLog.Printf(
-					"Failed to find unique document %s for deletion using index pattern %s",
-					objectID, ic.config.DeleteIndexPattern,
-				)
-				return
-			}
-		} else {
-			req.Index(indexType.Index)
+		archive := ic.config.Tombstone.ArchiveIndex
+		archive = strings.ToLower(strings.Replace(archive, "{index}", target.index, -1))
+		ireq := elastic.NewBulkIndexRequest()
+		ireq.UseEasyJSON(ic.config.EnableEasyJSON)
+		ireq.Id(target.id)
+		ireq.Index(archive)
+		ireq.Doc(doc)
+		if target.routing != "" {
+			ireq.Routing(target.routing)
 		}
-	} else {
-		return
+		dreq := elastic.NewBulkDeleteRequest()
+		dreq.UseEasyJSON(ic.config.EnableEasyJSON)
+		dreq.Id(target.id)
+		dreq.Index(target.index)
+		if target.routing != "" {
+			dreq.Routing(target.routing)
+		}
+		if target.parent != "" {
+			dreq.Parent(target.parent)
+		}
+		if !ic.config.IndexAsUpdate {
+			ireq.Version(tsVersion(op))
+			ireq.VersionType("external")
+			dreq.Version(tsVersion(op))
+			dreq.VersionType("external")
+		}
+		ic.bulk.Add(ireq)
+		ic.bulk.Add(dreq)
 	}
-	ic.bulk.Add(req)
 }
 
 func logRotateDefaults() logRotate {
@@ -4210,7 +8529,7 @@ func (ctx *httpServerCtx) buildServer() {
 	})
 	if ctx.config.Stats {
 		mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
-			stats, err := json.MarshalIndent(ctx.bulk.Stats(), "", "    ")
+			stats, err := json.MarshalIndent(statsSnapshot(ctx.bulk), "", "    ")
 			if err == nil {
 				w.Header().Set("Content-Type", "application/json")
 				w.WriteHeader(200)
@@ -4333,7 +8652,68 @@ func (config *configOptions) makeShardInsertHandler() gtm.ShardInsertHandler {
 	}
 }
 
+// pushdownStages returns $match stages for the query filters marked for
+// pushdown which apply to ns.  For change streams the query is matched
+// against the fullDocument of inserts, updates and replaces only, and only
+// within the filter namespace.
+func pushdownStages(ns string, changeEvent bool) (stages []interface{}) {
+	var names []string
+	for name, qf := range queryFilters {
+		if qf.pushdown {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		qf := queryFilters[name]
+		if !changeEvent {
+			if name == "" || name == ns {
+				stages = append(stages, bson.M{"$match": qf.query.Document()})
+			}
+			continue
+		}
+		if name != "" && ns != "" && ns != name && !strings.HasPrefix(name, ns+".") {
+			continue
+		}
+		or := []interface{}{
+			bson.M{"operationType": bson.M{"$nin": []string{"insert", "update", "replace"}}},
+			qf.query.Prefixed("fullDocument."),
+		}
+		if name != "" {
+			parts := strings.SplitN(name, ".", 2)
+			or = append(or, bson.M{"ns.db": bson.M{"$ne": parts[0]}})
+			if len(parts) == 2 {
+				or = append(or, bson.M{"ns.coll": bson.M{"$ne": parts[1]}})
+			}
+		}
+		stages = append(stages, bson.M{"$match": bson.M{"$or": or}})
+	}
+	return
+}
+
 func buildPipe(config *configOptions) func(string, bool) ([]interface{}, error) {
+	pipe := buildScriptPipe(config)
+	hasPushdown := false
+	for _, qf := range queryFilters {
+		hasPushdown = hasPushdown || qf.pushdown
+	}
+	if !hasPushdown {
+		return pipe
+	}
+	return func(ns string, changeEvent bool) ([]interface{}, error) {
+		stages := pushdownStages(ns, changeEvent)
+		if pipe != nil {
+			more, err := pipe(ns, changeEvent)
+			if err != nil {
+				return nil, err
+			}
+			stages = append(stages, more...)
+		}
+		return stages, nil
+	}
+}
+
+func buildScriptPipe(config *configOptions) func(string, bool) ([]interface{}, error) {
 	if pipePlugin != nil {
 		return pipePlugin
 	} else if len(pipeEnvs) > 0 {
@@ -4345,7 +8725,7 @@ func buildPipe(config *configOptions) func(string, bool) ([]interface{}, error)
 				if env := pipeEnvs[ns]; env != nil {
 					env.lock.Lock()
 					defer env.lock.Unlock()
-					val, err := env.VM.Call("module.exports", ns, ns, changeEvent)
+					val, err := env.call(ns, changeEvent)
 					if err != nil {
 						return nil, err
 					}
@@ -4435,6 +8815,46 @@ func (ic *indexClient) setupFileIndexing() {
 	}
 }
 
+// setupDeleteMeta creates the compact index holding document metadata when
+// stateful deletes keep it in Elasticsearch.  Only the fields used to drop
+// metadata in bulk are indexed.
+func (ic *indexClient) setupDeleteMeta() {
+	if !ic.metaInElastic() {
+		return
+	}
+	ctx := context.Background()
+	index := ic.config.DeleteMetaIndex
+	exists, err := ic.client.IndexExists(index).Do(ctx)
+	if err != nil {
+		errorLog.Fatalf("Unable to check delete meta index %s: %s", index, err)
+	}
+	if exists {
+		return
+	}
+	stored := map[string]interface{}{"type": "keyword", "index": false, "doc_values": false}
+	body := map[string]interface{}{
+		"mappings": map[string]interface{}{
+			"dynamic": false,
+			"properties": map[string]interface{}{
+				"db":        map[string]interface{}{"type": "keyword"},
+				"namespace": map[string]interface{}{"type": "keyword"},
+				"id":        stored,
+				"routing":   stored,
+				"index":     stored,
+				"type":      stored,
+				"parent":    stored,
+				"pipeline":  stored,
+			},
+		},
+	}
+	if _, err = ic.client.CreateIndex(index).BodyJson(body).Do(ctx); err != nil {
+		var ee *elastic.Error
+		if !errors.As(err, &ee) || ee.Details == nil || ee.Details.Type != "resource_already_exists_exception" {
+			errorLog.Fatalf("Unable to create delete meta index %s: %s", index, err)
+		}
+	}
+}
+
 func (ic *indexClient) setupBulk() {
 	bulk, err := ic.newBulkProcessor(ic.client)
 	if err != nil {
@@ -4454,13 +8874,18 @@ func (ic *indexClient) setupBulk() {
 func (ic *indexClient) run() {
 	ic.startNotify()
 	ic.setupFileIndexing()
+	ic.setupDeleteMeta()
 	ic.setupBulk()
 	ic.startHTTPServer()
 	ic.startCluster()
+	ic.loadDerived()
 	ic.startRelate()
 	ic.startIndex()
 	ic.startDownload()
 	ic.startPostProcess()
+	ic.startDeleteLookup()
+	ic.startScriptUpdates()
+	ic.startArchiveRetention()
 	ic.clusterWait()
 	ic.startListen()
 	ic.startReadWait()
@@ -4484,6 +8909,16 @@ func (ic *indexClient) startDownload() {
 }
 
 func (ic *indexClient) startPostProcess() {
+	if processBatchPlugin != nil {
+		// a single batcher so that the batch size and window apply to all
+		// ops rather than to each post processor
+		ic.processWg.Add(1)
+		go func() {
+			defer ic.processWg.Done()
+			ic.runBatchProcessor()
+		}()
+		return
+	}
 	for i := 0; i < ic.config.PostProcessors; i++ {
 		ic.processWg.Add(1)
 		go func() {
@@ -4497,6 +8932,14 @@ func (ic *indexClient) startPostProcess() {
 	}
 }
 
+func (ic *indexClient) startDeleteLookup() {
+	ic.deleteWg.Add(1)
+	go func() {
+		defer ic.deleteWg.Done()
+		ic.runDeleteLookup()
+	}()
+}
+
 func (ic *indexClient) onExternalShutdown() {
 	ic.rwmutex.Lock()
 	defer ic.rwmutex.Unlock()
@@ -4528,17 +8971,34 @@ func (ic *indexClient) directReadChan() chan struct{} {
 }
 
 func (ic *indexClient) stopAllWorkers() {
-	infoLog.Println("Stopping all workers")
-	ic.gtmCtx.Stop()
-	<-ic.opsConsumed
-	close(ic.relateC)
-	ic.relateWg.Wait()
-	close(ic.fileC)
-	ic.fileWg.Wait()
-	close(ic.indexC)
-	ic.indexWg.Wait()
-	close(ic.processC)
-	ic.processWg.Wait()
+	ic.stopOnce.Do(func() {
+		infoLog.Println("Stopping all workers")
+		ic.gtmCtx.Stop()
+		if ic.stopDDL != nil {
+			ic.stopDDL()
+		}
+		if ic.stopArchives != nil {
+			ic.stopArchives()
+		}
+		<-ic.opsConsumed
+		close(ic.relateC)
+		ic.relateWg.Wait()
+		close(ic.fileC)
+		ic.fileWg.Wait()
+		close(ic.indexC)
+		ic.indexWg.Wait()
+		close(ic.deleteC)
+		ic.deleteWg.Wait()
+		close(ic.processC)
+		ic.processWg.Wait()
+		// a rename deletes the old index once its reindex task completes
+		infoLog.Println("Waiting for renames in progress")
+		ic.renameWg.Wait()
+		if ic.stopScriptUpdates != nil {
+			ic.stopScriptUpdates()
+			ic.scriptUpdateWg.Wait()
+		}
+	})
 }
 
 func (ic *indexClient) startReadWait() {
@@ -4771,9 +9231,18 @@ func (ic *indexClient) buildFilterArray() []gtm.OpFilter {
 		pluginFilter = filterWithPlugin(ic.mongo)
 		filterArray = append(filterArray, pluginFilter)
 	} else if len(filterEnvs) > 0 {
-		pluginFilter = filterWithScript()
+		pluginFilter = ic.filterWithScript()
 		filterArray = append(filterArray, pluginFilter)
 	}
+	if len(queryFilters) > 0 {
+		queryFilter := filterWithQuery()
+		filterArray = append(filterArray, queryFilter)
+		if pluginFilter != nil {
+			pluginFilter = gtm.ChainOpFilters(queryFilter, pluginFilter)
+		} else {
+			pluginFilter = queryFilter
+		}
+	}
 	if pluginFilter != nil {
 		ic.filter = pluginFilter
 	}
@@ -4910,6 +9379,7 @@ func (ic *indexClient) startListen() {
 
 	gtmOpts := ic.buildGtmOptions()
 	ic.gtmCtx = gtm.StartMulti(conns, gtmOpts)
+	ic.startDDLWatch(gtmOpts.NamespaceFilter)
 	if config.readShards() && !config.DisableChangeEvents {
 		ic.gtmCtx.AddShardListener(ic.mongoConfig, gtmOpts, config.makeShardInsertHandler())
 	}
@@ -4962,7 +9432,7 @@ func (ic *indexClient) nextStats() {
 			errorLog.Printf("Error indexing statistics: %s", err)
 		}
 	} else {
-		stats, err := json.Marshal(ic.bulk.Stats())
+		stats, err := json.Marshal(statsSnapshot(ic.bulk))
 		if err != nil {
 			errorLog.Printf("Unable to log statistics: %s", err)
 		} else {
@@ -5035,6 +9505,28 @@ func (ic *indexClient) eventLoop() {
 	if ic.config.Stats == false {
 		printStats.Stop()
 	}
+	// DDL events arrive on their own change stream so they are held until
+	// the main stream has passed their cluster time or has gone idle.  This
+	// keeps ops on a renamed collection from being indexed after the rename.
+	var ddlHeld []*gtm.Op
+	var opsSeen bool
+	ddlTicker := time.NewTicker(ddlIdleDuration)
+	defer ddlTicker.Stop()
+	releaseDDL := func(before *primitive.Timestamp) {
+		for len(ddlHeld) > 0 && !ic.failed.Load() {
+			op := ddlHeld[0]
+			if before != nil && primitive.CompareTimestamp(op.Timestamp, *before) >= 0 {
+				break
+			}
+			ddlHeld = ddlHeld[1:]
+			if err := ic.routeOp(op); err != nil {
+				ic.processErr(err)
+			}
+			if ic.config.Resume && !ic.failed.Load() {
+				ic.ddlTokens[op.ResumeToken.StreamID] = op.ResumeToken.ResumeToken
+			}
+		}
+	}
 	infoLog.Println("Listening for events")
 	ic.sigH.clientStartedC <- ic
 	for {
@@ -5046,7 +9538,7 @@ func (ic *indexClient) eventLoop() {
 			ic.shutdown(timeout)
 			return
 		case <-timestampTicker.C:
-			if !ic.enabled {
+			if !ic.enabled || ic.failed.Load() {
 				break
 			}
 			if ic.config.ResumeStrategy == tokenResumeStrategy {
@@ -5054,6 +9546,9 @@ func (ic *indexClient) eventLoop() {
 			} else {
 				ic.nextTimestamp()
 			}
+			if err = ic.saveDDLTokens(); err != nil {
+				ic.processErr(err)
+			}
 		case <-heartBeat.C:
 			if ic.config.ClusterName == "" {
 				break
@@ -5076,6 +9571,19 @@ func (ic *indexClient) eventLoop() {
 				break
 			}
 			ic.processErr(err)
+		case op := <-ic.ddlC:
+			if !ic.enabled || ic.failed.Load() {
+				break
+			}
+			ddlHeld = append(ddlHeld, op)
+			if primitive.CompareTimestamp(ic.lastTs, op.Timestamp) > 0 {
+				releaseDDL(&ic.lastTs)
+			}
+		case <-ddlTicker.C:
+			if !opsSeen {
+				releaseDDL(nil)
+			}
+			opsSeen = false
 		case op, open := <-ic.gtmCtx.OpC:
 			if !ic.enabled {
 				break
@@ -5087,7 +9595,14 @@ func (ic *indexClient) eventLoop() {
 				}
 				break
 			}
+			if ic.failed.Load() {
+				break
+			}
+			opsSeen = true
 			if op.IsSourceOplog() {
+				if len(ddlHeld) > 0 {
+					releaseDDL(&op.Timestamp)
+				}
 				ic.lastTs = op.Timestamp
 				if ic.config.ResumeStrategy == tokenResumeStrategy {
 					ic.tokens[op.ResumeToken.StreamID] = op.ResumeToken.ResumeToken
@@ -5159,6 +9674,7 @@ func (ic *indexClient) closeClient() {
 	if ic.bulkStats != nil {
 		ic.bulkStats.Close()
 	}
+	closePlugins()
 	if len(ic.config.DirectReadNs) > 0 {
 		ic.rwmutex.RLock()
 		if !ic.directReadsPending {
@@ -5345,8 +9861,198 @@ func buildElasticClient(config *configOptions) *elastic.Client {
 	return elasticClient
 }
 
+type testMappingEvent struct {
+	Namespace         string                 `bson:"namespace"`
+	Operation         string                 `bson:"operation"`
+	Source            string                 `bson:"source"`
+	Timestamp         primitive.Timestamp    `bson:"timestamp"`
+	Document          map[string]interface{} `bson:"document"`
+	UpdateDescription map[string]interface{} `bson:"updateDescription"`
+}
+
+type testMappingResult struct {
+	Line      int                    `json:"line"`
+	Namespace string                 `json:"namespace,omitempty"`
+	Operation string                 `json:"operation,omitempty"`
+	ID        string                 `json:"id,omitempty"`
+	Filtered  bool                   `json:"filtered,omitempty"`
+	Dropped   bool                   `json:"dropped,omitempty"`
+	Index     string                 `json:"index,omitempty"`
+	Meta      *indexingMeta          `json:"meta,omitempty"`
+	Document  map[string]interface{} `json:"document,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+func testMappingRegistry() *bsoncodec.Registry {
+	rb := bson.NewRegistryBuilder()
+	rb.RegisterTypeMapEntry(bsontype.DateTime, reflect.TypeOf(time.Time{}))
+	rb.RegisterTypeMapEntry(bsontype.EmbeddedDocument, reflect.TypeOf(map[string]interface{}{}))
+	rb.RegisterTypeMapEntry(bsontype.Array, reflect.TypeOf([]interface{}{}))
+	return rb.Build()
+}
+
+func parseTestMappingEvent(reg *bsoncodec.Registry, line []byte) (op *gtm.Op, err error) {
+	var event testMappingEvent
+	if err = bson.UnmarshalExtJSONWithRegistry(reg, line, false, &event); err != nil {
+		return
+	}
+	if event.Namespace == "" {
+		return nil, errors.New("Test event must specify a namespace")
+	}
+	if event.Operation == "" {
+		event.Operation = "i"
+	}
+	if event.Document == nil {
+		return nil, errors.New("Test event must specify a document")
+	}
+	if event.Document["_id"] == nil {
+		return nil, errors.New("Test event document must have an _id")
+	}
+	op = &gtm.Op{
+		Id:                event.Document["_id"],
+		Operation:         event.Operation,
+		Namespace:         event.Namespace,
+		Source:            gtm.OplogQuerySource,
+		Timestamp:         event.Timestamp,
+		UpdateDescription: event.UpdateDescription,
+	}
+	if event.Source == "direct" {
+		op.Source = gtm.DirectQuerySource
+	}
+	if op.Timestamp.T == 0 {
+		now := time.Now().UTC()
+		op.Timestamp = primitive.Timestamp{T: uint32(now.Unix())}
+	}
+	if op.IsDelete() {
+		op.Data = map[string]interface{}{"_id": op.Id}
+	} else {
+		op.Data = event.Document
+	}
+	return
+}
+
+func (ic *indexClient) testMappingOp(op *gtm.Op, filter gtm.OpFilter) (result *testMappingResult, err error) {
+	result = &testMappingResult{
+		Namespace: op.Namespace,
+		Operation: op.Operation,
+		ID:        opIDToString(op),
+	}
+	if op.IsDelete() {
+		result.Index = ic.mapIndex(op).Index
+		return
+	}
+	if filter != nil && !filter(op) {
+		result.Filtered = true
+		return
+	}
+	if err = ic.mapData(op); err != nil {
+		return
+	}
+	if op.Data == nil {
+		result.Dropped = true
+		return
+	}
+	meta := parseIndexMeta(op)
+	ic.prepareDataForIndexing(op)
+	result.Index = ic.mapIndex(op).Index
+	if meta.Index != "" {
+		result.Index = meta.Index
+	}
+	if meta.ID != "" {
+		result.ID = meta.ID
+	}
+	result.Meta = meta
+	result.Document = op.Data
+	return
+}
+
+func (ic *indexClient) runTestMapping(in io.Reader, out io.Writer) (failed bool) {
+	var filter gtm.OpFilter
+	if filterPlugin != nil {
+		filter = filterWithPlugin(nil)
+	} else if len(filterEnvs) > 0 {
+		filter = ic.filterWithScript()
+	}
+	if len(queryFilters) > 0 {
+		if filter != nil {
+			filter = gtm.ChainOpFilters(filterWithQuery(), filter)
+		} else {
+			filter = filterWithQuery()
+		}
+	}
+	reg := testMappingRegistry()
+	encoder := json.NewEncoder(out)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var result *testMappingResult
+		op, err := parseTestMappingEvent(reg, line)
+		if err == nil {
+			result, err = ic.testMappingOp(op, filter)
+		}
+		if err != nil {
+			failed = true
+			result = &testMappingResult{Error: err.Error()}
+			if op != nil {
+				result.Namespace, result.Operation = op.Namespace, op.Operation
+			}
+		}
+		result.Line = lineNum
+		if err = encoder.Encode(result); err != nil {
+			errorLog.Printf("Unable to print test mapping result for line %d: %s", lineNum, err)
+			failed = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errorLog.Printf("Unable to read test mapping input: %s", err)
+		failed = true
+	}
+	return
+}
+
+func testMapping() {
+	// keep stdout clean for the mapping results
+	infoLog.SetOutput(os.Stderr)
+	warnLog.SetOutput(os.Stderr)
+	statsLog.SetOutput(os.Stderr)
+	traceLog.SetOutput(os.Stderr)
+	config := mustConfig()
+	loadBuiltinFunctions(nil, config)
+	ic := &indexClient{
+		config: config,
+	}
+	var in io.Reader = os.Stdin
+	if config.TestMappingInput != "" && config.TestMappingInput != "-" {
+		f, err := os.Open(config.TestMappingInput)
+		if err != nil {
+			errorLog.Fatalf("Unable to open test mapping input: %s", err)
+		}
+		in = f
+	}
+	if ic.runTestMapping(in, os.Stdout) {
+		exitStatus = 1
+	}
+	if f, ok := in.(*os.File); ok && f != os.Stdin {
+		f.Close()
+	}
+	closePlugins()
+	os.Exit(exitStatus)
+}
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "test-mapping" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		testMapping()
+		return
+	}
+
 	config := mustConfig()
 
 	sh := &sigHandler{
@@ -5373,14 +10079,19 @@ func main() {
 		enabled:        true,
 		indexC:         make(chan *gtm.Op),
 		processC:       make(chan *gtm.Op),
+		deleteC:        make(chan *pendingDelete, config.DeleteBatchSize),
+		deletesPending: make(map[string]int),
+		deleteWg:       &sync.WaitGroup{},
 		fileC:          make(chan *gtm.Op),
 		relateC:        make(chan *gtm.Op, config.RelateBuffer),
 		statusReqC:     make(chan *statusRequest),
 		sigH:           sh,
 		tokens:         bson.M{},
+		ddlTokens:      bson.M{},
 		bulkBackoffC:   make(chan time.Duration),
 		bulkBackoff:    elastic.NewExponentialBackoff(1*time.Minute, 1*time.Hour),
 		bulkBackoffMax: 1 * time.Hour,
+		derivedCache:   lru.New(derivedCacheSize, 0),
 	}
 
 	ic.run()
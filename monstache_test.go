@@ -1,19 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/olivere/elastic/v7"
 	"github.com/rwynn/gtm/v2"
 	"github.com/rwynn/monstache/v6/monstachemap"
+	"github.com/rwynn/monstache/v6/pkg/lru"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -59,7 +70,10 @@ var elasticNoSniffConfig = elastic.SetSniff(false)
 
 func init() {
 	testing.Init()
-	fmt.Printf("MongoDB Url: %v\nElasticsearch Url: %v\n", mongoURL, elasticURL)
+	// stdout belongs to the protocol when running as a stdio plugin helper
+	if os.Getenv("MONSTACHE_STDIO_HELPER") != "1" {
+		fmt.Printf("MongoDB Url: %v\nElasticsearch Url: %v\n", mongoURL, elasticURL)
+	}
 
 	flag.IntVar(&delay, "delay", 3, "Delay between operations in seconds")
 	flag.Parse()
@@ -487,3 +501,1575 @@ func TestDropCollection(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestScriptContext(t *testing.T) {
+	op := &gtm.Op{
+		Id:        "1",
+		Operation: "u",
+		Namespace: "db.col.sub",
+		Source:    gtm.DirectQuerySource,
+		Timestamp: primitive.Timestamp{T: 10, I: 2},
+		Data: map[string]interface{}{
+			"fullDocumentBeforeChange": map[string]interface{}{"a": 1},
+		},
+	}
+	ctx := scriptContext(op)
+	if ctx["operation"] != "u" || ctx["source"] != "direct" {
+		t.Fatalf("Unexpected operation or source in context: %v", ctx)
+	}
+	if ctx["database"] != "db" || ctx["collection"] != "col.sub" {
+		t.Fatalf("Expected namespace split into db and col.sub: %v", ctx)
+	}
+	ts := ctx["timestamp"].(map[string]interface{})
+	if ts["t"] != int64(10) || ts["i"] != int64(2) {
+		t.Fatalf("Unexpected timestamp in context: %v", ts)
+	}
+	before, ok := ctx["fullDocumentBeforeChange"].(map[string]interface{})
+	if !ok || before["a"] != 1 {
+		t.Fatalf("Expected pre-image in context: %v", ctx)
+	}
+	op.Source = gtm.OplogQuerySource
+	ic := &indexClient{config: &configOptions{}}
+	ic.prepareDataForIndexing(op)
+	if _, ok := op.Data["fullDocumentBeforeChange"]; ok {
+		t.Fatalf("Expected pre-image stripped before indexing: %v", op.Data)
+	}
+	op.Data = nil
+	ctx = scriptContext(op)
+	if ctx["source"] != "oplog" || ctx["fullDocumentBeforeChange"] != nil {
+		t.Fatalf("Unexpected context without pre-image: %v", ctx)
+	}
+}
+
+func TestRunTestMapping(t *testing.T) {
+	ic := &indexClient{config: &configOptions{}}
+	in := bytes.NewBufferString(`{"namespace":"db.col","document":{"_id":{"$oid":"5fae4b4e4138d2fcf16cfd64"},"a":[1,{"b":2}]}}
+
+{"namespace":"db.col","operation":"d","document":{"_id":1}}
+{"operation":"i"}
+`)
+	var out bytes.Buffer
+	if !ic.runTestMapping(in, &out) {
+		t.Fatalf("Expected failure for invalid test event")
+	}
+	var results []testMappingResult
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var r testMappingResult
+		if err := decoder.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, r)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results but got %d", len(results))
+	}
+	if results[0].ID != "5fae4b4e4138d2fcf16cfd64" || results[0].Index != "db.col" {
+		t.Fatalf("Unexpected insert result: %+v", results[0])
+	}
+	if _, ok := results[0].Document["_id"]; ok {
+		t.Fatalf("Expected _id removed from indexed document")
+	}
+	if results[1].Line != 3 || results[1].Operation != "d" || results[1].Index != "db.col" {
+		t.Fatalf("Unexpected delete result: %+v", results[1])
+	}
+	if results[2].Error == "" {
+		t.Fatalf("Expected error for event without namespace")
+	}
+}
+
+func TestScriptTimeoutAndErrorPolicy(t *testing.T) {
+	s := &javascript{
+		Namespace: "db.col",
+		Script:    "module.exports = function(doc) { if (doc.loop) { while (true) {} } throw 'failed'; }",
+		Timeout:   "50ms",
+		OnError:   skipScriptErrorPolicy,
+	}
+	env := s.newExecutionEnv(".")
+	if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.VM.Run(env.Script); err != nil {
+		t.Fatal(err)
+	}
+	_, err := env.call(map[string]interface{}{"loop": true})
+	if err == nil || !strings.Contains(err.Error(), errScriptTimeout.Error()) {
+		t.Fatalf("Expected script timeout error but got %v", err)
+	}
+	if _, err = env.call(map[string]interface{}{}); err == nil {
+		t.Fatalf("Expected script error after a timeout")
+	}
+	mapEnvs["db.col"] = env
+	defer delete(mapEnvs, "db.col")
+	ic := &indexClient{config: &configOptions{}}
+	op := &gtm.Op{Id: 1, Operation: "i", Namespace: "db.col", Data: map[string]interface{}{"a": 1}}
+	if err = ic.mapDataJavascript(op); err != nil {
+		t.Fatalf("Expected error handled by skip policy: %s", err)
+	}
+	if meta := parseIndexMeta(op); !meta.Skip {
+		t.Fatalf("Expected document to be skipped")
+	}
+	env.errorPolicy = indexScriptErrorPolicy
+	op.Data = map[string]interface{}{"a": 1}
+	if err = ic.mapDataJavascript(op); err != nil || op.Data["a"] != 1 {
+		t.Fatalf("Expected unmapped document to be indexed: %v %v", err, op.Data)
+	}
+	env.errorPolicy = defaultScriptErrorPolicy
+	if err = ic.mapDataJavascript(op); err == nil {
+		t.Fatalf("Expected script error without a policy")
+	}
+	if isFatal(err) {
+		t.Fatalf("Expected script error without a policy to not be fatal")
+	}
+	env.errorPolicy = failScriptErrorPolicy
+	if err = ic.mapDataJavascript(op); !isFatal(err) {
+		t.Fatalf("Expected fatal error for fail policy but got %v", err)
+	}
+	if err = scriptErrorPolicy("unknown").validate(); err == nil {
+		t.Fatalf("Expected invalid policy error")
+	}
+}
+
+func TestScriptRequire(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(dir+"/lib/util", 0755); err != nil {
+		t.Fatal(err)
+	}
+	common := "var calls = 0; module.exports = { inc: function() { return ++calls; }, upper: require('./util/fmt').upper };"
+	format := "exports.upper = require('../upper').upper;"
+	upper := "exports.upper = function(s) { return s.toUpperCase(); };"
+	if err := ioutil.WriteFile(dir+"/lib/util/fmt.js", []byte(format), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/lib/common.js", []byte(common), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/lib/upper.js", []byte(upper), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &javascript{Namespace: "db.col"}
+	env := s.newExecutionEnv(dir)
+	val, err := env.VM.Run("var a = require('./lib/common.js'); var b = require('./lib/common'); a.inc(); b.inc() + a.upper('x')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val.String() != "2X" {
+		t.Fatalf("Expected module loaded once per VM but got %s", val.String())
+	}
+	if val, err = env.VM.Run("require('lib/util/fmt') === require('./lib/util/fmt.js')"); err != nil || val.String() != "true" {
+		t.Fatalf("Expected bare module names to resolve against the module directory")
+	}
+	if _, err = env.VM.Run("require('../outside.js')"); err == nil {
+		t.Fatalf("Expected error requiring a module outside of the module directory")
+	}
+	if _, err = env.VM.Run("require('./missing.js')"); err == nil {
+		t.Fatalf("Expected error requiring a missing module")
+	}
+}
+
+func TestScriptLibraryFunctions(t *testing.T) {
+	s := &javascript{Namespace: "db.col"}
+	env := s.newExecutionEnv(".")
+	run := func(script string) string {
+		val, err := env.VM.Run(script)
+		if err != nil {
+			t.Fatalf("Error running %s: %s", script, err)
+		}
+		return val.String()
+	}
+	if r := run("sha1('abc')"); r != "a9993e364706816aba3e25717850c26c9cd0d89d" {
+		t.Fatalf("Unexpected sha1 %s", r)
+	}
+	if r := run("sha256('abc')"); r != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Fatalf("Unexpected sha256 %s", r)
+	}
+	if r := run("hmac('sha256', 'key', 'The quick brown fox jumps over the lazy dog')"); r != "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8" {
+		t.Fatalf("Unexpected hmac %s", r)
+	}
+	if r := run("uuid()"); len(r) != 36 || r[14] != '4' {
+		t.Fatalf("Unexpected uuid %s", r)
+	}
+	if r := run("objectIdTime('5fae4b4e4138d2fcf16cfd64').toISOString()"); r != "2020-11-13T09:01:02.000Z" {
+		t.Fatalf("Unexpected objectId time %s", r)
+	}
+	if r := run("objectIdFromTime(objectIdTime('5fae4b4e4138d2fcf16cfd64'))"); r != "5fae4b4e0000000000000000" {
+		t.Fatalf("Unexpected objectId from time %s", r)
+	}
+	if r := run("formatDate(parseDate('2021-03-04 05:06', '2006-01-02 15:04', 'America/New_York'), '2006-01-02T15:04Z07:00')"); r != "2021-03-04T10:06Z" {
+		t.Fatalf("Unexpected date conversion %s", r)
+	}
+	if r := run("formatDate(parseDate('2021-03-04T10:06:00Z'), '15:04 MST', 'Europe/Paris')"); r != "11:06 CET" {
+		t.Fatalf("Unexpected date format %s", r)
+	}
+	run("incCounter('test.counter'); incCounter('test.counter', 2)")
+	if c := counters.snapshot()["test.counter"]; c != 3 {
+		t.Fatalf("Expected counter value of 3 but got %d", c)
+	}
+	if r := run("binDataFromUUID('not-a-uuid')"); r != "null" {
+		t.Fatalf("Expected null for invalid uuid but got %s", r)
+	}
+	if err := env.VM.Set("stringFromBinData", jsStringFromBinData); err != nil {
+		t.Fatal(err)
+	}
+	if r := run("var id = uuid(); stringFromBinData(binDataFromUUID(id)) === id"); r != "true" {
+		t.Fatalf("Expected uuid to round trip through binDataFromUUID and stringFromBinData")
+	}
+}
+
+func TestFindCache(t *testing.T) {
+	s := &javascript{Namespace: "db.col", CacheSize: 10, CacheTTL: "1m"}
+	env := s.newExecutionEnv(".")
+	fa := &findConf{name: "findOne", vm: env.VM, ns: "db.col"}
+	env.setFindCache(fa)
+	if !fa.cacheEnabled || fa.cacheTTL != time.Minute {
+		t.Fatalf("Expected cache to be enabled with a ttl of 1m")
+	}
+	fc := &findCall{config: fa, db: "db", col: "lookup", query: map[string]interface{}{"code": "a"}, useCache: true}
+	key, err := fc.cacheKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa.cache.Add(key, map[string]interface{}{"name": "alpha"})
+	val, err := fc.execute()
+	if err != nil {
+		t.Fatalf("Expected cached lookup but got %s", err)
+	}
+	obj := val.Object()
+	if name, _ := obj.Get("name"); name.String() != "alpha" {
+		t.Fatalf("Unexpected cached value %v", name)
+	}
+	obj.Set("name", "changed")
+	if cached, _ := fa.cache.Get(key); cached.(map[string]interface{})["name"] != "alpha" {
+		t.Fatalf("Expected cached document to be unchanged")
+	}
+	fc.query = map[string]interface{}{"code": "b"}
+	key, _ = fc.cacheKey()
+	fa.cache.Add(key, nil)
+	if _, err = fc.execute(); err != mongo.ErrNoDocuments {
+		t.Fatalf("Expected cached miss to return ErrNoDocuments but got %v", err)
+	}
+	oid, _ := primitive.ObjectIDFromHex("5fae4b4e4138d2fcf16cfd64")
+	fc.query = oid
+	oidKey, _ := fc.cacheKey()
+	fc.query = oid.Hex()
+	if hexKey, _ := fc.cacheKey(); hexKey == oidKey {
+		t.Fatalf("Expected different cache keys for an ObjectId and its hex string")
+	}
+	fc = &findCall{config: fa}
+	if err = fc.setCache(map[string]interface{}{"cacheTTL": "5s"}); err != nil {
+		t.Fatal(err)
+	}
+	if !fc.useCache || fc.cacheTTL != 5*time.Second {
+		t.Fatalf("Expected cacheTTL option to enable caching")
+	}
+	if err = fc.setCache(map[string]interface{}{"cache": "yes"}); err == nil {
+		t.Fatalf("Expected error for invalid cache option")
+	}
+}
+
+func TestStdioPlugin(t *testing.T) {
+	plugin := &monstachemap.StdioPlugin{
+		Map: func(input *monstachemap.MapperPluginInput) (*monstachemap.MapperPluginOutput, error) {
+			doc := input.Document
+			doc["ns"] = input.Namespace
+			return &monstachemap.MapperPluginOutput{Document: doc, Index: "mapped"}, nil
+		},
+		Filter: func(input *monstachemap.MapperPluginInput) (bool, error) {
+			if input.Document["bad"] == true {
+				return false, errors.New("bad document")
+			}
+			return input.Document["keep"] == true, nil
+		},
+	}
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	go plugin.Serve(reqR, respW)
+	defer reqW.Close()
+	sp := newStdioPlugin("test", nil, 0)
+	sp.writer = bufio.NewWriter(reqW)
+	sp.reader = bufio.NewReader(respR)
+	hello, err := sp.call(monstachemap.StdioHello, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hello.Methods, []string{"map", "filter"}) {
+		t.Fatalf("Unexpected methods %v", hello.Methods)
+	}
+	created := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	in := &monstachemap.StdioInput{
+		Namespace: "db.col",
+		Document: map[string]interface{}{
+			"_id":     "1",
+			"created": created,
+			"nested":  map[string]interface{}{"tags": []interface{}{"a", "b"}},
+		},
+	}
+	out, err := sp.call(monstachemap.StdioMap, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped := out.Map.MapperPluginOutput()
+	if mapped.Index != "mapped" || mapped.Document["ns"] != "db.col" {
+		t.Fatalf("Unexpected map output %v", mapped)
+	}
+	if c, ok := mapped.Document["created"].(time.Time); !ok || !c.Equal(created) {
+		t.Fatalf("Expected created time to round trip but got %v", mapped.Document["created"])
+	}
+	if tags := mapped.Document["nested"].(map[string]interface{})["tags"].([]interface{}); len(tags) != 2 {
+		t.Fatalf("Unexpected nested tags %v", tags)
+	}
+	out, err = sp.call(monstachemap.StdioFilter, &monstachemap.StdioInput{Document: map[string]interface{}{"keep": true}})
+	if err != nil || !out.Filter {
+		t.Fatalf("Expected document to be kept: %v", err)
+	}
+	if _, err = sp.call(monstachemap.StdioFilter, &monstachemap.StdioInput{Document: map[string]interface{}{"bad": true}}); err == nil || err.Error() != "bad document" {
+		t.Fatalf("Expected plugin error but got %v", err)
+	}
+	if _, err = sp.call(monstachemap.StdioProcess, &monstachemap.StdioInput{}); err == nil {
+		t.Fatalf("Expected error for unimplemented method")
+	}
+}
+
+// TestStdioPluginHelper is not a real test.  It serves a stdio plugin when
+// started as a subprocess by TestStdioPluginRestart.
+func TestStdioPluginHelper(t *testing.T) {
+	if os.Getenv("MONSTACHE_STDIO_HELPER") != "1" {
+		return
+	}
+	var settings map[string]interface{}
+	monstachemap.ServeStdio(&monstachemap.StdioPlugin{
+		Init: func(s map[string]interface{}) error {
+			settings = s
+			return nil
+		},
+		Map: func(input *monstachemap.MapperPluginInput) (*monstachemap.MapperPluginOutput, error) {
+			if input.Document["crash"] == true {
+				os.Exit(1)
+			}
+			return &monstachemap.MapperPluginOutput{Document: map[string]interface{}{"env": settings["env"]}}, nil
+		},
+	})
+	os.Exit(0)
+}
+
+func TestStdioPluginRestart(t *testing.T) {
+	t.Setenv("MONSTACHE_STDIO_HELPER", "1")
+	sp := newStdioPlugin(os.Args[0], []string{"-test.run=^TestStdioPluginHelper$"}, 10*time.Second)
+	defer sp.stop()
+	if _, err := sp.call(monstachemap.StdioHello, nil); err != nil {
+		t.Fatal(err)
+	}
+	settings := map[string]interface{}{"env": "test"}
+	if _, err := sp.call(monstachemap.StdioInit, &monstachemap.StdioInput{Settings: settings}); err != nil {
+		t.Fatal(err)
+	}
+	crash := &monstachemap.StdioInput{Document: map[string]interface{}{"crash": true}}
+	if _, err := sp.call(monstachemap.StdioMap, crash); err == nil {
+		t.Fatalf("Expected error when the plugin exits")
+	}
+	out, err := sp.call(monstachemap.StdioMap, &monstachemap.StdioInput{Document: map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env := out.Map.MapperPluginOutput().Document["env"]; env != "test" {
+		t.Fatalf("Expected restarted plugin to be initialized with settings but got %v", env)
+	}
+}
+
+func TestStdioPluginTimeout(t *testing.T) {
+	sp := newStdioPlugin("sh", []string{"-c", "exec sleep 10"}, 100*time.Millisecond)
+	defer sp.stop()
+	start := time.Now()
+	_, err := sp.call(monstachemap.StdioHello, nil)
+	if err == nil || !strings.Contains(err.Error(), "within") {
+		t.Fatalf("Expected timeout error but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected plugin call to time out but it took %s", elapsed)
+	}
+	if sp.cmd != nil || sp.writer != nil {
+		t.Fatalf("Expected plugin process to be killed after a timeout")
+	}
+}
+
+func TestDerivedDocuments(t *testing.T) {
+	config := &configOptions{
+		Script: []javascript{{
+			Namespace: "shop.orders",
+			Script: `module.exports = function(doc) {
+				doc._meta_monstache = {documents: doc.items.map(function(item, i) {
+					return {index: "Order_Items", id: doc._id + "-" + i, routing: doc._id, document: item};
+				})};
+				return doc;
+			}`,
+		}},
+	}
+	config.loadScripts()
+	defer delete(mapEnvs, "shop.orders")
+	ic := &indexClient{config: config}
+	op := &gtm.Op{
+		Id:        "o1",
+		Operation: "i",
+		Namespace: "shop.orders",
+		Data: map[string]interface{}{
+			"_id":   "o1",
+			"items": []interface{}{map[string]interface{}{"sku": "a"}, map[string]interface{}{"sku": "b"}},
+		},
+	}
+	if err := ic.mapData(op); err != nil {
+		t.Fatal(err)
+	}
+	meta := parseIndexMeta(op)
+	if len(meta.Documents) != 2 {
+		t.Fatalf("Expected 2 derived documents but got %d", len(meta.Documents))
+	}
+	d := meta.Documents[1]
+	if d.ID != "o1-1" || d.Index != "Order_Items" || d.Routing != "o1" || d.Document["sku"] != "b" {
+		t.Fatalf("Unexpected derived document %+v", d)
+	}
+	if _, err := parseDerivedDocuments([]interface{}{map[string]interface{}{"document": map[string]interface{}{}}}); err == nil {
+		t.Fatalf("Expected error for derived document without id")
+	}
+	if _, err := parseDerivedDocuments("bad"); err == nil {
+		t.Fatalf("Expected error for invalid derived documents")
+	}
+	// only namespaces with derived documents are looked up and lookups are
+	// served from the cache when possible
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1:1").SetServerSelectionTimeout(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.mongo = client
+	ic.derivedCache = lru.New(10, 0)
+	other := &gtm.Op{Id: "p1", Operation: "u", Namespace: "shop.products", Data: map[string]interface{}{"_id": "p1"}}
+	if err = ic.indexDerived(other, &indexingMeta{}); err != nil {
+		t.Fatalf("Expected no lookup in a namespace without derived documents but got %s", err)
+	}
+	ic.derivedNs.Store("shop.orders", true)
+	ic.derivedCache.Add("shop.orders.o2", []derivedRef(nil))
+	plain := &gtm.Op{Id: "o2", Operation: "u", Namespace: "shop.orders", Data: map[string]interface{}{"_id": "o2"}}
+	if err = ic.indexDerived(plain, &indexingMeta{}); err != nil {
+		t.Fatalf("Expected cached lookup for a document without derived documents but got %s", err)
+	}
+	if err = ic.indexDerived(op, &indexingMeta{}); err == nil {
+		t.Fatalf("Expected lookup for an uncached document")
+	}
+}
+
+func TestStdioPluginLifecycle(t *testing.T) {
+	var settings map[string]interface{}
+	closed := false
+	plugin := &monstachemap.StdioPlugin{
+		Init: func(s map[string]interface{}) error {
+			settings = s
+			return nil
+		},
+		Close: func() error {
+			closed = true
+			return nil
+		},
+	}
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	go plugin.Serve(reqR, respW)
+	defer reqW.Close()
+	sp := newStdioPlugin("test", nil, 0)
+	sp.writer = bufio.NewWriter(reqW)
+	sp.reader = bufio.NewReader(respR)
+	hello, err := sp.call(monstachemap.StdioHello, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hello.Methods, []string{"init", "close"}) {
+		t.Fatalf("Unexpected methods %v", hello.Methods)
+	}
+	in := &monstachemap.StdioInput{Settings: map[string]interface{}{"url": "http://localhost", "size": int64(10)}}
+	if _, err = sp.call(monstachemap.StdioInit, in); err != nil {
+		t.Fatal(err)
+	}
+	if settings["url"] != "http://localhost" || settings["size"] != int64(10) {
+		t.Fatalf("Unexpected plugin settings %v", settings)
+	}
+	if _, err = sp.call(monstachemap.StdioClose, nil); err != nil || !closed {
+		t.Fatalf("Expected plugin to be closed: %v", err)
+	}
+}
+
+func TestDeleteHook(t *testing.T) {
+	config := &configOptions{
+		DeleteScript: []javascript{{
+			Namespace: "db.col",
+			Script: `module.exports = function(doc, ns, ctx) {
+				if (doc._id === "keep") return false;
+				if (doc._id === "plain") return;
+				return {index: "Archive_" + ctx.collection, id: "x-" + doc._id, routing: doc._id};
+			}`,
+		}},
+	}
+	config.loadDeleteScripts()
+	defer delete(deleteEnvs, "db.col")
+	ic := &indexClient{config: config}
+	op := &gtm.Op{Id: "a", Operation: "d", Namespace: "db.col"}
+	out, err := ic.deleteData(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out == nil || out.Index != "Archive_col" || out.ID != "x-a" || out.Routing != "a" || out.Skip {
+		t.Fatalf("Unexpected delete override %+v", out)
+	}
+	op.Id = "keep"
+	if out, err = ic.deleteData(op); err != nil || out == nil || !out.Skip {
+		t.Fatalf("Expected delete to be skipped: %+v %v", out, err)
+	}
+	op.Id = "plain"
+	if out, err = ic.deleteData(op); err != nil || out != nil {
+		t.Fatalf("Expected no delete override: %+v %v", out, err)
+	}
+	op.Namespace = "db.other"
+	if out, err = ic.deleteData(op); err != nil || out != nil {
+		t.Fatalf("Expected no delete override for other namespace: %+v %v", out, err)
+	}
+}
+
+func TestBatchProcessor(t *testing.T) {
+	var batches [][]string
+	processBatchPlugin = func(inputs []*monstachemap.ProcessPluginInput) error {
+		var ids []string
+		for _, input := range inputs {
+			ids = append(ids, input.Document["_id"].(string))
+		}
+		batches = append(batches, ids)
+		return nil
+	}
+	defer func() { processBatchPlugin = nil }()
+	ic := &indexClient{
+		config:    &configOptions{ProcessBatchSize: 2, ProcessBatchSeconds: 60, PostProcessors: 4},
+		processC:  make(chan *gtm.Op),
+		processWg: &sync.WaitGroup{},
+	}
+	// batches are not split across the post processors
+	ic.startPostProcess()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		ic.processC <- &gtm.Op{Id: id, Operation: "i", Namespace: "db.col", Data: map[string]interface{}{"_id": id}}
+	}
+	close(ic.processC)
+	ic.processWg.Wait()
+	expected := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}
+	if !reflect.DeepEqual(batches, expected) {
+		t.Fatalf("Expected batches %v but got %v", expected, batches)
+	}
+}
+
+func TestIndexTemplate(t *testing.T) {
+	tmpl, err := parseIndexTemplate("Logs-{meta.createdAt:2006.01}-{_id:2006}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := tmpl.pattern(); p != "logs-*-*" {
+		t.Fatalf("Unexpected index pattern %s", p)
+	}
+	oid, _ := primitive.ObjectIDFromHex("5fae4b4e4138d2fcf16cfd64")
+	op := &gtm.Op{
+		Id:        oid,
+		Timestamp: primitive.Timestamp{T: uint32(time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC).Unix())},
+		Data: map[string]interface{}{
+			"meta": map[string]interface{}{"createdAt": monstachemap.Time{Time: time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)}},
+		},
+	}
+	index, fromDocument := tmpl.resolve(op)
+	if index != "logs-2021.03-2020" || !fromDocument {
+		t.Fatalf("Unexpected index %s resolved from document %v", index, fromDocument)
+	}
+	op.Data = map[string]interface{}{}
+	index, fromDocument = tmpl.resolve(op)
+	if index != "logs-2019.07-2020" || fromDocument {
+		t.Fatalf("Expected fallback to oplog time but got %s", index)
+	}
+	if tmpl, err = parseIndexTemplate("logs"); err != nil || tmpl != nil {
+		t.Fatalf("Expected no template for a static index")
+	}
+	if _, err = parseIndexTemplate("logs-{createdAt"); err == nil {
+		t.Fatalf("Expected error for unclosed placeholder")
+	}
+	if _, err = parseIndexTemplate("logs-{:2006}"); err == nil {
+		t.Fatalf("Expected error for missing field")
+	}
+	if tmpl, _ = parseIndexTemplate("Logs-{meta.createdAt:2006.01}-{_id:2006}"); tmpl.fromID() {
+		t.Fatalf("Expected template using document fields not to depend only on the _id")
+	}
+	// deletes compute indexes from the _id without saved metadata or searches
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"errors": false, "items": []}`)
+	}))
+	defer ts.Close()
+	client, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, err := client.BulkProcessor().Do(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, _ = parseIndexTemplate("logs-{_id:2006}")
+	if !tmpl.fromID() {
+		t.Fatalf("Expected template to depend only on the _id")
+	}
+	mapIndexTypes["db.logs"] = &indexMapping{Namespace: "db.logs", template: tmpl}
+	defer delete(mapIndexTypes, "db.logs")
+	ic := &indexClient{
+		config: &configOptions{DeleteStrategy: statelessDeleteStrategy, DeleteIndexPattern: "*"},
+		client: client,
+		bulk:   bp,
+	}
+	ic.doDelete(&gtm.Op{Id: oid, Operation: "d", Namespace: "db.logs", Timestamp: op.Timestamp})
+	if err = bp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || !strings.Contains(requests[0], `{"delete":{"_index":"logs-2020","_id":"5fae4b4e4138d2fcf16cfd64"`) {
+		t.Fatalf("Expected a single bulk delete from the computed index but got %v", requests)
+	}
+	// updates use the saved index under any strategy and move documents
+	requests = nil
+	if bp, err = client.BulkProcessor().Do(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, _ = parseIndexTemplate("events-{created:2006}")
+	mapIndexTypes["db.events"] = &indexMapping{Namespace: "db.events", template: tmpl}
+	defer delete(mapIndexTypes, "db.events")
+	ic.bulk = bp
+	ic.config.DeleteMetaStore = deleteMetaStoreElastic
+	ic.config.DeleteMetaIndex = "monstache.meta"
+	ic.queueMeta("db.events.e1", map[string]interface{}{"index": "events-2019"})
+	update := &gtm.Op{Id: "e1", Operation: "u", Namespace: "db.events", Timestamp: op.Timestamp,
+		Data: map[string]interface{}{"_id": "e1", "a": 1}}
+	if err = ic.doIndexing(update); err != nil {
+		t.Fatal(err)
+	}
+	update.Data = map[string]interface{}{"_id": "e1", "created": time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err = ic.doIndexing(update); err != nil {
+		t.Fatal(err)
+	}
+	if err = bp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Join(requests, "")
+	if !strings.Contains(body, `{"index":{"_index":"events-2019","_id":"e1"`) {
+		t.Fatalf("Expected update without the time field to use the saved index but got %v", requests)
+	}
+	if !strings.Contains(body, `{"delete":{"_index":"events-2019","_id":"e1"`) ||
+		!strings.Contains(body, `{"index":{"_index":"events-2021","_id":"e1"`) {
+		t.Fatalf("Expected document to move from the saved index but got %v", requests)
+	}
+}
+
+func TestPartialUpdate(t *testing.T) {
+	ic := &indexClient{config: &configOptions{IndexAsUpdate: true, IndexPartialUpdates: true}}
+	op := &gtm.Op{
+		Id:        "1",
+		Operation: "u",
+		Namespace: "db.col",
+		Source:    gtm.OplogQuerySource,
+		Data: map[string]interface{}{
+			"count": 2,
+			"stats": map[string]interface{}{"views": 10, "likes": 1},
+			"tags":  []interface{}{"a", "b"},
+		},
+		UpdateDescription: map[string]interface{}{
+			"updatedFields": map[string]interface{}{"count": 2, "stats.views": 10, "tags.1": "b"},
+			"removedFields": primitive.A{"old", "stats.shares"},
+		},
+	}
+	doc, removed, ok := ic.partialUpdate(op)
+	if !ok {
+		t.Fatalf("Expected partial update")
+	}
+	expected := map[string]interface{}{
+		"count": 2,
+		"stats": map[string]interface{}{"views": 10},
+		"tags":  []interface{}{"a", "b"},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatalf("Expected partial doc %v but got %v", expected, doc)
+	}
+	if !reflect.DeepEqual(removed, []string{"old", "stats.shares"}) {
+		t.Fatalf("Unexpected removed fields %v", removed)
+	}
+	op.UpdateDescription["updatedFields"] = map[string]interface{}{"missing.0": 1}
+	if _, _, ok = ic.partialUpdate(op); ok {
+		t.Fatalf("Expected full update when array field is missing from the document")
+	}
+	op.UpdateDescription["updatedFields"] = map[string]interface{}{"count": 2}
+	aggregations["db.col"] = &aggregation{Namespace: "db.col"}
+	_, _, ok = ic.partialUpdate(op)
+	delete(aggregations, "db.col")
+	if ok {
+		t.Fatalf("Expected full update for namespaces with an aggregation")
+	}
+	op.Source = gtm.DirectQuerySource
+	if _, _, ok = ic.partialUpdate(op); ok {
+		t.Fatalf("Expected full update for direct reads")
+	}
+}
+
+func TestScriptUpdateConfig(t *testing.T) {
+	var config configOptions
+	_, err := toml.Decode(`
+[[mapping]]
+namespace = "blog.comments"
+
+[[mapping.script-update]]
+index = "blog.posts"
+id = "{postId}"
+routing = "{author.id}"
+script = "ctx._source.comments += params.delta"
+params = { delta = 1, post = "{postId}", label = "post-{postId}" }
+operations = ["insert"]
+retry-on-conflict = 3
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Mapping) != 1 || len(config.Mapping[0].ScriptUpdates) != 1 {
+		t.Fatalf("Expected a mapping with a script update: %+v", config.Mapping)
+	}
+	su := config.Mapping[0].ScriptUpdates[0]
+	if err = su.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !su.appliesTo("insert") || su.appliesTo("delete") || su.RetryOnConflict != 3 {
+		t.Fatalf("Unexpected script update %+v", su)
+	}
+	postID, _ := primitive.ObjectIDFromHex("5fae4b4e4138d2fcf16cfd64")
+	op := &gtm.Op{
+		Id:        "c1",
+		Operation: "i",
+		Data: map[string]interface{}{
+			"postId": postID,
+			"author": map[string]interface{}{"id": 7},
+		},
+	}
+	target, err := su.resolve(0, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Index != "blog.posts" || target.ID != "5fae4b4e4138d2fcf16cfd64" || target.Routing != "7" {
+		t.Fatalf("Unexpected script update target %+v", target)
+	}
+	if target.Params["delta"] != int64(1) || target.Params["post"] != postID || target.Params["label"] != "post-5fae4b4e4138d2fcf16cfd64" {
+		t.Fatalf("Unexpected script update params %v", target.Params)
+	}
+	op.Data = map[string]interface{}{}
+	if _, err = su.resolve(0, op); err == nil {
+		t.Fatalf("Expected error when a template field is missing")
+	}
+	if err = (&scriptUpdate{Index: "a", ID: "b", Script: "c", Operations: []string{"i"}}).validate(); err == nil {
+		t.Fatalf("Expected error for invalid operation")
+	}
+	// only change events queue script updates
+	var bulk []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bulk = append(bulk, string(body))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"errors": false, "items": []}`)
+	}))
+	defer ts.Close()
+	client, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, err := client.BulkProcessor().Do(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapIndexTypes["blog.comments"] = &config.Mapping[0]
+	defer delete(mapIndexTypes, "blog.comments")
+	ic := &indexClient{config: &configOptions{}, bulk: bp}
+	data := map[string]interface{}{"postId": postID, "author": map[string]interface{}{"id": 7}}
+	ic.runScriptUpdates(&gtm.Op{Id: "c1", Operation: "i", Namespace: "blog.comments", Source: gtm.DirectQuerySource, Data: data})
+	if err = bp.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(bulk) != 0 {
+		t.Fatalf("Expected no script update for a direct read but got %v", bulk)
+	}
+	// documents skipped by a mapping do not queue script updates
+	skipped := map[string]interface{}{"postId": postID, "_meta_monstache": map[string]interface{}{"skip": true}}
+	if err = ic.doIndexing(&gtm.Op{Id: "c2", Operation: "i", Namespace: "blog.comments", Source: gtm.OplogQuerySource, Data: skipped}); err != nil {
+		t.Fatal(err)
+	}
+	ic.runScriptUpdates(&gtm.Op{Id: "c1", Operation: "i", Namespace: "blog.comments", Source: gtm.OplogQuerySource, Data: data})
+	if err = bp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(bulk) != 1 || !strings.Contains(bulk[0], `"update":{"_index":"blog.posts","_id":"5fae4b4e4138d2fcf16cfd64"`) {
+		t.Fatalf("Expected a script update for a change event but got %v", bulk)
+	}
+	// queued delete targets are forgotten when their collection is dropped
+	if ic.mongo, err = mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1:1").SetServerSelectionTimeout(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	ic.queueScriptUpdateTargets("blog.comments.c1", bson.M{"db": "blog", "namespace": "blog.comments"})
+	ic.queueScriptUpdateTargets("blog.likes.l1", bson.M{"db": "blog", "namespace": "blog.likes"})
+	ic.dropScriptUpdates("namespace", "blog.comments")
+	if _, ok := ic.scriptUpdateDocs["blog.comments.c1"]; ok || len(ic.scriptUpdateDocs) != 1 {
+		t.Fatalf("Expected only the targets of the dropped collection to be removed: %v", ic.scriptUpdateDocs)
+	}
+}
+
+func TestAggregationPipeline(t *testing.T) {
+	stages, err := parseAggregationStages(`[
+		{"$lookup": {"from": "authors", "localField": "authorId", "foreignField": "_id", "as": "author"}},
+		{"$project": {"title": 1, "author.name": 1, "since": {"$gte": ["$created", {"$date": "2020-01-01T00:00:00Z"}]}}}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &aggregation{stages: stages}
+	pipeline := a.pipeline("p1")
+	if len(pipeline) != 3 {
+		t.Fatalf("Expected 3 stages but got %d", len(pipeline))
+	}
+	if !reflect.DeepEqual(pipeline[0], bson.M{"$match": bson.M{"_id": "p1"}}) {
+		t.Fatalf("Expected a match on _id first but got %v", pipeline[0])
+	}
+	if _, err = parseAggregationStages(`{"$match": {}}`); err == nil {
+		t.Fatalf("Expected error for pipeline that is not an array")
+	}
+}
+
+func TestIgnoreUpdate(t *testing.T) {
+	mapIndexTypes["test.heartbeat"] = &indexMapping{
+		Namespace:     "test.heartbeat",
+		IgnoreUpdates: []string{"lastSeenAt", "devices.*.seen"},
+	}
+	defer delete(mapIndexTypes, "test.heartbeat")
+	op := &gtm.Op{
+		Id:        "h1",
+		Operation: "u",
+		Namespace: "test.heartbeat",
+		Data:      map[string]interface{}{"name": "a"},
+		UpdateDescription: map[string]interface{}{
+			"updatedFields": map[string]interface{}{"lastSeenAt": 1, "devices.2.seen": 2},
+			"removedFields": []interface{}{"lastSeenAt.tz"},
+		},
+	}
+	if !ignoreUpdate(op) {
+		t.Fatalf("Expected update of ignored fields to be ignored")
+	}
+	op.UpdateDescription["removedFields"] = []interface{}{"devices.2.name"}
+	if ignoreUpdate(op) {
+		t.Fatalf("Expected update of a field outside the ignored set to be kept")
+	}
+	op.UpdateDescription = map[string]interface{}{}
+	if ignoreUpdate(op) {
+		t.Fatalf("Expected update without changed fields to be kept")
+	}
+	op.Operation = "i"
+	op.UpdateDescription = nil
+	if ignoreUpdate(op) {
+		t.Fatalf("Expected insert to be kept")
+	}
+	if matchFieldPath("devices.*.seen", "devices.seen") {
+		t.Fatalf("Expected shorter field not to match")
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	var config configOptions
+	_, err := toml.Decode(`
+[[filter]]
+namespace = "test.accounts"
+query = { status = "active", tenant = { "$in" = ["a", "b"] } }
+pushdown = true
+
+[[filter]]
+namespace = "test.events"
+query = '{"created": {"$gte": {"$date": "2021-01-01T00:00:00Z"}}}'
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.loadFilters()
+	defer func() {
+		queryFilters = make(map[string]*queryFilter)
+	}()
+	filter := filterWithQuery()
+	op := &gtm.Op{
+		Id:        "a1",
+		Operation: "i",
+		Namespace: "test.accounts",
+		Data:      map[string]interface{}{"status": "active", "tenant": "b"},
+	}
+	if !filter(op) {
+		t.Fatalf("Expected matching document to be kept")
+	}
+	op.Data["tenant"] = "c"
+	if filter(op) {
+		t.Fatalf("Expected document outside the query to be filtered")
+	}
+	op.Namespace = "test.other"
+	if !filter(op) {
+		t.Fatalf("Expected document in another namespace to be kept")
+	}
+	op.Namespace = "test.events"
+	op.Data = map[string]interface{}{"created": time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if filter(op) {
+		t.Fatalf("Expected old event to be filtered")
+	}
+	if stages := pushdownStages("test.accounts", false); len(stages) != 1 {
+		t.Fatalf("Expected direct read pushdown stage but got %v", stages)
+	}
+	if stages := pushdownStages("test.events", false); len(stages) != 0 {
+		t.Fatalf("Expected no pushdown for filter without pushdown but got %v", stages)
+	}
+	if stages := pushdownStages("other", true); len(stages) != 0 {
+		t.Fatalf("Expected no change stream pushdown for another database but got %v", stages)
+	}
+	stages := pushdownStages("test", true)
+	if len(stages) != 1 {
+		t.Fatalf("Expected change stream pushdown stage but got %v", stages)
+	}
+	or := stages[0].(bson.M)["$match"].(bson.M)["$or"].([]interface{})
+	if _, found := or[1].(map[string]interface{})["fullDocument.status"]; !found || len(or) != 4 {
+		t.Fatalf("Unexpected change stream pushdown stage %v", or)
+	}
+}
+
+func TestOperationPolicy(t *testing.T) {
+	var config configOptions
+	_, err := toml.Decode(`
+[[operation-policy]]
+namespace = "audit.events"
+operations = ["insert", "update"]
+
+[[operation-policy]]
+namespace = "logs"
+operations = ["insert", "delete", "drop"]
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.loadOperationPolicies()
+	defer func() {
+		operationPolicies = make(map[string]*operationPolicy)
+	}()
+	if !allowsOperation("audit.events", "update") || allowsOperation("audit.events", "delete") {
+		t.Fatalf("Expected audit.events to allow only inserts and updates")
+	}
+	if !allowsOperation("audit.other", "delete") {
+		t.Fatalf("Expected namespace without a policy to allow deletes")
+	}
+	if allowsOperation("logs.app", "update") || !allowsOperation("logs.app", "delete") {
+		t.Fatalf("Expected database policy to apply to its collections")
+	}
+	if allowsDropDatabase("audit") || !allowsDropDatabase("logs") {
+		t.Fatalf("Expected drop of audit database to be excluded by its collection policy")
+	}
+	if err = (&operationPolicy{Namespace: "db.col"}).validate(); err == nil {
+		t.Fatalf("Expected error for a policy without operations")
+	}
+	if err = (&operationPolicy{Namespace: "db.col", Operations: []string{"upsert"}}).validate(); err == nil {
+		t.Fatalf("Expected error for an invalid operation")
+	}
+	// excluded operations are not sent to process plugins
+	processPlugin = func(*monstachemap.ProcessPluginInput) error { return nil }
+	defer func() { processPlugin = nil }()
+	ic := &indexClient{config: &configOptions{DeleteStrategy: ignoreDeleteStrategy}, processC: make(chan *gtm.Op, 1)}
+	if err = ic.routeOp(&gtm.Op{Id: "e1", Operation: "d", Namespace: "audit.events"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ic.processC) != 0 {
+		t.Fatalf("Expected excluded delete not to be processed")
+	}
+	if err = ic.routeOp(&gtm.Op{Id: "e1", Operation: "d", Namespace: "logs.app"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ic.processC) != 1 {
+		t.Fatalf("Expected allowed delete to be processed")
+	}
+	// soft deletes are indexed as updates when deletes are excluded
+	sdConfig := &configOptions{SoftDelete: []*softDelete{{Namespace: "audit.events", Field: "deletedAt"}}}
+	sdConfig.loadSoftDeletes()
+	defer func() {
+		softDeletes = make(map[string]*softDelete)
+	}()
+	ic.indexC = make(chan *gtm.Op, 1)
+	op := &gtm.Op{
+		Id:        "e1",
+		Operation: "u",
+		Namespace: "audit.events",
+		Source:    gtm.OplogQuerySource,
+		Data:      map[string]interface{}{"deletedAt": time.Now()},
+	}
+	if err = ic.routeData(op); err != nil {
+		t.Fatal(err)
+	}
+	if len(ic.indexC) != 1 {
+		t.Fatalf("Expected soft deleted update to be indexed when deletes are excluded")
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	var config configOptions
+	_, err := toml.Decode(`
+[[soft-delete]]
+namespace = "test.users"
+field = "deletedAt"
+
+[[soft-delete]]
+namespace = "test.orders"
+query = { state = "cancelled" }
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.loadSoftDeletes()
+	defer func() {
+		softDeletes = make(map[string]*softDelete)
+	}()
+	op := &gtm.Op{
+		Id:        "u1",
+		Operation: "u",
+		Namespace: "test.users",
+		Data:      map[string]interface{}{"name": "a", "deletedAt": time.Now()},
+	}
+	if !softDeleted(op) {
+		t.Fatalf("Expected document with deletedAt to be soft deleted")
+	}
+	op.Data["deletedAt"] = nil
+	if softDeleted(op) {
+		t.Fatalf("Expected document with deletedAt unset to be indexed")
+	}
+	op.Namespace = "test.orders"
+	op.Data = map[string]interface{}{"state": "cancelled"}
+	if !softDeleted(op) {
+		t.Fatalf("Expected cancelled order to be soft deleted")
+	}
+}
+
+func TestMissingTombstones(t *testing.T) {
+	tombstone := tombstoneRequest{elastic.NewBulkUpdateRequest().Index("db.col").Id("a")}
+	update := elastic.NewBulkUpdateRequest().Index("db.col").Id("b")
+	requests := []elastic.BulkableRequest{tombstone, update}
+	missing := func() *elastic.BulkResponseItem {
+		return &elastic.BulkResponseItem{
+			Index:  "db.col",
+			Status: http.StatusNotFound,
+			Error:  &elastic.ErrorDetails{Type: "document_missing_exception"},
+		}
+	}
+	response := &elastic.BulkResponse{
+		Errors: true,
+		Items: []map[string]*elastic.BulkResponseItem{
+			{"update": missing()},
+			{"update": missing()},
+		},
+	}
+	ignored := missingTombstones(requests, response)
+	if len(ignored) != 1 || !ignored[response.Items[0]["update"]] {
+		t.Fatalf("Expected only the missing tombstone target to be ignored")
+	}
+}
+
+func TestTombstoneFields(t *testing.T) {
+	var config configOptions
+	_, err := toml.Decode(`
+delete-strategy = 3
+
+[tombstone]
+deleted-at-field = "removedAt"
+archive-index = "archive-{index}"
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.setDefaults()
+	if config.DeleteStrategy != tombstoneDeleteStrategy || config.Tombstone.DeletedField != "_deleted" {
+		t.Fatalf("Unexpected tombstone config %+v", config.Tombstone)
+	}
+	ic := &indexClient{config: &config}
+	op := &gtm.Op{Id: "a", Operation: "d", Namespace: "db.col", Timestamp: primitive.Timestamp{T: 1600000000}}
+	fields := ic.tombstoneFields(op)
+	if fields["_deleted"] != true || fields["removedAt"] != "2020-09-13T12:26:40Z" {
+		t.Fatalf("Unexpected tombstone fields %v", fields)
+	}
+	// deletes are archived in batches with a single multi get
+	var mgets int
+	var bulk []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_mget"):
+			mgets++
+			fmt.Fprint(w, `{"docs": [
+				{"_index": "db.col", "_id": "a", "found": true, "_source": {"title": "a"}},
+				{"_index": "db.col", "_id": "b", "found": false}]}`)
+		case strings.HasSuffix(r.URL.Path, "/_bulk"):
+			bulk = append(bulk, string(body))
+			fmt.Fprint(w, `{"errors": false, "items": []}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	client, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, err := client.BulkProcessor().Do(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.DeleteBatchMillis = 60000
+	ic = &indexClient{
+		config:         &config,
+		client:         client,
+		bulk:           bp,
+		deleteC:        make(chan *pendingDelete, 2),
+		deletesPending: make(map[string]int),
+		deleteWg:       &sync.WaitGroup{},
+	}
+	ic.startDeleteLookup()
+	for _, id := range []string{"a", "b"} {
+		op := &gtm.Op{Id: id, Operation: "d", Namespace: "db.col", Timestamp: primitive.Timestamp{T: 1600000000}}
+		ic.addDelete(op, &deleteTarget{id: id, index: "db.col"}, nil)
+	}
+	close(ic.deleteC)
+	ic.deleteWg.Wait()
+	if err = bp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if mgets != 1 {
+		t.Fatalf("Expected a single multi get but got %d", mgets)
+	}
+	requests := strings.Join(bulk, "")
+	if !strings.Contains(requests, `{"index":{"_index":"archive-db.col","_id":"a"`) ||
+		!strings.Contains(requests, `"removedAt":"2020-09-13T12:26:40Z"`) ||
+		!strings.Contains(requests, `{"delete":{"_index":"db.col","_id":"a"`) {
+		t.Fatalf("Expected document a to be archived but got %s", requests)
+	}
+	if strings.Contains(requests, `"_id":"b"`) {
+		t.Fatalf("Expected missing document b not to be archived: %s", requests)
+	}
+}
+
+// newTestIndexClient returns an indexClient whose client and bulk processor
+// send requests to a test server running handler.  The caller closes the
+// server when done.
+func newTestIndexClient(t *testing.T, config *configOptions, handler http.HandlerFunc) (*indexClient, *httptest.Server) {
+	ts := httptest.NewServer(handler)
+	client, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	bp, err := client.BulkProcessor().Do(context.Background())
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	return &indexClient{config: config, client: client, bulk: bp}, ts
+}
+
+func TestBatchedDeleteLookup(t *testing.T) {
+	var searches int
+	var bulk []string
+	config := &configOptions{DeleteIndexPattern: "*", DeleteBatchSize: 10, DeleteBatchMillis: 60000}
+	ic, ts := newTestIndexClient(t, config, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/_search") {
+			searches++
+			if !strings.Contains(string(body), `"terms":{"_id":["a","b","c"]}`) {
+				t.Errorf("Expected a terms query on all ids but got %s", body)
+			}
+			fmt.Fprint(w, `{"hits": {"total": {"value": 4}, "hits": [
+				{"_index": "db.col", "_id": "a", "_routing": "r1"},
+				{"_index": "db.col", "_id": "b"},
+				{"_index": "db.col2", "_id": "c"},
+				{"_index": "db.col3", "_id": "c"}]}}`)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/_bulk") {
+			bulk = append(bulk, string(body))
+			fmt.Fprint(w, `{"errors": false, "items": []}`)
+			return
+		}
+		http.NotFound(w, r)
+	})
+	defer ts.Close()
+	ic.deleteC = make(chan *pendingDelete)
+	ic.deleteWg = &sync.WaitGroup{}
+	ic.startDeleteLookup()
+	for _, id := range []string{"a", "b", "c"} {
+		op := &gtm.Op{Id: id, Operation: "d", Namespace: "db.col", Timestamp: primitive.Timestamp{T: 1}}
+		ic.deleteC <- &pendingDelete{op: op, target: &deleteTarget{id: id}}
+	}
+	close(ic.deleteC)
+	ic.deleteWg.Wait()
+	if err := ic.bulk.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if searches != 1 {
+		t.Fatalf("Expected a single search but got %d", searches)
+	}
+	requests := strings.Join(bulk, "")
+	if !strings.Contains(requests, `"_id":"a"`) || !strings.Contains(requests, `"routing":"r1"`) || !strings.Contains(requests, `"_id":"b"`) {
+		t.Fatalf("Expected deletes of a and b but got %s", requests)
+	}
+	if strings.Contains(requests, `"_id":"c"`) {
+		t.Fatalf("Expected ambiguous document c not to be deleted: %s", requests)
+	}
+}
+
+func TestFlushDeletesBeforeInsert(t *testing.T) {
+	var searches int
+	config := &configOptions{DeleteIndexPattern: "*", DeleteBatchSize: 10, DeleteBatchMillis: 60000}
+	ic, ts := newTestIndexClient(t, config, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/_search") {
+			searches++
+			fmt.Fprint(w, `{"hits": {"total": {"value": 1}, "hits": [{"_index": "db.col", "_id": "a"}]}}`)
+			return
+		}
+		fmt.Fprint(w, `{"errors": false, "items": []}`)
+	})
+	defer ts.Close()
+	defer ic.bulk.Close()
+	ic.deleteC = make(chan *pendingDelete, 10)
+	ic.deletesPending = make(map[string]int)
+	ic.deleteWg = &sync.WaitGroup{}
+	ic.indexC = make(chan *gtm.Op, 1)
+	ic.startDeleteLookup()
+	// indexing a document with a pending delete resolves the batch first
+	for _, id := range []string{"a", "b"} {
+		op := &gtm.Op{Id: id, Operation: "d", Namespace: "db.col", Timestamp: primitive.Timestamp{T: 1}}
+		ic.queueDelete(&pendingDelete{op: op, target: &deleteTarget{id: id}})
+	}
+	insert := &gtm.Op{Id: "a", Operation: "i", Namespace: "db.col", Data: map[string]interface{}{"_id": "a"}}
+	if !ic.hasPendingDelete(insert) {
+		t.Fatalf("Expected delete of a to be pending")
+	}
+	if err := ic.routeData(insert); err != nil {
+		t.Fatal(err)
+	}
+	if searches != 1 || ic.hasPendingDelete(insert) {
+		t.Fatalf("Expected pending deletes to be resolved before indexing but got %d searches", searches)
+	}
+	if op := <-ic.indexC; op != insert {
+		t.Fatalf("Expected insert to be indexed after the pending deletes")
+	}
+	// documents without a pending delete are indexed without a flush
+	other := &gtm.Op{Id: "c", Operation: "i", Namespace: "db.col", Data: map[string]interface{}{"_id": "c"}}
+	if err := ic.routeData(other); err != nil {
+		t.Fatal(err)
+	}
+	if searches != 1 {
+		t.Fatalf("Expected no lookup for a document without a pending delete")
+	}
+	<-ic.indexC
+	close(ic.deleteC)
+	ic.deleteWg.Wait()
+}
+
+func TestElasticDeleteMeta(t *testing.T) {
+	var bulk []string
+	config := &configOptions{
+		DeleteStrategy:  statefulDeleteStrategy,
+		DeleteMetaStore: deleteMetaStoreElastic,
+		DeleteMetaIndex: "monstache-meta",
+	}
+	ic, ts := newTestIndexClient(t, config, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_bulk"):
+			bulk = append(bulk, string(body))
+			fmt.Fprint(w, `{"errors": false, "items": []}`)
+		case r.URL.Path == "/monstache-meta/_doc/db.col.a":
+			fmt.Fprint(w, `{"_index": "monstache-meta", "_id": "db.col.a", "found": true,
+				"_source": {"routing": "r1", "index": "Posts", "namespace": "db.col"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"found": false}`)
+		}
+	})
+	defer ts.Close()
+	if err := ic.setIndexMeta("db.col", "b", &indexingMeta{Routing: "r2"}); err != nil {
+		t.Fatal(err)
+	}
+	meta := ic.getIndexMeta("db.col", "a")
+	if meta.Routing != "r1" || meta.Index != "posts" {
+		t.Fatalf("Unexpected meta %+v", meta)
+	}
+	if _, found := ic.readIndexMeta("db.col", "missing"); found {
+		t.Fatalf("Expected missing meta not to be found")
+	}
+	// queued meta is read from memory without flushing
+	if meta, found := ic.readIndexMeta("db.col", "b"); !found || meta.Routing != "r2" {
+		t.Fatalf("Expected queued meta to be found but got %+v", meta)
+	}
+	if len(bulk) != 0 {
+		t.Fatalf("Expected no flush reading meta but got %v", bulk)
+	}
+	// pending meta is forgotten once its request is committed even when
+	// the bulk request failed without a response
+	written := []elastic.BulkableRequest{metaRequest{elastic.NewBulkIndexRequest(), "db.col.b"}}
+	ic.afterBulk()(1, written, nil, errors.New("bulk failed"))
+	if _, queued := ic.queuedMeta("db.col.b"); queued {
+		t.Fatalf("Expected written meta to be forgotten")
+	}
+	// a delete hook overriding the index still removes the saved meta
+	ic.config.DeleteScript = []javascript{{
+		Namespace: "db.col",
+		Script:    `module.exports = function(doc) { return {index: "archive"}; }`,
+	}}
+	ic.config.loadDeleteScripts()
+	defer delete(deleteEnvs, "db.col")
+	ic.doDelete(&gtm.Op{Id: "b", Operation: "d", Namespace: "db.col"})
+	if err := ic.bulk.Close(); err != nil {
+		t.Fatal(err)
+	}
+	requests := strings.Join(bulk, "")
+	if !strings.Contains(requests, `{"index":{"_index":"monstache-meta","_id":"db.col.b"}}`) ||
+		!strings.Contains(requests, `{"delete":{"_index":"monstache-meta","_id":"db.col.a"}}`) {
+		t.Fatalf("Expected meta to be saved and removed using bulk requests but got %s", requests)
+	}
+	if !strings.Contains(requests, `{"delete":{"_index":"monstache-meta","_id":"db.col.b"}}`) ||
+		!strings.Contains(requests, `{"delete":{"_index":"archive","_id":"b"`) {
+		t.Fatalf("Expected overridden delete to remove the saved meta but got %s", requests)
+	}
+}
+
+func TestRenameCollection(t *testing.T) {
+	op := renameOp("db.old", "db.new", primitive.Timestamp{T: 1})
+	if from, to, ok := renameOf(op); !ok || from != "db.old" || to != "db.new" {
+		t.Fatalf("Expected rename of db.old to db.new but got %s %s %v", from, to, ok)
+	}
+	if _, _, ok := renameOf(&gtm.Op{Operation: "c", Data: map[string]interface{}{"drop": "old"}}); ok {
+		t.Fatalf("Expected drop not to be a rename")
+	}
+	var requests []string
+	config := &configOptions{RenameStrategy: reindexRenameStrategy}
+	ic, ts := newTestIndexClient(t, config, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "HEAD":
+			w.WriteHeader(http.StatusOK)
+		case r.URL.Path == "/_reindex":
+			if r.URL.Query().Get("wait_for_completion") != "false" {
+				t.Errorf("Expected reindex not to wait for completion")
+			}
+			fmt.Fprint(w, `{"task": "node:1"}`)
+		case r.URL.Path == "/_tasks/node:1":
+			fmt.Fprint(w, `{"completed": true, "response": {"created": 2, "failures": []}}`)
+		case r.Method == "GET":
+			// the new index name is an alias of the old index
+			fmt.Fprint(w, `{"db.old": {"aliases": {"db.new": {}}}}`)
+		default:
+			fmt.Fprint(w, `{"acknowledged": true}`)
+		}
+	})
+	defer ts.Close()
+	defer ic.bulk.Close()
+	if err := ic.doRename("db.old", "db.new"); err != nil {
+		t.Fatal(err)
+	}
+	ic.renameWg.Wait()
+	all := strings.Join(requests, "\n")
+	if !strings.Contains(all, `"dest":{"index":"db.new","version_type":"external"}`) ||
+		!strings.Contains(all, `"source":{"index":"db.old"}`) || !strings.Contains(all, "DELETE /db.old") {
+		t.Fatalf("Expected reindex then delete of the old index but got %s", all)
+	}
+	// without versions the reindex only creates missing documents
+	requests = nil
+	ic.config.IndexAsUpdate = true
+	if err := ic.doRename("db.old", "db.new"); err != nil {
+		t.Fatal(err)
+	}
+	ic.renameWg.Wait()
+	if all = strings.Join(requests, "\n"); !strings.Contains(all, `"dest":{"index":"db.new","op_type":"create"}`) {
+		t.Fatalf("Expected reindex to create missing documents only but got %s", all)
+	}
+	// dropping the new collection deletes the index behind the alias
+	requests = nil
+	if err := ic.deleteIndex("db.new"); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || requests[0] != "GET /db.new " || requests[1] != "DELETE /db.old " {
+		t.Fatalf("Expected aliased index to be resolved and deleted but got %v", requests)
+	}
+}
+
+func TestArchiveDroppedIndex(t *testing.T) {
+	var requests []string
+	var failDelete bool
+	config := &configOptions{DropArchive: dropArchive{Mode: dropArchiveClone, Suffix: "2006"}}
+	ic, ts := newTestIndexClient(t, config, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET":
+			fmt.Fprint(w, `{"db.col": {}, "archived-db.col-20200101000000": {}}`)
+		case r.Method == "HEAD":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == "DELETE" && r.URL.Path == "/db.col" && failDelete:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": {"type": "illegal_argument_exception"}, "status": 400}`)
+		default:
+			fmt.Fprint(w, `{"acknowledged": true}`)
+		}
+	})
+	defer ts.Close()
+	defer ic.bulk.Close()
+	if err := ic.deleteIndex("db.col"); err != nil {
+		t.Fatal(err)
+	}
+	target := "archived-db.col-" + time.Now().UTC().Format("2006")
+	expected := []string{
+		"GET /db.col",
+		"PUT /db.col/_settings",
+		"POST /db.col/_clone/" + target,
+		"POST /_aliases",
+		"DELETE /db.col",
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("Expected %d requests but got %v", len(expected), requests)
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(requests[i], e+" ") {
+			t.Fatalf("Expected request %s but got %s", e, requests[i])
+		}
+	}
+	if !strings.Contains(requests[3], `"alias":"archived-db.col"`) {
+		t.Fatalf("Expected archive to be aliased: %s", requests[3])
+	}
+	// close mode closes the clone so that the index name can be reused
+	requests = nil
+	ic.config.DropArchive.Mode = dropArchiveClose
+	if err := ic.deleteIndex("db.col"); err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, "POST /"+target+"/_close")
+	if len(requests) != len(expected) {
+		t.Fatalf("Expected %d requests but got %v", len(expected), requests)
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(requests[i], e+" ") {
+			t.Fatalf("Expected request %s but got %s", e, requests[i])
+		}
+	}
+	// a failed delete unblocks the index and removes the clone
+	requests = nil
+	failDelete = true
+	ic.config.DropArchive.Mode = dropArchiveClone
+	if err := ic.deleteIndex("db.col"); err == nil {
+		t.Fatalf("Expected error when the index cannot be deleted")
+	}
+	expected = []string{
+		"GET /db.col",
+		"PUT /db.col/_settings",
+		"POST /db.col/_clone/" + target,
+		"POST /_aliases",
+		"DELETE /db.col",
+		"HEAD /db.col",
+		"PUT /db.col/_settings",
+		"DELETE /" + target,
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("Expected %d requests but got %v", len(expected), requests)
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(requests[i], e+" ") {
+			t.Fatalf("Expected request %s but got %s", e, requests[i])
+		}
+	}
+	if !strings.Contains(requests[6], `{"index.blocks.write":null}`) {
+		t.Fatalf("Expected write block to be removed: %s", requests[6])
+	}
+	// retention only runs while the process is enabled
+	ic.statusReqC = make(chan *statusRequest)
+	go func() {
+		req := <-ic.statusReqC
+		req.responseC <- &statusResponse{enabled: false}
+	}()
+	if ic.isEnabled(context.Background()) {
+		t.Fatalf("Expected process not to be enabled")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if ic.isEnabled(ctx) {
+		t.Fatalf("Expected stopped retention not to wait for the event loop")
+	}
+}
+
+func TestDDLEvents(t *testing.T) {
+	config := &configOptions{
+		DDLScript: []javascript{{
+			Namespace: "db.col",
+			Script: `module.exports = function(event, ns, ctx) {
+				seen = event.type + ":" + ns + ":" + event.operationDescription.idType;
+			}`,
+		}, {
+			Namespace: "db.fail",
+			Script:    `module.exports = function() { throw "bad event"; }`,
+			OnError:   failScriptErrorPolicy,
+		}},
+		CreateIndex: []*createIndex{{
+			Body: `{"settings": {"number_of_shards": 2}}`,
+		}},
+	}
+	config.loadDDLScripts()
+	config.loadCreateIndexes()
+	defer func() {
+		ddlEnvs = make(map[string]*executionEnv)
+		createIndexes = make(map[string]*createIndex)
+	}()
+	var requests []string
+	ic, ts := newTestIndexClient(t, config, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"acknowledged": true}`)
+	})
+	defer ts.Close()
+	defer ic.bulk.Close()
+	op := ddlOp("create", "db.col", map[string]interface{}{"idType": "objectId"}, primitive.Timestamp{T: 1})
+	if ddl, ok := ddlOf(op); !ok || ddl != "create" {
+		t.Fatalf("Expected create DDL op")
+	}
+	if err := ic.routeOp(op); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || !strings.HasPrefix(requests[1], `PUT /db.col {"settings":{"number_of_shards":2}}`) {
+		t.Fatalf("Expected index to be created from the configured body but got %v", requests)
+	}
+	seen, err := ddlEnvs["db.col"].VM.Get("seen")
+	if err != nil || seen.String() != "create:db.col:objectId" {
+		t.Fatalf("Expected DDL script to see the event but got %v", seen)
+	}
+	// each DDL stream saves its resume token under its own stream id
+	if ddlStreamID("") != "ddl" || ddlStreamID("db") != "ddl:db" {
+		t.Fatalf("Expected DDL streams to be named by scope")
+	}
+	if token, err := ic.loadDDLToken("ddl:db"); token != nil || err != nil {
+		t.Fatalf("Expected no saved token without resume but got %v %v", token, err)
+	}
+	// a failing DDL script under the fail policy stops processing
+	if err := ic.routeDDL(ddlOp("drop", "db.fail", nil, primitive.Timestamp{T: 2}), "drop"); !isFatal(err) {
+		t.Fatalf("Expected fatal error from failing DDL script but got %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package monstachemap
 
 import (
+	"context"
+
 	"github.com/olivere/elastic/v7"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -15,6 +17,23 @@ import (
 // plugins can be compiled using go build -buildmode=plugin -o myplugin.so myplugin.go
 // to enable the plugin start with monstache -mapper-plugin-path /path/to/myplugin.so
 
+// plugins may implement a function named "Init" to set up resources from the
+// mapper-plugin-settings table in the TOML config
+// func Init(settings map[string]interface{}) error
+
+// plugins may implement a function named "Delete" to control how deletes are applied
+// func Delete(input *monstachemap.MapperPluginInput) (output *monstachemap.DeletePluginOutput, err error)
+
+// plugins may implement a function named "ProcessBatch" to receive the inputs to Process in batches
+// batches are flushed by size (process-batch-size) and time (process-batch-seconds)
+// func ProcessBatch(inputs []*monstachemap.ProcessPluginInput) error
+
+// plugins may implement a function named "Close" to release resources when monstache shuts down
+// func Close() error
+
+// plugins can also run out-of-process with monstache -mapper-plugin-command /path/to/executable
+// see stdio.go for the protocol and the ServeStdio helper
+
 // MapperPluginInput is the input to the Map function
 type MapperPluginInput struct {
 	Document          map[string]interface{} // the original document from MongoDB
@@ -24,6 +43,15 @@ type MapperPluginInput struct {
 	Operation         string                 // "i" for a insert or "u" for update
 	MongoClient       *mongo.Client          // MongoDB driver client
 	UpdateDescription map[string]interface{} // map describing changes to the document
+	Context           context.Context        // canceled when monstache shuts down
+	Logger            Logger                 // writes to the monstache logs
+}
+
+// Logger writes plugin messages to the monstache logs
+type Logger interface {
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
 }
 
 // MapperPluginOutput is the output of the Map function
@@ -41,6 +69,26 @@ type MapperPluginOutput struct {
 	RetryOnConflict int                    // how many times to retry updates before failing
 	Skip            bool                   // set to true to indicate the the document should be ignored
 	ID              string                 // override the _id of the indexed document; not recommended
+	Documents       []*DerivedDocument     // additional documents to index; removed when the original document is deleted
+}
+
+// DerivedDocument is an additional document indexed for a MongoDB document
+type DerivedDocument struct {
+	Document map[string]interface{} `bson:"document"`           // the document to index
+	Index    string                 `bson:"index,omitempty"`    // the name of the index to use; defaults to the index of the original document
+	ID       string                 `bson:"id"`                 // the id of the document; required
+	Routing  string                 `bson:"routing,omitempty"`  // the routing value to use
+	Pipeline string                 `bson:"pipeline,omitempty"` // the pipeline to index with
+}
+
+// DeletePluginOutput is the output of the Delete function. A nil output
+// deletes the document as usual
+type DeletePluginOutput struct {
+	Index   string `bson:"index,omitempty"`   // the name of the index to delete from
+	ID      string `bson:"id,omitempty"`      // the _id of the document to delete
+	Routing string `bson:"routing,omitempty"` // the routing value to use
+	Parent  string `bson:"parent,omitempty"`  // the parent id to use
+	Skip    bool   `bson:"skip,omitempty"`    // set to true to leave the document in Elasticsearch
 }
 
 // ProcessPluginInput is the input to the Process function
@@ -0,0 +1,373 @@
+package monstachemap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Out-of-process plugins are regular executables started by monstache with
+// -mapper-plugin-command.  They do not need to be built with the same Go
+// toolchain or dependencies as monstache.
+//
+// Monstache and the plugin exchange messages over the plugin's stdin and
+// stdout.  Each message is a single BSON document.  BSON documents begin
+// with their total length as a little-endian int32, so every message is
+// length-prefixed.  The plugin must not write anything else to stdout; use
+// stderr for logging.
+//
+// A message has the following fields
+//
+//	id      int64   set by monstache on requests and echoed in the response
+//	method  string  hello, init, map, filter, delete, process, processBatch,
+//	                pipeline or close
+//	input   doc     the request input (see StdioInput)
+//	output  doc     the response output (see StdioOutput)
+//	error   string  set on a response when the method failed
+//
+// Monstache first sends a hello request.  The plugin answers with the list
+// of methods it implements in output.methods.  Monstache then sends one
+// request at a time and waits for the response with the same id.  If the
+// plugin implements init it receives the mapper-plugin-settings in
+// input.settings before any other request.  If it implements close it is
+// called before monstache closes stdin on shutdown.  A plugin which exits
+// is restarted by monstache and receives hello and init again before the
+// next request.
+//
+// Plugins written in Go can use ServeStdio which implements the protocol:
+//
+//	func main() {
+//		monstachemap.ServeStdio(&monstachemap.StdioPlugin{Map: myMap})
+//	}
+
+// Methods of the stdio plugin protocol
+const (
+	StdioHello        = "hello"
+	StdioInit         = "init"
+	StdioClose        = "close"
+	StdioMap          = "map"
+	StdioFilter       = "filter"
+	StdioDelete       = "delete"
+	StdioProcess      = "process"
+	StdioProcessBatch = "processBatch"
+	StdioPipeline     = "pipeline"
+)
+
+// StdioMessage is a request or response exchanged with a stdio plugin
+type StdioMessage struct {
+	ID     int64        `bson:"id"`
+	Method string       `bson:"method,omitempty"`
+	Input  *StdioInput  `bson:"input,omitempty"`
+	Output *StdioOutput `bson:"output,omitempty"`
+	Error  string       `bson:"error,omitempty"`
+}
+
+// StdioInput is the input to a stdio plugin method
+type StdioInput struct {
+	Document          map[string]interface{} `bson:"document,omitempty"`
+	Database          string                 `bson:"database,omitempty"`
+	Collection        string                 `bson:"collection,omitempty"`
+	Namespace         string                 `bson:"namespace,omitempty"`
+	Operation         string                 `bson:"operation,omitempty"`
+	UpdateDescription map[string]interface{} `bson:"updateDescription,omitempty"`
+	Timestamp         primitive.Timestamp    `bson:"timestamp,omitempty"`
+	ChangeEvent       bool                   `bson:"changeEvent,omitempty"`
+	Settings          map[string]interface{} `bson:"settings,omitempty"`
+	Inputs            []*StdioInput          `bson:"inputs,omitempty"` // processBatch: the input of each op
+}
+
+// StdioOutput is the output of a stdio plugin method
+type StdioOutput struct {
+	Methods  []string            `bson:"methods,omitempty"`  // hello: the methods implemented
+	Map      *StdioMapOutput     `bson:"map,omitempty"`      // map: nil to index the document unchanged
+	Filter   bool                `bson:"filter"`             // filter: true to keep the document
+	Delete   *DeletePluginOutput `bson:"delete,omitempty"`   // delete: nil to delete the document as usual
+	Requests []*BulkRequest      `bson:"requests,omitempty"` // process: requests to add to the bulk processor
+	Pipeline []interface{}       `bson:"pipeline,omitempty"` // pipeline: the aggregation stages
+}
+
+// StdioMapOutput is the wire form of MapperPluginOutput
+type StdioMapOutput struct {
+	Document        map[string]interface{} `bson:"document,omitempty"`
+	Index           string                 `bson:"index,omitempty"`
+	Type            string                 `bson:"type,omitempty"`
+	Routing         string                 `bson:"routing,omitempty"`
+	Drop            bool                   `bson:"drop,omitempty"`
+	Passthrough     bool                   `bson:"passthrough,omitempty"`
+	Parent          string                 `bson:"parent,omitempty"`
+	Version         int64                  `bson:"version,omitempty"`
+	VersionType     string                 `bson:"versionType,omitempty"`
+	Pipeline        string                 `bson:"pipeline,omitempty"`
+	RetryOnConflict int                    `bson:"retryOnConflict,omitempty"`
+	Skip            bool                   `bson:"skip,omitempty"`
+	ID              string                 `bson:"id,omitempty"`
+	Documents       []*DerivedDocument     `bson:"documents,omitempty"`
+}
+
+// BulkRequest is a request returned by a stdio Process function. Since the
+// plugin has no access to the Elasticsearch client monstache adds these
+// requests to its bulk processor on behalf of the plugin.
+type BulkRequest struct {
+	Action   string                 `bson:"action"` // index, update or delete
+	Index    string                 `bson:"index"`
+	ID       string                 `bson:"id"`
+	Routing  string                 `bson:"routing,omitempty"`
+	Pipeline string                 `bson:"pipeline,omitempty"`
+	Document map[string]interface{} `bson:"document,omitempty"` // the source for index or the partial doc for update
+}
+
+// StdioPlugin holds the functions implemented by a stdio plugin. Nil
+// functions are not advertised to monstache.
+type StdioPlugin struct {
+	Init         func(map[string]interface{}) error
+	Close        func() error
+	Map          func(*MapperPluginInput) (*MapperPluginOutput, error)
+	Filter       func(*MapperPluginInput) (bool, error)
+	Delete       func(*MapperPluginInput) (*DeletePluginOutput, error)
+	Process      func(*ProcessPluginInput) ([]*BulkRequest, error)
+	ProcessBatch func([]*ProcessPluginInput) ([]*BulkRequest, error)
+	Pipeline     func(string, bool) ([]interface{}, error)
+}
+
+var stdioRegistry = newStdioRegistry()
+
+func newStdioRegistry() *bsoncodec.Registry {
+	rb := bson.NewRegistryBuilder()
+	rb.RegisterTypeMapEntry(bsontype.DateTime, reflect.TypeOf(time.Time{}))
+	rb.RegisterTypeMapEntry(bsontype.EmbeddedDocument, reflect.TypeOf(map[string]interface{}{}))
+	rb.RegisterTypeMapEntry(bsontype.Array, reflect.TypeOf([]interface{}{}))
+	return rb.Build()
+}
+
+// ReadStdioMessage reads the next message from r
+func ReadStdioMessage(r io.Reader) (*StdioMessage, error) {
+	raw, err := bson.ReadDocument(r)
+	if err != nil {
+		return nil, err
+	}
+	msg := &StdioMessage{}
+	if err = bson.UnmarshalWithRegistry(stdioRegistry, raw, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteStdioMessage writes msg to w
+func WriteStdioMessage(w io.Writer, msg *StdioMessage) error {
+	b, err := bson.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// NewMapperPluginInput converts the input of a stdio request
+func (in *StdioInput) NewMapperPluginInput() *MapperPluginInput {
+	if in == nil {
+		in = &StdioInput{}
+	}
+	return &MapperPluginInput{
+		Document:          in.Document,
+		Database:          in.Database,
+		Collection:        in.Collection,
+		Namespace:         in.Namespace,
+		Operation:         in.Operation,
+		UpdateDescription: in.UpdateDescription,
+	}
+}
+
+// NewStdioMapOutput converts the output of a Map function for the wire
+func NewStdioMapOutput(out *MapperPluginOutput) *StdioMapOutput {
+	if out == nil {
+		return nil
+	}
+	return &StdioMapOutput{
+		Document:        out.Document,
+		Index:           out.Index,
+		Type:            out.Type,
+		Routing:         out.Routing,
+		Drop:            out.Drop,
+		Passthrough:     out.Passthrough,
+		Parent:          out.Parent,
+		Version:         out.Version,
+		VersionType:     out.VersionType,
+		Pipeline:        out.Pipeline,
+		RetryOnConflict: out.RetryOnConflict,
+		Skip:            out.Skip,
+		ID:              out.ID,
+		Documents:       out.Documents,
+	}
+}
+
+// MapperPluginOutput converts the wire form back to a MapperPluginOutput
+func (out *StdioMapOutput) MapperPluginOutput() *MapperPluginOutput {
+	if out == nil {
+		return nil
+	}
+	return &MapperPluginOutput{
+		Document:        out.Document,
+		Index:           out.Index,
+		Type:            out.Type,
+		Routing:         out.Routing,
+		Drop:            out.Drop,
+		Passthrough:     out.Passthrough,
+		Parent:          out.Parent,
+		Version:         out.Version,
+		VersionType:     out.VersionType,
+		Pipeline:        out.Pipeline,
+		RetryOnConflict: out.RetryOnConflict,
+		Skip:            out.Skip,
+		ID:              out.ID,
+		Documents:       out.Documents,
+	}
+}
+
+func (p *StdioPlugin) methods() []string {
+	var methods []string
+	if p.Init != nil {
+		methods = append(methods, StdioInit)
+	}
+	if p.Close != nil {
+		methods = append(methods, StdioClose)
+	}
+	if p.Map != nil {
+		methods = append(methods, StdioMap)
+	}
+	if p.Filter != nil {
+		methods = append(methods, StdioFilter)
+	}
+	if p.Delete != nil {
+		methods = append(methods, StdioDelete)
+	}
+	if p.Process != nil {
+		methods = append(methods, StdioProcess)
+	}
+	if p.ProcessBatch != nil {
+		methods = append(methods, StdioProcessBatch)
+	}
+	if p.Pipeline != nil {
+		methods = append(methods, StdioPipeline)
+	}
+	return methods
+}
+
+func (p *StdioPlugin) handle(req *StdioMessage) (out *StdioOutput, err error) {
+	out = &StdioOutput{}
+	switch req.Method {
+	case StdioHello:
+		out.Methods = p.methods()
+	case StdioInit:
+		if p.Init == nil {
+			return nil, errors.New("Init is not implemented")
+		}
+		var settings map[string]interface{}
+		if req.Input != nil {
+			settings = req.Input.Settings
+		}
+		err = p.Init(settings)
+	case StdioClose:
+		if p.Close == nil {
+			return nil, errors.New("Close is not implemented")
+		}
+		err = p.Close()
+	case StdioMap:
+		if p.Map == nil {
+			return nil, errors.New("Map is not implemented")
+		}
+		var mapped *MapperPluginOutput
+		if mapped, err = p.Map(req.Input.NewMapperPluginInput()); err == nil {
+			out.Map = NewStdioMapOutput(mapped)
+		}
+	case StdioFilter:
+		if p.Filter == nil {
+			return nil, errors.New("Filter is not implemented")
+		}
+		out.Filter, err = p.Filter(req.Input.NewMapperPluginInput())
+	case StdioDelete:
+		if p.Delete == nil {
+			return nil, errors.New("Delete is not implemented")
+		}
+		out.Delete, err = p.Delete(req.Input.NewMapperPluginInput())
+	case StdioProcess:
+		if p.Process == nil {
+			return nil, errors.New("Process is not implemented")
+		}
+		input := &ProcessPluginInput{MapperPluginInput: *req.Input.NewMapperPluginInput()}
+		if req.Input != nil {
+			input.Timestamp = req.Input.Timestamp
+		}
+		out.Requests, err = p.Process(input)
+	case StdioProcessBatch:
+		if p.ProcessBatch == nil {
+			return nil, errors.New("ProcessBatch is not implemented")
+		}
+		var inputs []*ProcessPluginInput
+		if req.Input != nil {
+			for _, in := range req.Input.Inputs {
+				input := &ProcessPluginInput{MapperPluginInput: *in.NewMapperPluginInput()}
+				if in != nil {
+					input.Timestamp = in.Timestamp
+				}
+				inputs = append(inputs, input)
+			}
+		}
+		out.Requests, err = p.ProcessBatch(inputs)
+	case StdioPipeline:
+		if p.Pipeline == nil {
+			return nil, errors.New("Pipeline is not implemented")
+		}
+		var ns string
+		var changeEvent bool
+		if req.Input != nil {
+			ns, changeEvent = req.Input.Namespace, req.Input.ChangeEvent
+		}
+		out.Pipeline, err = p.Pipeline(ns, changeEvent)
+	default:
+		return nil, fmt.Errorf("Unknown method %q", req.Method)
+	}
+	return
+}
+
+// Serve answers requests read from r by writing responses to w until r is
+// closed
+func (p *StdioPlugin) Serve(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for {
+		req, err := ReadStdioMessage(br)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		resp := &StdioMessage{ID: req.ID}
+		out, err := p.handle(req)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Output = out
+		}
+		if err = WriteStdioMessage(bw, resp); err != nil {
+			return err
+		}
+		if err = bw.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// ServeStdio runs the plugin over the process stdin and stdout. It returns
+// when monstache closes stdin.
+func ServeStdio(p *StdioPlugin) error {
+	return p.Serve(os.Stdin, os.Stdout)
+}
@@ -0,0 +1,100 @@
+package lru
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache is a fixed size least recently used cache whose entries optionally
+// expire after a time to live.  It is safe for concurrent use.
+type Cache struct {
+	size    int
+	ttl     time.Duration
+	ll      *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+	m       sync.Mutex
+}
+
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// New returns a cache holding at most size entries.  A ttl of zero means
+// that entries only leave the cache when evicted.
+func New(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		size:    size,
+		ttl:     ttl,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// Get returns the value stored under key if present and not expired
+func (c *Cache) Get(key string) (value interface{}, ok bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	el, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if !e.expires.IsZero() && c.now().After(e.expires) {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+// Add stores value under key using the default time to live of the cache
+func (c *Cache) Add(key string, value interface{}) {
+	c.AddWithTTL(key, value, c.ttl)
+}
+
+// AddWithTTL stores value under key expiring after ttl.  A ttl of zero
+// means that the entry does not expire.
+func (c *Cache) AddWithTTL(key string, value interface{}, ttl time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var expires time.Time
+	if ttl > 0 {
+		expires = c.now().Add(ttl)
+	}
+	if el, found := c.entries[key]; found {
+		e := el.Value.(*entry)
+		e.value, e.expires = value, expires
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.ll.PushFront(&entry{key: key, value: value, expires: expires})
+	for c.size > 0 && c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Len returns the number of entries in the cache including expired
+// entries which have not yet been removed
+func (c *Cache) Len() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.ll.Len()
+}
+
+// Purge removes all entries from the cache
+func (c *Cache) Purge() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.ll.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.entries, el.Value.(*entry).key)
+}
@@ -0,0 +1,64 @@
+package lru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New(2, 0)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("Expected a to be cached")
+	}
+	c.Add("c", 3)
+	if _, ok := c.Get("b"); ok {
+		t.Fatalf("Expected b to be evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf("Expected a to be retained")
+	}
+	if v, ok := c.Get("c"); !ok || v != 3 {
+		t.Fatalf("Expected c to be cached")
+	}
+	if c.Len() != 2 {
+		t.Fatalf("Expected 2 entries but got %d", c.Len())
+	}
+}
+
+func TestCacheExpiresEntries(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New(10, time.Minute)
+	c.now = func() time.Time { return now }
+	c.Add("a", 1)
+	c.AddWithTTL("b", 2, time.Hour)
+	c.AddWithTTL("c", nil, 0)
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Fatalf("Expected a to expire")
+	}
+	if v, ok := c.Get("b"); !ok || v != 2 {
+		t.Fatalf("Expected b to be cached")
+	}
+	if v, ok := c.Get("c"); !ok || v != nil {
+		t.Fatalf("Expected nil value for c to be cached without expiry")
+	}
+	if c.Len() != 2 {
+		t.Fatalf("Expected expired entry to be removed")
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	c := New(10, 0)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Purge()
+	if _, ok := c.Get("a"); ok || c.Len() != 0 {
+		t.Fatalf("Expected cache to be empty after purge")
+	}
+	c.Add("c", 3)
+	if v, ok := c.Get("c"); !ok || v != 3 {
+		t.Fatalf("Expected cache to be usable after purge")
+	}
+}
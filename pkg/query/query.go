@@ -0,0 +1,543 @@
+// Package query compiles MongoDB query documents into matchers which are
+// evaluated against documents in process.  A subset of the query language is
+// supported: $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $regex,
+// $options, $size and $not on fields, and $and, $or and $nor at the top level
+// of any query document.  Fields may be dotted paths which traverse embedded
+// documents and arrays.
+package query
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Query is a compiled query document
+type Query struct {
+	doc   map[string]interface{}
+	match matcher
+}
+
+type matcher func(doc map[string]interface{}) bool
+
+// valueMatcher is given the values found at a field path along with the
+// elements of any arrays among them
+type valueMatcher func(values []interface{}, candidates []interface{}) bool
+
+// Parse compiles a query document given as Extended JSON
+func Parse(ext string) (*Query, error) {
+	var doc bson.M
+	if err := bson.UnmarshalExtJSON([]byte(ext), false, &doc); err != nil {
+		return nil, fmt.Errorf("query must be an Extended JSON document: %s", err)
+	}
+	return Compile(doc)
+}
+
+// Compile compiles a query document
+func Compile(doc map[string]interface{}) (*Query, error) {
+	m, err := compileDoc(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &Query{doc: doc, match: m}, nil
+}
+
+// Match returns true if doc satisfies the query
+func (q *Query) Match(doc map[string]interface{}) bool {
+	return q.match(doc)
+}
+
+// Document returns the query document which was compiled
+func (q *Query) Document() map[string]interface{} {
+	return q.doc
+}
+
+// Prefixed returns the query document with every field path prefixed by
+// prefix, e.g. to match against the fullDocument of change events
+func (q *Query) Prefixed(prefix string) map[string]interface{} {
+	return prefixDoc(q.doc, prefix)
+}
+
+func prefixDoc(doc map[string]interface{}, prefix string) map[string]interface{} {
+	out := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		switch k {
+		case "$and", "$or", "$nor":
+			var clauses []interface{}
+			for _, c := range toSlice(v) {
+				clauses = append(clauses, prefixDoc(toDoc(c), prefix))
+			}
+			out[k] = clauses
+		default:
+			out[prefix+k] = v
+		}
+	}
+	return out
+}
+
+func compileDoc(doc map[string]interface{}) (matcher, error) {
+	var ms []matcher
+	for k, v := range doc {
+		var m matcher
+		var err error
+		switch k {
+		case "$and", "$or", "$nor":
+			m, err = compileLogical(k, v)
+		default:
+			if strings.HasPrefix(k, "$") {
+				return nil, fmt.Errorf("unsupported query operator %s", k)
+			}
+			m, err = compileField(k, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return func(doc map[string]interface{}) bool {
+		for _, m := range ms {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileLogical(op string, v interface{}) (matcher, error) {
+	clauses := toSlice(v)
+	if len(clauses) == 0 {
+		return nil, fmt.Errorf("%s must be a non-empty array", op)
+	}
+	var ms []matcher
+	for _, c := range clauses {
+		cd := toDoc(c)
+		if cd == nil {
+			return nil, fmt.Errorf("%s must be an array of documents", op)
+		}
+		m, err := compileDoc(cd)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return func(doc map[string]interface{}) bool {
+		for _, m := range ms {
+			matched := m(doc)
+			switch {
+			case op == "$and" && !matched:
+				return false
+			case op == "$or" && matched:
+				return true
+			case op == "$nor" && matched:
+				return false
+			}
+		}
+		return op != "$or"
+	}, nil
+}
+
+func compileField(path string, v interface{}) (matcher, error) {
+	var vm valueMatcher
+	var err error
+	if ops := toDoc(v); ops != nil && isOperatorDoc(ops) {
+		vm, err = compileOperators(ops)
+	} else {
+		vm, err = compileEq(v)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %s", path, err)
+	}
+	parts := strings.Split(path, ".")
+	return func(doc map[string]interface{}) bool {
+		values := lookup(doc, parts)
+		return vm(values, candidates(values))
+	}, nil
+}
+
+// isOperatorDoc reports whether any key of doc is an operator.  Documents
+// mixing operators and fields are then rejected by compileOperators.
+func isOperatorDoc(doc map[string]interface{}) bool {
+	for k := range doc {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func compileOperators(ops map[string]interface{}) (valueMatcher, error) {
+	var vms []valueMatcher
+	for op, arg := range ops {
+		var vm valueMatcher
+		var err error
+		switch op {
+		case "$eq":
+			vm, err = compileEq(arg)
+		case "$ne":
+			vm, err = compileEq(arg)
+			vm = not(vm)
+		case "$gt", "$gte", "$lt", "$lte":
+			vm = compileCompare(op, arg)
+		case "$in":
+			vm, err = compileIn(arg)
+		case "$nin":
+			vm, err = compileIn(arg)
+			vm = not(vm)
+		case "$exists":
+			exists := truthy(arg)
+			vm = func(values, _ []interface{}) bool {
+				return (len(values) > 0) == exists
+			}
+		case "$regex":
+			vm, err = compileRegex(arg, ops["$options"])
+		case "$options":
+			if _, found := ops["$regex"]; !found {
+				err = fmt.Errorf("$options requires $regex")
+			}
+			continue
+		case "$size":
+			size, ok := toFloat(arg)
+			if !ok {
+				err = fmt.Errorf("$size must be a number")
+				break
+			}
+			vm = func(values, _ []interface{}) bool {
+				for _, v := range values {
+					if a := toSlice(v); a != nil && float64(len(a)) == size {
+						return true
+					}
+				}
+				return false
+			}
+		case "$not":
+			if d := toDoc(arg); d != nil {
+				vm, err = compileOperators(d)
+			} else if _, ok := arg.(primitive.Regex); ok {
+				vm, err = compileEq(arg)
+			} else {
+				err = fmt.Errorf("$not must be a regex or an operator document")
+			}
+			if vm != nil {
+				vm = not(vm)
+			}
+		default:
+			err = fmt.Errorf("unsupported query operator %s", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, vm)
+	}
+	return func(values, cands []interface{}) bool {
+		for _, vm := range vms {
+			if !vm(values, cands) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func not(vm valueMatcher) valueMatcher {
+	return func(values, cands []interface{}) bool {
+		return !vm(values, cands)
+	}
+}
+
+func compileEq(arg interface{}) (valueMatcher, error) {
+	if re, ok := arg.(primitive.Regex); ok {
+		return compileRegex(re.Pattern, re.Options)
+	}
+	return func(values, cands []interface{}) bool {
+		if arg == nil && len(values) == 0 {
+			return true
+		}
+		for _, c := range cands {
+			if equal(c, arg) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func compileIn(arg interface{}) (valueMatcher, error) {
+	list := toSlice(arg)
+	if list == nil {
+		return nil, fmt.Errorf("$in and $nin must be arrays")
+	}
+	var vms []valueMatcher
+	for _, v := range list {
+		vm, err := compileEq(v)
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, vm)
+	}
+	return func(values, cands []interface{}) bool {
+		for _, vm := range vms {
+			if vm(values, cands) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func compileCompare(op string, arg interface{}) valueMatcher {
+	return func(_, cands []interface{}) bool {
+		for _, c := range cands {
+			if n, ok := compare(c, arg); ok {
+				switch op {
+				case "$gt":
+					if n > 0 {
+						return true
+					}
+				case "$gte":
+					if n >= 0 {
+						return true
+					}
+				case "$lt":
+					if n < 0 {
+						return true
+					}
+				case "$lte":
+					if n <= 0 {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+}
+
+func compileRegex(pattern interface{}, options interface{}) (valueMatcher, error) {
+	var expr string
+	switch p := pattern.(type) {
+	case string:
+		expr = p
+	case primitive.Regex:
+		expr = p.Pattern
+		if options == nil {
+			options = p.Options
+		}
+	default:
+		return nil, fmt.Errorf("$regex must be a string")
+	}
+	if opts, ok := options.(string); ok && opts != "" {
+		var flags string
+		for _, o := range opts {
+			switch o {
+			case 'i', 'm', 's':
+				flags += string(o)
+			default:
+				return nil, fmt.Errorf("unsupported regex option %c", o)
+			}
+		}
+		expr = "(?" + flags + ")" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(_, cands []interface{}) bool {
+		for _, c := range cands {
+			if s, ok := c.(string); ok && re.MatchString(s) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// lookup returns the values at path within v.  Arrays are traversed both by
+// numeric index and by matching the remaining path against each element.
+func lookup(v interface{}, parts []string) (values []interface{}) {
+	if len(parts) == 0 {
+		return []interface{}{v}
+	}
+	if d := toDoc(v); d != nil {
+		if child, found := d[parts[0]]; found {
+			return lookup(child, parts[1:])
+		}
+		return nil
+	}
+	if a := toSlice(v); a != nil {
+		if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 && i < len(a) {
+			values = append(values, lookup(a[i], parts[1:])...)
+		}
+		for _, e := range a {
+			if toDoc(e) != nil {
+				values = append(values, lookup(e, parts)...)
+			}
+		}
+	}
+	return
+}
+
+// candidates returns the values along with the elements of any arrays
+func candidates(values []interface{}) []interface{} {
+	var cands []interface{}
+	for _, v := range values {
+		cands = append(cands, v)
+		if a := toSlice(v); a != nil {
+			cands = append(cands, a...)
+		}
+	}
+	return cands
+}
+
+func equal(a, b interface{}) bool {
+	if n, ok := compare(a, b); ok {
+		return n == 0
+	}
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if da, db := toDoc(a), toDoc(b); da != nil && db != nil {
+		if len(da) != len(db) {
+			return false
+		}
+		for k, v := range da {
+			if w, found := db[k]; !found || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	if sa, sb := toSlice(a), toSlice(b); sa != nil && sb != nil {
+		if len(sa) != len(sb) {
+			return false
+		}
+		for i := range sa {
+			if !equal(sa[i], sb[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compare orders values of the same kind.  The second result is false when
+// the values cannot be compared.
+func compare(a, b interface{}) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			switch {
+			case fa < fb:
+				return -1, true
+			case fa > fb:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	if ta, ok := toTime(a); ok {
+		if tb, ok := toTime(b); ok {
+			switch {
+			case ta.Before(tb):
+				return -1, true
+			case ta.After(tb):
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	switch va := a.(type) {
+	case string:
+		if vb, ok := b.(string); ok {
+			return strings.Compare(va, vb), true
+		}
+	case bool:
+		if vb, ok := b.(bool); ok {
+			switch {
+			case va == vb:
+				return 0, true
+			case vb:
+				return -1, true
+			}
+			return 1, true
+		}
+	case primitive.ObjectID:
+		if vb, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(va[:], vb[:]), true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case primitive.DateTime:
+		return t.Time(), true
+	}
+	return time.Time{}, false
+}
+
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	return v != nil
+}
+
+func toDoc(v interface{}) map[string]interface{} {
+	switch d := v.(type) {
+	case map[string]interface{}:
+		return d
+	case primitive.M:
+		return d
+	case primitive.D:
+		return d.Map()
+	}
+	return nil
+}
+
+func toSlice(v interface{}) []interface{} {
+	switch a := v.(type) {
+	case []interface{}:
+		return a
+	case primitive.A:
+		return a
+	case []map[string]interface{}:
+		s := make([]interface{}, len(a))
+		for i, e := range a {
+			s[i] = e
+		}
+		return s
+	}
+	return nil
+}
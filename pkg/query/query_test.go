@@ -0,0 +1,89 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMatch(t *testing.T) {
+	created := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	doc := map[string]interface{}{
+		"status":  "active",
+		"tenant":  "a",
+		"count":   int32(5),
+		"created": primitive.NewDateTimeFromTime(created),
+		"tags":    []interface{}{"x", "y"},
+		"owner":   map[string]interface{}{"name": "Ann"},
+		"items": []interface{}{
+			map[string]interface{}{"sku": "s1", "qty": int64(1)},
+			map[string]interface{}{"sku": "s2", "qty": int64(3)},
+		},
+	}
+	tests := []struct {
+		query string
+		match bool
+	}{
+		{`{"status": "active", "tenant": {"$in": ["a", "b"]}}`, true},
+		{`{"status": "active", "tenant": {"$in": ["b", "c"]}}`, false},
+		{`{"tenant": {"$nin": ["b"]}}`, true},
+		{`{"count": {"$gt": 4.5, "$lte": 5}}`, true},
+		{`{"count": {"$lt": 5}}`, false},
+		{`{"count": {"$ne": 5}}`, false},
+		{`{"created": {"$gte": {"$date": "2021-01-01T00:00:00Z"}}}`, true},
+		{`{"deleted": {"$exists": false}}`, true},
+		{`{"deleted": null}`, true},
+		{`{"owner.name": {"$exists": true}}`, true},
+		{`{"owner.name": {"$regex": "^an", "$options": "i"}}`, true},
+		{`{"owner.name": {"$not": {"$regex": "^B"}}}`, true},
+		{`{"tags": "y"}`, true},
+		{`{"tags": {"$size": 2}}`, true},
+		{`{"items.sku": "s2"}`, true},
+		{`{"items.1.qty": {"$gt": 2}}`, true},
+		{`{"items.0.qty": {"$gt": 2}}`, false},
+		{`{"$or": [{"status": "deleted"}, {"count": 5}]}`, true},
+		{`{"$and": [{"status": "active"}, {"count": 6}]}`, false},
+		{`{"$nor": [{"status": "deleted"}]}`, true},
+	}
+	for _, test := range tests {
+		q, err := Parse(test.query)
+		if err != nil {
+			t.Fatalf("Unable to parse %s: %s", test.query, err)
+		}
+		if q.Match(doc) != test.match {
+			t.Errorf("Expected %s to match %v", test.query, test.match)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, query := range []string{
+		`{"$where": "true"}`,
+		`{"a": {"$elemMatch": {"b": 1}}}`,
+		`{"a": {"$in": 1}}`,
+		`{"$or": []}`,
+		`{"a": {"$regex": "("}}`,
+		`{"a": {"$gt": 1, "b": 2}}`,
+		`{"a": {"b": 2, "$gt": 1}}`,
+	} {
+		if _, err := Parse(query); err == nil {
+			t.Errorf("Expected error compiling %s", query)
+		}
+	}
+}
+
+func TestPrefixed(t *testing.T) {
+	q, err := Parse(`{"status": "active", "$or": [{"a": 1}, {"b.c": 2}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := q.Prefixed("fullDocument.")
+	if p["fullDocument.status"] != "active" {
+		t.Fatalf("Expected status to be prefixed: %v", p)
+	}
+	or := p["$or"].([]interface{})
+	if _, found := or[1].(map[string]interface{})["fullDocument.b.c"]; !found {
+		t.Fatalf("Expected $or clauses to be prefixed: %v", or)
+	}
+}